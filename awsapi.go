@@ -4,21 +4,28 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"sort"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ec2"
-	"github.com/aws/aws-sdk-go/service/ec2instanceconnect"
-	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2instanceconnect"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
 	"github.com/manifoldco/promptui"
 )
 
 const (
-	DocumentNameAwsStartPortForwardingSession string = "AWS-StartPortForwardingSession"
+	DocumentNameAwsStartPortForwardingSession             string = "AWS-StartPortForwardingSession"
+	DocumentNameAwsStartPortForwardingSessionToRemoteHost string = "AWS-StartPortForwardingSessionToRemoteHost"
+	// The default document of shell sessions, which Session Manager creates in the account.
+	DocumentNameSsmSessionManagerRunShell string = "SSM-SessionManagerRunShell"
+
+	// How long to wait for TerminateSession on exit.
+	SessionTerminateTimeout time.Duration = 5 * time.Second
 )
 
 type (
@@ -27,223 +34,334 @@ type (
 		DocumentName string                `json:"DocumentName"`
 		Parameters   SsmDocumentParameters `json:"Parameters"`
 	}
+	// SsmDocumentParameters is the parameters of the port forwarding documents. Host is the remote host of
+	// AWS-StartPortForwardingSessionToRemoteHost, which is reached through the instance.
 	SsmDocumentParameters struct {
+		Host            []string `json:"host,omitempty"`
 		PortNumber      []string `json:"portNumber"`
 		LocalPortNumber []string `json:"localPortNumber"`
 	}
+	// SsmShellDocument is the session parameter of shell sessions. The default document is used if DocumentName is empty.
+	SsmShellDocument struct {
+		Target       string              `json:"Target"`
+		DocumentName string              `json:"DocumentName,omitempty"`
+		Parameters   map[string][]string `json:"Parameters,omitempty"`
+	}
+	// SsmSession is the StartSession response passed to session-manager-plugin.
+	SsmSession struct {
+		SessionId  string `json:"SessionId"`
+		StreamUrl  string `json:"StreamUrl"`
+		TokenValue string `json:"TokenValue"`
+	}
 
 	Instance struct {
-		ID      string
-		TagName string
+		ID               string
+		TagName          string
+		AvailabilityZone string
+		Platform         string
+		PrivateIPAddress string
+		VpcID            string
+		SubnetID         string
+		State            string
+		Tags             map[string]string
 	}
 	Instances []Instance
 )
 
-func newAwsSession(profile string, cache bool, duration time.Duration) (sess *session.Session) {
-	if cache {
-		c, _ := NewCache(CachePath, profile)
-		credsCache, err := c.Load()
-		if err != nil {
-			sess = session.Must(
-				session.NewSessionWithOptions(
-					session.Options{
-						SharedConfigState:       session.SharedConfigEnable,
-						Profile:                 profile,
-						AssumeRoleDuration:      duration,
-						AssumeRoleTokenProvider: stscreds.StdinTokenProvider,
-					},
-				),
-			)
-			credsCache, _ := sess.Config.Credentials.Get()
-			c.Save(&credsCache, duration)
-		} else {
-			creds := credentials.NewStaticCredentialsFromCreds(*credsCache)
-			sess = session.Must(
-				session.NewSessionWithOptions(
-					session.Options{
-						Config: aws.Config{
-							Credentials: creds,
-						},
-						SharedConfigState:       session.SharedConfigEnable,
-						Profile:                 profile,
-						AssumeRoleDuration:      duration,
-						AssumeRoleTokenProvider: stscreds.StdinTokenProvider,
-					},
-				),
-			)
-		}
-	} else {
-		sess = session.Must(
-			session.NewSessionWithOptions(
-				session.Options{
-					SharedConfigState:       session.SharedConfigEnable,
-					Profile:                 profile,
-					AssumeRoleDuration:      duration,
-					AssumeRoleTokenProvider: stscreds.StdinTokenProvider,
-				},
-			),
-		)
-	}
-
-	return sess
-}
-
-func getRegion(sess *session.Session) (region string) {
-	region = *sess.Config.Region
-	return region
-}
-
 func getSsmApiUrl(region string) (url string) {
 	url = "https://ssm." + region + ".amazonaws.com"
 	return url
 }
 
-func getSsmSessionToken(ctx context.Context, sess *session.Session, instanceID, remotePortNumber, localPortNumber string) (tokens, sessionManagerParam string, err error) {
-	ssmClient := ssm.New(sess)
+// Start a port forwarding session to the port of the instance, or to the port of remoteHost through the instance if it is not empty.
+func getSsmSessionToken(ctx context.Context, client SessionStarter, instanceID, remoteHost, remotePortNumber, localPortNumber string) (tokens, sessionManagerParam, sessionID string, err error) {
+	documentName := DocumentNameAwsStartPortForwardingSession
+	parameters := SsmDocumentParameters{
+		PortNumber:      []string{remotePortNumber},
+		LocalPortNumber: []string{localPortNumber},
+	}
+	if remoteHost != "" {
+		documentName = DocumentNameAwsStartPortForwardingSessionToRemoteHost
+		parameters.Host = []string{remoteHost}
+	}
+
 	ssmInput := &ssm.StartSessionInput{
 		Target:       aws.String(instanceID),
-		DocumentName: aws.String(DocumentNameAwsStartPortForwardingSession),
-		Parameters: map[string][]*string{
-			"portNumber":      []*string{aws.String(remotePortNumber)},
-			"localPortNumber": []*string{aws.String(localPortNumber)},
+		DocumentName: aws.String(documentName),
+		Parameters: map[string][]string{
+			"portNumber":      parameters.PortNumber,
+			"localPortNumber": parameters.LocalPortNumber,
 		},
 	}
-	result, err := ssmClient.StartSessionWithContext(ctx, ssmInput)
+	if remoteHost != "" {
+		ssmInput.Parameters["host"] = parameters.Host
+	}
+	result, err := client.StartSession(ctx, ssmInput)
 	if err != nil {
-		return "", "", err
+		return "", "", "", wrapStartSessionError(err, instanceID)
 	}
 
-	tokensBytes, err := json.Marshal(result)
+	sessionID = aws.ToString(result.SessionId)
+	tokens, err = marshalSsmSession(result)
 	if err != nil {
-		return "", "", err
+		return "", "", "", err
 	}
-	tokens = string(tokensBytes)
 
 	sessionManagerParams := SsmDocument{
 		Target:       instanceID,
-		DocumentName: DocumentNameAwsStartPortForwardingSession,
-		Parameters: SsmDocumentParameters{
-			PortNumber:      []string{remotePortNumber},
-			LocalPortNumber: []string{localPortNumber},
-		},
+		DocumentName: documentName,
+		Parameters:   parameters,
 	}
 	sessionManagerParamsByte, err := json.Marshal(sessionManagerParams)
 	if err != nil {
-		return "", "", err
+		return "", "", "", err
 	}
 
 	sessionManagerParam = string(sessionManagerParamsByte)
 
-	return tokens, sessionManagerParam, nil
+	return tokens, sessionManagerParam, sessionID, nil
 }
 
-func sendSSHPublicKey(ctx context.Context, sess *session.Session, instanceID, username, publickeyFilePath string) (err error) {
-	az, err := getInstanceAZ(ctx, sess, instanceID)
+func getSsmShellSessionToken(ctx context.Context, client SessionStarter, instanceID, documentName string, parameters map[string][]string) (tokens, sessionManagerParam, sessionID string, err error) {
+	ssmInput := &ssm.StartSessionInput{
+		Target: aws.String(instanceID),
+	}
+	if documentName != "" {
+		ssmInput.DocumentName = aws.String(documentName)
+	}
+	if len(parameters) > 0 {
+		ssmInput.Parameters = parameters
+	}
+	result, err := client.StartSession(ctx, ssmInput)
 	if err != nil {
-		return err
+		return "", "", "", wrapStartSessionError(err, instanceID)
+	}
+
+	sessionID = aws.ToString(result.SessionId)
+	tokens, err = marshalSsmSession(result)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	sessionManagerParamsByte, err := json.Marshal(SsmShellDocument{
+		Target:       instanceID,
+		DocumentName: documentName,
+		Parameters:   parameters,
+	})
+	if err != nil {
+		return "", "", "", err
+	}
+
+	sessionManagerParam = string(sessionManagerParamsByte)
+	return tokens, sessionManagerParam, sessionID, nil
+}
+
+// Terminate the session so that it does not stay open on the server side until the idle timeout.
+// A new context is used because it is called on exit, after the context of the session is done.
+func terminateSsmSession(client SessionStarter, sessionID string) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), SessionTerminateTimeout)
+	defer cancel()
+
+	_, err = client.TerminateSession(ctx, &ssm.TerminateSessionInput{
+		SessionId: aws.String(sessionID),
+	})
+	return wrapAwsError(err, "ssm:TerminateSession")
+}
+
+// Parse "Key=Value" formatted document parameters. A key given multiple times has multiple values.
+func parseDocumentParameters(parameterStrings []string) (parameters map[string][]string, err error) {
+	parameters = map[string][]string{}
+	for _, parameterString := range parameterStrings {
+		kv := strings.SplitN(parameterString, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			err = errors.New("invalid document parameter format: " + parameterString + " (expected Key=Value)")
+			return nil, err
+		}
+		parameters[kv[0]] = append(parameters[kv[0]], kv[1])
 	}
+	return parameters, nil
+}
 
+// Marshal the StartSession response into the tokens passed to session-manager-plugin.
+func marshalSsmSession(result *ssm.StartSessionOutput) (tokens string, err error) {
+	ssmSession := SsmSession{
+		SessionId:  aws.ToString(result.SessionId),
+		StreamUrl:  aws.ToString(result.StreamUrl),
+		TokenValue: aws.ToString(result.TokenValue),
+	}
+	tokensBytes, err := json.Marshal(ssmSession)
+	if err != nil {
+		return "", err
+	}
+
+	tokens = string(tokensBytes)
+	return tokens, nil
+}
+
+func wrapStartSessionError(err error, instanceID string) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "TargetNotConnected" {
+		return &TargetNotConnectedError{InstanceID: instanceID, Err: err}
+	}
+	return wrapAwsError(err, "ssm:StartSession")
+}
+
+func sendSSHPublicKey(ctx context.Context, client KeyPusher, instance *Instance, username, publickeyFilePath string) (err error) {
 	publicKey, err := readPublicKey(publickeyFilePath)
 	if err != nil {
 		return err
 	}
 
-	ec2InstanceConnectClient := ec2instanceconnect.New(sess)
 	ec2InstanceConnectInput := &ec2instanceconnect.SendSSHPublicKeyInput{
-		AvailabilityZone: aws.String(az),
-		InstanceId:       aws.String(instanceID),
+		AvailabilityZone: aws.String(instance.AvailabilityZone),
+		InstanceId:       aws.String(instance.ID),
 		InstanceOSUser:   aws.String(username),
 		SSHPublicKey:     aws.String(publicKey),
 	}
-	if result, err := ec2InstanceConnectClient.SendSSHPublicKeyWithContext(ctx, ec2InstanceConnectInput); err != nil {
-		return err
-	} else if !*result.Success {
-		return errors.New("SendSSHPublicKey request unsuccessful.")
+	if result, err := client.SendSSHPublicKey(ctx, ec2InstanceConnectInput); err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			switch apiErr.ErrorCode() {
+			case "EC2InstanceUnavailableException", "EC2InstanceTypeInvalidException", "EC2InstanceNotFoundException":
+				return &InstanceConnectUnavailableError{InstanceID: instance.ID, Err: err}
+			}
+		}
+		return wrapAwsError(err, "ec2-instance-connect:SendSSHPublicKey")
+	} else if !result.Success {
+		return &InstanceConnectUnavailableError{InstanceID: instance.ID, Err: errors.New("SendSSHPublicKey request unsuccessful.")}
 	}
 
 	return nil
 }
 
-func getInstanceAZ(ctx context.Context, sess *session.Session, instanceID string) (az string, err error) {
-	ec2Client := ec2.New(sess)
-	instance, err := getInstance(ctx, sess, instanceID)
+// Describe the instance once. Everything awssh needs about the target (AZ, platform, state, tags) comes from the result.
+func getInstance(ctx context.Context, client InstanceDiscoverer, instanceID string) (instance *Instance, err error) {
+	ec2Input := &ec2.DescribeInstancesInput{
+		InstanceIds: []string{
+			instanceID,
+		},
+	}
+	result, err := client.DescribeInstances(ctx, ec2Input)
 	if err != nil {
-		return "", err
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidInstanceID.NotFound" {
+			return nil, &InstanceNotFoundError{InstanceID: instanceID}
+		}
+		return nil, wrapAwsError(err, "ec2:DescribeInstances")
 	}
 
-	subnetId := instance.SubnetId
-	subnetInput := &ec2.DescribeSubnetsInput{
-		SubnetIds: []*string{subnetId},
+	for _, i := range instancesFromReservations(result.Reservations) {
+		if i.ID == instanceID {
+			instance = &i
+			return instance, nil
+		}
 	}
-	subnetResult, err := ec2Client.DescribeSubnetsWithContext(ctx, subnetInput)
+
+	return nil, &InstanceNotFoundError{InstanceID: instanceID}
+}
+
+func getRunningInstances(ctx context.Context, client InstanceDiscoverer) (instances Instances, err error) {
+	instances, err = describeRunningInstances(ctx, client)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	for _, subnet := range subnetResult.Subnets {
-		az = *subnet.AvailabilityZone
+	if len(instances) == 0 {
+		err = errors.New("No running instance")
+		return nil, err
 	}
 
-	return az, nil
+	return instances, nil
 }
 
-func getInstance(ctx context.Context, sess *session.Session, instanceID string) (instance *ec2.Instance, err error) {
-	ec2Client := ec2.New(sess)
-	ec2Input := &ec2.DescribeInstancesInput{
-		InstanceIds: []*string{
-			aws.String(instanceID),
-		},
-	}
-	result, err := ec2Client.DescribeInstancesWithContext(ctx, ec2Input)
+// Find the running instance by the Name tag. The name must match only one instance.
+func getRunningInstanceByName(ctx context.Context, client InstanceDiscoverer, name string) (instance *Instance, err error) {
+	instances, err := describeRunningInstances(ctx, client, types.Filter{
+		Name:   aws.String("tag:Name"),
+		Values: []string{name},
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	for _, reservation := range result.Reservations {
-		instance = reservation.Instances[0]
+	matched := Instances{}
+	for _, i := range instances {
+		if i.TagName == name {
+			matched = append(matched, i)
+		}
 	}
-	return instance, nil
+	switch len(matched) {
+	case 0:
+		return nil, &InstanceNotFoundError{InstanceID: name}
+	case 1:
+		return &matched[0], nil
+	}
+
+	ids := []string{}
+	for _, i := range matched {
+		ids = append(ids, i.ID)
+	}
+	err = errors.New("multiple running instances are named " + name + ": " + strings.Join(ids, ", ") + " (specify the instance-id)")
+	return nil, err
 }
 
-func getRunningInstances(ctx context.Context, sess *session.Session) (instances Instances, err error) {
-	ec2Client := ec2.New(sess)
+func describeRunningInstances(ctx context.Context, client InstanceDiscoverer, filters ...types.Filter) (instances Instances, err error) {
 	ec2Input := &ec2.DescribeInstancesInput{
-		Filters: []*ec2.Filter{
+		Filters: append([]types.Filter{
 			{
 				Name: aws.String("instance-state-name"),
-				Values: []*string{
-					aws.String("running"),
+				Values: []string{
+					"running",
 				},
 			},
-		},
+		}, filters...),
 	}
-	result, err := ec2Client.DescribeInstancesWithContext(ctx, ec2Input)
-	if err != nil {
-		return nil, err
+
+	paginator := ec2.NewDescribeInstancesPaginator(client, ec2Input)
+	for paginator.HasMorePages() {
+		result, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, wrapAwsError(err, "ec2:DescribeInstances")
+		}
+		instances = append(instances, instancesFromReservations(result.Reservations)...)
 	}
 
-	for _, reservation := range result.Reservations {
+	return instances, nil
+}
+
+func instancesFromReservations(reservations []types.Reservation) (instances Instances) {
+	for _, reservation := range reservations {
 		for _, instance := range reservation.Instances {
-			i := Instance{
-				ID: *instance.InstanceId,
-			}
-			for _, tag := range instance.Tags {
-				if *tag.Key == "Name" {
-					i.TagName = *tag.Value
-				}
-			}
-			instances = append(instances, i)
+			instances = append(instances, newInstance(instance))
 		}
 	}
-	if len(instances) == 0 {
-		err = errors.New("No running instance")
-		return nil, err
+
+	return instances
+}
+
+func newInstance(instance types.Instance) (i Instance) {
+	i = Instance{
+		ID:               aws.ToString(instance.InstanceId),
+		Platform:         aws.ToString(instance.PlatformDetails),
+		PrivateIPAddress: aws.ToString(instance.PrivateIpAddress),
+		VpcID:            aws.ToString(instance.VpcId),
+		SubnetID:         aws.ToString(instance.SubnetId),
+		Tags:             map[string]string{},
 	}
+	if instance.Placement != nil {
+		i.AvailabilityZone = aws.ToString(instance.Placement.AvailabilityZone)
+	}
+	if instance.State != nil {
+		i.State = string(instance.State.Name)
+	}
+	for _, tag := range instance.Tags {
+		i.Tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	i.TagName = i.Tags["Name"]
 
-	return instances, nil
+	return i
 }
 
-func selectInstance(instances Instances) (instanceID string, err error) {
+func selectInstance(instances Instances) (instance *Instance, err error) {
 	prompt := promptui.Select{
 		Label: "Instances",
 		Templates: &promptui.SelectTemplates{
@@ -255,67 +373,184 @@ func selectInstance(instances Instances) (instanceID string, err error) {
 		Items: instances,
 		Size:  50,
 		Searcher: func(input string, index int) bool {
-			item := instances[index]
-			instanceName := strings.Replace(strings.ToLower(item.TagName), " ", "", -1)
-			instanceID := strings.Replace(strings.ToLower(item.ID), " ", "", -1)
-			input = strings.Replace(strings.ToLower(input), " ", "", -1)
-			if strings.Contains(instanceName, input) {
-				return true
-			} else if strings.Contains(instanceID, input) {
-				return true
-			}
-			return false
+			return matchInstance(instances[index], input)
 		},
 		StartInSearchMode: true,
 	}
 
 	index, _, err := prompt.Run()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	instanceID = instances[index].ID
+	instance = &instances[index]
+
+	return instance, nil
+}
 
-	return instanceID, nil
+// Match the instance by the Name tag or instance-id, ignoring case and spaces.
+func matchInstance(instance Instance, input string) (matched bool) {
+	instanceName := strings.Replace(strings.ToLower(instance.TagName), " ", "", -1)
+	instanceID := strings.Replace(strings.ToLower(instance.ID), " ", "", -1)
+	input = strings.Replace(strings.ToLower(input), " ", "", -1)
+	if strings.Contains(instanceName, input) {
+		return true
+	} else if strings.Contains(instanceID, input) {
+		return true
+	}
+	return false
 }
 
-func createAMI(ctx context.Context, sess *session.Session, instanceID string) (imageId *string, err error) {
-	t := time.Now()
-	now := t.Format("20060102150405")
+func createAMI(ctx context.Context, clients *Clients, instanceID string, instanceTags map[string]string, opts SnapshotOptions) (imageId *string, err error) {
+	name, err := renderImageName(opts.NameTemplate, instanceID, instanceTags, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	principal, err := getCallerArn(ctx, clients.Identity)
+	if err != nil {
+		return nil, err
+	}
+
+	imageTags := buildImageTags(instanceID, principal, instanceTags, opts)
+	keys := make([]string, 0, len(imageTags))
+	for key := range imageTags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var tags []types.Tag
+	for _, key := range keys {
+		tags = append(tags, types.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(imageTags[key]),
+		})
+	}
 
-	ec2Client := ec2.New(sess)
 	ec2Input := &ec2.CreateImageInput{
 		Description: aws.String("Created by awssh command to auto snapshot. [" + instanceID + "]"),
 		InstanceId:  aws.String(instanceID),
-		Name:        aws.String(instanceID + "_" + now),
+		Name:        aws.String(name),
 		NoReboot:    aws.Bool(true),
+		TagSpecifications: []types.TagSpecification{
+			{
+				ResourceType: types.ResourceTypeImage,
+				Tags:         tags,
+			},
+			{
+				ResourceType: types.ResourceTypeSnapshot,
+				Tags:         tags,
+			},
+		},
 	}
-	result, err := ec2Client.CreateImageWithContext(ctx, ec2Input)
+	result, err := clients.Images.CreateImage(ctx, ec2Input)
 	if err != nil {
-		return nil, err
+		return nil, wrapAwsError(err, "ec2:CreateImage")
 	}
 
 	imageId = result.ImageId
+	return imageId, nil
+}
+
+func getCallerArn(ctx context.Context, client CallerIdentifier) (arn string, err error) {
+	result, err := client.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", wrapAwsError(err, "sts:GetCallerIdentity")
+	}
 
-	input := &ec2.CreateTagsInput{
-		Resources: []*string{
-			imageId,
+	arn = aws.ToString(result.Arn)
+	return arn, nil
+}
+
+func waitImageAvailable(ctx context.Context, client ImageCreator, imageID string) (err error) {
+	ec2Input := &ec2.DescribeImagesInput{
+		ImageIds: []string{
+			imageID,
 		},
-		Tags: []*ec2.Tag{
-			{
-				Key:   aws.String("instance-id"),
-				Value: aws.String(instanceID),
-			},
+	}
+	waiter := ec2.NewImageAvailableWaiter(client, func(o *ec2.ImageAvailableWaiterOptions) {
+		o.MinDelay = 15 * time.Second
+		o.MaxDelay = 15 * time.Second
+	})
+	err = waiter.Wait(ctx, ec2Input, 1*time.Hour)
+	return err
+}
+
+// Get AMIs created by awssh. If instanceID is not empty, only AMIs of the instance are returned.
+func getAwsshImages(ctx context.Context, client ImageCreator, instanceID string) (images Images, err error) {
+	ec2Input := &ec2.DescribeImagesInput{
+		Owners: []string{
+			"self",
+		},
+		Filters: []types.Filter{
 			{
-				Key:   aws.String("Created"),
-				Value: aws.String("awssh"),
+				Name: aws.String("tag:" + SnapshotTagKeyCreated),
+				Values: []string{
+					SnapshotTagValueCreated,
+				},
 			},
 		},
 	}
+	if instanceID != "" {
+		ec2Input.Filters = append(ec2Input.Filters, types.Filter{
+			Name: aws.String("tag:" + SnapshotTagKeyInstanceID),
+			Values: []string{
+				instanceID,
+			},
+		})
+	}
 
-	if _, err := ec2Client.CreateTags(input); err != nil {
-		return nil, err
+	paginator := ec2.NewDescribeImagesPaginator(client, ec2Input)
+	for paginator.HasMorePages() {
+		result, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, wrapAwsError(err, "ec2:DescribeImages")
+		}
+
+		for _, image := range result.Images {
+			i := Image{
+				ID:    aws.ToString(image.ImageId),
+				Name:  aws.ToString(image.Name),
+				State: string(image.State),
+			}
+			if creationDate, err := time.Parse(time.RFC3339, aws.ToString(image.CreationDate)); err == nil {
+				i.CreationDate = creationDate
+			}
+			for _, tag := range image.Tags {
+				if aws.ToString(tag.Key) == SnapshotTagKeyInstanceID {
+					i.InstanceID = aws.ToString(tag.Value)
+				}
+			}
+			for _, blockDevice := range image.BlockDeviceMappings {
+				if blockDevice.Ebs != nil && blockDevice.Ebs.SnapshotId != nil {
+					i.SnapshotIDs = append(i.SnapshotIDs, *blockDevice.Ebs.SnapshotId)
+				}
+			}
+			images = append(images, i)
+		}
 	}
+	images.sortByInstanceAndNewest()
 
-	return imageId, nil
+	return images, nil
+}
+
+// Deregister the image and delete the EBS snapshots it was backed by.
+func deleteImage(ctx context.Context, client ImageCreator, image Image) (err error) {
+	deregisterInput := &ec2.DeregisterImageInput{
+		ImageId: aws.String(image.ID),
+	}
+	if _, err = client.DeregisterImage(ctx, deregisterInput); err != nil {
+		return wrapAwsError(err, "ec2:DeregisterImage")
+	}
+
+	for _, snapshotID := range image.SnapshotIDs {
+		deleteInput := &ec2.DeleteSnapshotInput{
+			SnapshotId: aws.String(snapshotID),
+		}
+		if _, err = client.DeleteSnapshot(ctx, deleteInput); err != nil {
+			return wrapAwsError(err, "ec2:DeleteSnapshot")
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,424 @@
+package awssh
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+)
+
+type (
+	fakeEC2 struct {
+		pages          []*ec2.DescribeInstancesOutput
+		describeErr    error
+		images         []types.Image
+		createImage    *ec2.CreateImageInput
+		deregistered   []string
+		deletedSnaps   []string
+		describeImages *ec2.DescribeImagesInput
+	}
+	fakeSSM struct {
+		input      *ssm.StartSessionInput
+		terminated []string
+	}
+	fakeSTS struct {
+		arn string
+	}
+)
+
+func (f *fakeEC2) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	if f.describeErr != nil {
+		return nil, f.describeErr
+	}
+	if len(params.InstanceIds) > 0 {
+		for _, page := range f.pages {
+			for _, reservation := range page.Reservations {
+				for _, instance := range reservation.Instances {
+					if aws.ToString(instance.InstanceId) == params.InstanceIds[0] {
+						return &ec2.DescribeInstancesOutput{
+							Reservations: []types.Reservation{{Instances: []types.Instance{instance}}},
+						}, nil
+					}
+				}
+			}
+		}
+		return &ec2.DescribeInstancesOutput{}, nil
+	}
+
+	index := 0
+	if params.NextToken != nil {
+		index = len(*params.NextToken)
+	}
+	return f.pages[index], nil
+}
+
+func (f *fakeEC2) CreateImage(ctx context.Context, params *ec2.CreateImageInput, optFns ...func(*ec2.Options)) (*ec2.CreateImageOutput, error) {
+	f.createImage = params
+	return &ec2.CreateImageOutput{ImageId: aws.String("ami-new")}, nil
+}
+
+func (f *fakeEC2) DescribeImages(ctx context.Context, params *ec2.DescribeImagesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeImagesOutput, error) {
+	f.describeImages = params
+	return &ec2.DescribeImagesOutput{Images: f.images}, nil
+}
+
+func (f *fakeEC2) DeregisterImage(ctx context.Context, params *ec2.DeregisterImageInput, optFns ...func(*ec2.Options)) (*ec2.DeregisterImageOutput, error) {
+	f.deregistered = append(f.deregistered, aws.ToString(params.ImageId))
+	return &ec2.DeregisterImageOutput{}, nil
+}
+
+func (f *fakeEC2) DeleteSnapshot(ctx context.Context, params *ec2.DeleteSnapshotInput, optFns ...func(*ec2.Options)) (*ec2.DeleteSnapshotOutput, error) {
+	f.deletedSnaps = append(f.deletedSnaps, aws.ToString(params.SnapshotId))
+	return &ec2.DeleteSnapshotOutput{}, nil
+}
+
+func (f *fakeSSM) StartSession(ctx context.Context, params *ssm.StartSessionInput, optFns ...func(*ssm.Options)) (*ssm.StartSessionOutput, error) {
+	f.input = params
+	return &ssm.StartSessionOutput{
+		SessionId:  aws.String("session-id"),
+		StreamUrl:  aws.String("wss://example.com/stream"),
+		TokenValue: aws.String("token"),
+	}, nil
+}
+
+func (f *fakeSSM) TerminateSession(ctx context.Context, params *ssm.TerminateSessionInput, optFns ...func(*ssm.Options)) (*ssm.TerminateSessionOutput, error) {
+	f.terminated = append(f.terminated, aws.ToString(params.SessionId))
+	return &ssm.TerminateSessionOutput{SessionId: params.SessionId}, nil
+}
+
+func (f *fakeSTS) GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error) {
+	return &sts.GetCallerIdentityOutput{Arn: aws.String(f.arn)}, nil
+}
+
+func testInstance(id, name, az string) (instance types.Instance) {
+	instance = types.Instance{
+		InstanceId:       aws.String(id),
+		Placement:        &types.Placement{AvailabilityZone: aws.String(az)},
+		PlatformDetails:  aws.String("Linux/UNIX"),
+		PrivateIpAddress: aws.String("10.0.0.1"),
+		State:            &types.InstanceState{Name: types.InstanceStateNameRunning},
+	}
+	if name != "" {
+		instance.Tags = []types.Tag{{Key: aws.String("Name"), Value: aws.String(name)}}
+	}
+	return instance
+}
+
+func newFakeEC2() (f *fakeEC2) {
+	f = &fakeEC2{
+		pages: []*ec2.DescribeInstancesOutput{
+			{
+				Reservations: []types.Reservation{
+					{Instances: []types.Instance{testInstance("i-00000001", "web 01", "ap-northeast-1a"), testInstance("i-00000002", "", "ap-northeast-1a")}},
+				},
+				NextToken: aws.String("x"),
+			},
+			{
+				Reservations: []types.Reservation{
+					{Instances: []types.Instance{testInstance("i-00000003", "db", "ap-northeast-1c")}},
+				},
+			},
+		},
+	}
+	return f
+}
+
+func TestMatchInstance(t *testing.T) {
+	instance := Instance{ID: "i-0123456789abcdef0", TagName: "Web Server"}
+
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{input: "web", want: true},
+		{input: "WEBSERVER", want: true},
+		{input: "web server", want: true},
+		{input: "i-0123", want: true},
+		{input: "ABCDEF", want: true},
+		{input: "db", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := matchInstance(instance, tt.input); got != tt.want {
+			t.Errorf("matchInstance(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestGetRunningInstances(t *testing.T) {
+	got, err := getRunningInstances(context.Background(), newFakeEC2())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, instance := range got {
+		names = append(names, instance.ID+":"+instance.TagName)
+	}
+	want := []string{"i-00000001:web 01", "i-00000002:", "i-00000003:db"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("getRunningInstances() = %v, want %v", names, want)
+	}
+
+	empty := &fakeEC2{pages: []*ec2.DescribeInstancesOutput{{}}}
+	if _, err := getRunningInstances(context.Background(), empty); err == nil {
+		t.Error("getRunningInstances() error = nil, want error")
+	}
+}
+
+func TestGetRunningInstanceByName(t *testing.T) {
+	got, err := getRunningInstanceByName(context.Background(), newFakeEC2(), "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != "i-00000003" {
+		t.Errorf("getRunningInstanceByName() = %s, want i-00000003", got.ID)
+	}
+
+	var notFound *InstanceNotFoundError
+	if _, err := getRunningInstanceByName(context.Background(), newFakeEC2(), "missing"); !errors.As(err, &notFound) {
+		t.Errorf("getRunningInstanceByName() error = %v, want InstanceNotFoundError", err)
+	}
+
+	duplicated := &fakeEC2{pages: []*ec2.DescribeInstancesOutput{{
+		Reservations: []types.Reservation{
+			{Instances: []types.Instance{testInstance("i-00000001", "web", "ap-northeast-1a"), testInstance("i-00000002", "web", "ap-northeast-1c")}},
+		},
+	}}}
+	if _, err := getRunningInstanceByName(context.Background(), duplicated, "web"); err == nil || !strings.Contains(err.Error(), "i-00000001, i-00000002") {
+		t.Errorf("getRunningInstanceByName() error = %v, want multiple instances", err)
+	}
+}
+
+func TestGetInstance(t *testing.T) {
+	got, err := getInstance(context.Background(), newFakeEC2(), "i-00000003")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Instance{
+		ID:               "i-00000003",
+		TagName:          "db",
+		AvailabilityZone: "ap-northeast-1c",
+		Platform:         "Linux/UNIX",
+		PrivateIPAddress: "10.0.0.1",
+		State:            "running",
+		Tags:             map[string]string{"Name": "db"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getInstance() = %+v, want %+v", got, want)
+	}
+}
+
+func TestGetInstanceNotFound(t *testing.T) {
+	tests := []struct {
+		name   string
+		client *fakeEC2
+	}{
+		{
+			name:   "empty result",
+			client: newFakeEC2(),
+		},
+		{
+			name:   "api error",
+			client: &fakeEC2{describeErr: &smithy.GenericAPIError{Code: "InvalidInstanceID.NotFound", Message: "not found"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := getInstance(context.Background(), tt.client, "i-99999999")
+			var notFound *InstanceNotFoundError
+			if !errors.As(err, &notFound) || notFound.InstanceID != "i-99999999" {
+				t.Errorf("getInstance() error = %v, want InstanceNotFoundError", err)
+			}
+		})
+	}
+}
+
+func TestGetSsmSessionToken(t *testing.T) {
+	client := &fakeSSM{}
+	tokens, param, sessionID, err := getSsmSessionToken(context.Background(), client, "i-00000001", "", "22", "10022")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessionID != "session-id" {
+		t.Errorf("sessionID = %s", sessionID)
+	}
+
+	if aws.ToString(client.input.DocumentName) != DocumentNameAwsStartPortForwardingSession {
+		t.Errorf("DocumentName = %q", aws.ToString(client.input.DocumentName))
+	}
+
+	var session SsmSession
+	if err := json.Unmarshal([]byte(tokens), &session); err != nil {
+		t.Fatal(err)
+	}
+	if session != (SsmSession{SessionId: "session-id", StreamUrl: "wss://example.com/stream", TokenValue: "token"}) {
+		t.Errorf("tokens = %s", tokens)
+	}
+
+	want := `{"Target":"i-00000001","DocumentName":"AWS-StartPortForwardingSession","Parameters":{"portNumber":["22"],"localPortNumber":["10022"]}}`
+	if param != want {
+		t.Errorf("sessionManagerParam = %s, want %s", param, want)
+	}
+}
+
+func TestGetSsmSessionTokenToRemoteHost(t *testing.T) {
+	client := &fakeSSM{}
+	_, param, _, err := getSsmSessionToken(context.Background(), client, "i-00000001", "db.example.com", "5432", "15432")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if aws.ToString(client.input.DocumentName) != DocumentNameAwsStartPortForwardingSessionToRemoteHost {
+		t.Errorf("DocumentName = %q", aws.ToString(client.input.DocumentName))
+	}
+	if host := client.input.Parameters["host"]; len(host) != 1 || host[0] != "db.example.com" {
+		t.Errorf("Parameters = %v", client.input.Parameters)
+	}
+
+	want := `{"Target":"i-00000001","DocumentName":"AWS-StartPortForwardingSessionToRemoteHost","Parameters":{"host":["db.example.com"],"portNumber":["5432"],"localPortNumber":["15432"]}}`
+	if param != want {
+		t.Errorf("sessionManagerParam = %s, want %s", param, want)
+	}
+}
+
+func TestCreateAMI(t *testing.T) {
+	images := &fakeEC2{}
+	clients := &Clients{
+		Images:   images,
+		Identity: &fakeSTS{arn: "arn:aws:iam::123456789012:user/alice"},
+	}
+	opts := SnapshotOptions{
+		NameTemplate: "{{ .Name }}",
+		CopyTags:     []string{"Name"},
+	}
+
+	imageID, err := createAMI(context.Background(), clients, "i-00000001", map[string]string{"Name": "web"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.ToString(imageID) != "ami-new" {
+		t.Errorf("createAMI() = %q, want ami-new", aws.ToString(imageID))
+	}
+
+	input := images.createImage
+	if aws.ToString(input.Name) != "web" || !aws.ToBool(input.NoReboot) {
+		t.Errorf("CreateImage input = %+v", input)
+	}
+	if len(input.TagSpecifications) != 2 {
+		t.Fatalf("TagSpecifications = %+v", input.TagSpecifications)
+	}
+
+	var keys []string
+	for _, tag := range input.TagSpecifications[0].Tags {
+		keys = append(keys, aws.ToString(tag.Key))
+	}
+	want := []string{SnapshotTagKeyCreated, SnapshotTagKeyCreatedBy, "Name", SnapshotTagKeyInstanceID}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("tag keys = %v, want %v", keys, want)
+	}
+}
+
+func TestGetAwsshImagesAndDelete(t *testing.T) {
+	client := &fakeEC2{
+		images: []types.Image{
+			{
+				ImageId:      aws.String("ami-old"),
+				State:        types.ImageStateAvailable,
+				CreationDate: aws.String("2020-01-01T00:00:00.000Z"),
+				Tags:         []types.Tag{{Key: aws.String(SnapshotTagKeyInstanceID), Value: aws.String("i-00000001")}},
+				BlockDeviceMappings: []types.BlockDeviceMapping{
+					{Ebs: &types.EbsBlockDevice{SnapshotId: aws.String("snap-1")}},
+					{VirtualName: aws.String("ephemeral0")},
+				},
+			},
+			{
+				ImageId:      aws.String("ami-new"),
+				State:        types.ImageStatePending,
+				CreationDate: aws.String("2020-01-02T00:00:00.000Z"),
+				Tags:         []types.Tag{{Key: aws.String(SnapshotTagKeyInstanceID), Value: aws.String("i-00000001")}},
+			},
+		},
+	}
+
+	images, err := getAwsshImages(context.Background(), client, "i-00000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(client.describeImages.Filters) != 2 {
+		t.Errorf("DescribeImages filters = %+v", client.describeImages.Filters)
+	}
+	if got := imageIDs(images); !reflect.DeepEqual(got, []string{"ami-new", "ami-old"}) {
+		t.Errorf("getAwsshImages() = %v", got)
+	}
+	if !reflect.DeepEqual(images[1].SnapshotIDs, []string{"snap-1"}) {
+		t.Errorf("SnapshotIDs = %v", images[1].SnapshotIDs)
+	}
+
+	if err := deleteImage(context.Background(), client, images[1]); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(client.deregistered, []string{"ami-old"}) || !reflect.DeepEqual(client.deletedSnaps, []string{"snap-1"}) {
+		t.Errorf("deleteImage() deregistered %v, deleted %v", client.deregistered, client.deletedSnaps)
+	}
+}
+
+func TestParseDocumentParameters(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []string
+		want    map[string][]string
+		wantErr bool
+	}{
+		{name: "empty", input: nil, want: map[string][]string{}},
+		{name: "multiple values", input: []string{"command=ls, -l", "command=pwd", "shell=bash"}, want: map[string][]string{"command": {"ls, -l", "pwd"}, "shell": {"bash"}}},
+		{name: "invalid", input: []string{"command"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDocumentParameters(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDocumentParameters() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDocumentParameters() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTerminateSsmSession(t *testing.T) {
+	client := &fakeSSM{}
+	if err := terminateSsmSession(client, "session-id"); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.terminated) != 1 || client.terminated[0] != "session-id" {
+		t.Errorf("terminated sessions = %v", client.terminated)
+	}
+}
+
+func TestGetSsmShellSessionToken(t *testing.T) {
+	client := &fakeSSM{}
+	_, param, _, err := getSsmShellSessionToken(context.Background(), client, "i-00000001", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.input.DocumentName != nil || client.input.Parameters != nil {
+		t.Errorf("StartSession input = %+v, want the default document", client.input)
+	}
+	if param != `{"Target":"i-00000001"}` {
+		t.Errorf("sessionManagerParam = %s", param)
+	}
+}
@@ -0,0 +1,204 @@
+package awssh
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+const (
+	AwsCliCachePath string = "~/.aws/cli/cache"
+)
+
+type (
+	// AwsCliCacheFile is the AssumeRole response format the AWS CLI (botocore) writes to ~/.aws/cli/cache.
+	AwsCliCacheFile struct {
+		Credentials     AwsCliCacheCredentials `json:"Credentials"`
+		AssumedRoleUser map[string]string      `json:"AssumedRoleUser,omitempty"`
+	}
+	AwsCliCacheCredentials struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string `json:"SecretAccessKey"`
+		SessionToken    string `json:"SessionToken"`
+		Expiration      string `json:"Expiration"`
+	}
+)
+
+// Compute the cache file name the same way as botocore's AssumeRoleCredentialFetcher,
+// that is sha1 of the json.dumps(sort_keys=True) AssumeRole arguments. botocore excludes RoleSessionName.
+func awsCliCacheKey(pc *ProfileConfig) (key string) {
+	args := map[string]string{
+		"RoleArn": pythonJSONString(pc.RoleArn),
+	}
+	if pc.ExternalID != "" {
+		args["ExternalId"] = pythonJSONString(pc.ExternalID)
+	}
+	if pc.MfaSerial != "" {
+		args["SerialNumber"] = pythonJSONString(pc.MfaSerial)
+	}
+	if pc.DurationSeconds != 0 {
+		args["DurationSeconds"] = strconv.Itoa(pc.DurationSeconds)
+	}
+
+	keys := make([]string, 0, len(args))
+	for k := range args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, pythonJSONString(k)+": "+args[k])
+	}
+
+	sum := sha1.Sum([]byte("{" + strings.Join(pairs, ", ") + "}"))
+	key = hex.EncodeToString(sum[:])
+	return key
+}
+
+// Encode a string like Python's json.dumps with the default ensure_ascii=True.
+func pythonJSONString(s string) (encoded string) {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"':
+			b.WriteString(`\"`)
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\b':
+			b.WriteString(`\b`)
+		case r == '\f':
+			b.WriteString(`\f`)
+		case r < 0x20 || r > 0x7f:
+			if r > 0xffff {
+				r1, r2 := utf16Surrogates(r)
+				fmt.Fprintf(&b, `\u%04x\u%04x`, r1, r2)
+			} else {
+				fmt.Fprintf(&b, `\u%04x`, r)
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	encoded = b.String()
+	return encoded
+}
+
+func utf16Surrogates(r rune) (r1, r2 rune) {
+	r -= 0x10000
+	r1 = 0xd800 + (r>>10)&0x3ff
+	r2 = 0xdc00 + r&0x3ff
+	return r1, r2
+}
+
+func awsCliCacheFilePath(pc *ProfileConfig) (path string, err error) {
+	dir, err := homedir.Expand(AwsCliCachePath)
+	if err != nil {
+		return "", err
+	}
+
+	path = filepath.Join(dir, awsCliCacheKey(pc)+".json")
+	return path, nil
+}
+
+// Load AssumeRole credentials cached by the AWS CLI. ErrCacheExpired is returned if they expire within CacheRefreshWindow.
+func loadAwsCliCache(pc *ProfileConfig) (creds *aws.Credentials, err error) {
+	if pc.RoleArn == "" {
+		return nil, ErrCacheNotFound
+	}
+
+	path, err := awsCliCacheFilePath(pc)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrCacheNotFound
+		}
+		return nil, err
+	}
+
+	var f AwsCliCacheFile
+	if err = json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+
+	expiration, err := parseAwsCliCacheExpiration(f.Credentials.Expiration)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().Add(CacheRefreshWindow).After(expiration) {
+		return nil, ErrCacheExpired
+	}
+
+	creds = &aws.Credentials{
+		AccessKeyID:     f.Credentials.AccessKeyID,
+		SecretAccessKey: f.Credentials.SecretAccessKey,
+		SessionToken:    f.Credentials.SessionToken,
+		Source:          "AwsCliCache",
+		CanExpire:       true,
+		Expires:         expiration,
+	}
+	return creds, nil
+}
+
+func saveAwsCliCache(pc *ProfileConfig, creds aws.Credentials) (err error) {
+	if pc.RoleArn == "" {
+		return nil
+	}
+
+	path, err := awsCliCacheFilePath(pc)
+	if err != nil {
+		return err
+	}
+
+	f := AwsCliCacheFile{
+		Credentials: AwsCliCacheCredentials{
+			AccessKeyID:     creds.AccessKeyID,
+			SecretAccessKey: creds.SecretAccessKey,
+			SessionToken:    creds.SessionToken,
+			Expiration:      creds.Expires.UTC().Format(time.RFC3339),
+		},
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(path, data)
+	return err
+}
+
+// botocore writes "2006-01-02T15:04:05UTC", the AWS CLI v2 and other tools write RFC3339.
+func parseAwsCliCacheExpiration(s string) (t time.Time, err error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05MST", "2006-01-02T15:04:05-0700"} {
+		if t, err = time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+
+	err = errors.New("invalid expiration in AWS CLI cache: " + s)
+	return time.Time{}, err
+}
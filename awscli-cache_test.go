@@ -0,0 +1,100 @@
+package awssh
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+func TestAwsCliCacheKey(t *testing.T) {
+	// Computed with botocore's AssumeRoleCredentialFetcher._create_cache_key.
+	pc := &ProfileConfig{
+		RoleArn:         "arn:aws:iam::123456789012:role/admin",
+		MfaSerial:       "arn:aws:iam::123456789012:mfa/yö",
+		DurationSeconds: 3600,
+	}
+	want := "888486fb04ccf07fa6a14adaffb4944ca8cb2b66"
+	if got := awsCliCacheKey(pc); got != want {
+		t.Errorf("awsCliCacheKey() = %s, want %s", got, want)
+	}
+
+	// botocore deletes RoleSessionName from the arguments before hashing them.
+	withSessionName := *pc
+	withSessionName.RoleSessionName = "alice"
+	if got := awsCliCacheKey(&withSessionName); got != want {
+		t.Errorf("awsCliCacheKey() with role_session_name = %s, want %s", got, want)
+	}
+}
+
+func TestPythonJSONString(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "abc", want: `"abc"`},
+		{input: "a\"b\\c", want: `"a\"b\\c"`},
+		{input: "tab\tnl\n", want: `"tab\tnl\n"`},
+		{input: "\x01", want: `"\u0001"`},
+		{input: "ö", want: `"\u00f6"`},
+		{input: "😀", want: `"\ud83d\ude00"`},
+	}
+
+	for _, tt := range tests {
+		if got := pythonJSONString(tt.input); got != tt.want {
+			t.Errorf("pythonJSONString(%q) = %s, want %s", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestParseAwsCliCacheExpiration(t *testing.T) {
+	want := time.Date(2020, 1, 31, 12, 0, 0, 0, time.UTC)
+	for _, s := range []string{"2020-01-31T12:00:00Z", "2020-01-31T12:00:00UTC", "2020-01-31T21:00:00+09:00", "2020-01-31T12:00:00+0000"} {
+		got, err := parseAwsCliCacheExpiration(s)
+		if err != nil {
+			t.Errorf("parseAwsCliCacheExpiration(%q) error = %v", s, err)
+			continue
+		}
+		if !got.Equal(want) {
+			t.Errorf("parseAwsCliCacheExpiration(%q) = %v, want %v", s, got, want)
+		}
+	}
+
+	if _, err := parseAwsCliCacheExpiration("tomorrow"); err == nil {
+		t.Error("parseAwsCliCacheExpiration() error = nil, want error")
+	}
+}
+
+func TestAwsCliCacheSaveLoad(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	homedir.Reset()
+	t.Cleanup(homedir.Reset)
+
+	pc := &ProfileConfig{RoleArn: "arn:aws:iam::123456789012:role/admin"}
+	if _, err := loadAwsCliCache(pc); err != ErrCacheNotFound {
+		t.Fatalf("loadAwsCliCache() error = %v, want %v", err, ErrCacheNotFound)
+	}
+
+	want := testCredentials(time.Now().Add(time.Hour).Truncate(time.Second))
+	if err := saveAwsCliCache(pc, want); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(home, ".aws", "cli", "cache", awsCliCacheKey(pc)+".json")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := loadAwsCliCache(pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.AccessKeyID != want.AccessKeyID || !got.Expires.Equal(want.Expires) {
+		t.Errorf("loadAwsCliCache() = %+v, want %+v", got, want)
+	}
+
+	if _, err := loadAwsCliCache(&ProfileConfig{}); err != ErrCacheNotFound {
+		t.Errorf("loadAwsCliCache() without role_arn error = %v, want %v", err, ErrCacheNotFound)
+	}
+}
@@ -3,13 +3,19 @@ package awssh
 import (
 	"io/ioutil"
 	"net"
+	"os"
 	"time"
 
 	homedir "github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/ssh"
 )
 
 const (
 	ConnectHost string = "127.0.0.1"
+	ConfigPath  string = "~/.config/awssh"
+
+	ModeSSH      string = "ssh"
+	ModeSSMShell string = "ssm-shell"
 )
 
 func fetchEmptyPort(host string) (port string, err error) {
@@ -56,9 +62,27 @@ func readPublicKey(filePath string) (publicKey string, err error) {
 
 	publicKeyBytes, err := ioutil.ReadFile(fullPath)
 	if err != nil {
-		return "", err
+		return "", &KeyFileError{Path: filePath, Err: err}
+	}
+	if _, _, _, _, err = ssh.ParseAuthorizedKey(publicKeyBytes); err != nil {
+		return "", &KeyFileError{Path: filePath, Err: err}
 	}
 
 	publicKey = string(publicKeyBytes)
 	return publicKey, nil
 }
+
+func checkIdentityFile(filePath string) (err error) {
+	fullPath, err := homedir.Expand(filePath)
+	if err != nil {
+		return &KeyFileError{Path: filePath, Err: err}
+	}
+
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return &KeyFileError{Path: filePath, Err: err}
+	}
+	f.Close()
+
+	return nil
+}
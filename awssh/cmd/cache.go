@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/youyo/awssh"
+)
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Manage cached credentials.",
+}
+
+var cacheListCmd = &cobra.Command{
+	Use:          "list",
+	Short:        "List cached credentials.",
+	Args:         cobra.NoArgs,
+	RunE:         awssh.CacheList,
+	SilenceUsage: true,
+}
+
+var cacheClearCmd = &cobra.Command{
+	Use:          "clear [profile...]",
+	Short:        "Clear cached credentials. Clear all if no profile is given.",
+	RunE:         awssh.CacheClear,
+	SilenceUsage: true,
+}
+
+func init() {
+	cacheCmd.AddCommand(cacheListCmd)
+	cacheCmd.AddCommand(cacheClearCmd)
+	rootCmd.AddCommand(cacheCmd)
+}
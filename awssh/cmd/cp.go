@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/youyo/awssh"
+)
+
+var cpCmd = &cobra.Command{
+	Use:          "cp <src> <dst>",
+	Short:        "Copy files from or to the instance (INSTANCE:PATH) with scp.",
+	Args:         cobra.ExactArgs(2),
+	RunE:         awssh.Copy,
+	SilenceUsage: true,
+}
+
+func init() {
+	cpCmd.Flags().BoolP("recursive", "r", false, "copy directories recursively.")
+	cpCmd.Flags().BoolP("quiet", "q", false, "do not show the progress.")
+	addSshFlags(cpCmd)
+
+	rootCmd.AddCommand(cpCmd)
+}
+
+// Flags to login with ssh for the subcommands running ssh. The defaults are the flags of the root command.
+func addSshFlags(cmd *cobra.Command) {
+	cmd.Flags().StringP("username", "u", "ec2-user", "ssh login username.")
+	cmd.Flags().StringP("identity-file", "i", "~/.ssh/id_rsa", "identity file path.")
+	cmd.Flags().String("publickey", "identity-file+'.pub'", "public key file path.")
+	cmd.Flags().String("port", "22", "ssh login port.")
+	cmd.Flags().String("key-push", awssh.KeyPushAuto, "how to push the public key to the instance. (auto|instance-connect|ssm)")
+	cmd.Flags().StringArrayP("ssh-option", "o", []string{}, "option passed to ssh. (Key=Value, can be specified multiple times)")
+	cmd.Flags().String("ssh-command", awssh.CmdSsh, "ssh command to login, such as a wrapped or patched ssh.")
+	cmd.Flags().String("transport", awssh.TransportAuto, "how to forward the ssh port. auto uses EC2 Instance Connect Endpoint if SSM is not available. (auto|ssm|eice)")
+}
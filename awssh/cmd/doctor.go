@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/youyo/awssh"
+)
+
+var doctorCmd = &cobra.Command{
+	Use:          "doctor [instance-id]",
+	Short:        "Diagnose the requirements to login to instances.",
+	Args:         awssh.Validate,
+	RunE:         awssh.Doctor,
+	SilenceUsage: true,
+}
+
+func init() {
+	doctorCmd.Flags().StringP("identity-file", "i", "~/.ssh/id_rsa", "identity file path.")
+	doctorCmd.Flags().StringP("publickey", "P", "identity-file+'.pub'", "public key file path.")
+	doctorCmd.Flags().String("mode", awssh.ModeSSH, "login mode to check the permissions for. (ssh|ssm-shell)")
+	doctorCmd.Flags().String("transport", awssh.TransportAuto, "transport to check the permissions for. (auto|ssm|eice)")
+	doctorCmd.Flags().String("key-push", awssh.KeyPushAuto, "key push method to check the permissions for. (auto|instance-connect|ssm)")
+	doctorCmd.Flags().String("document", "", "session document of --mode=ssm-shell to check the permissions for. (default \"SSM-SessionManagerRunShell\")")
+
+	rootCmd.AddCommand(doctorCmd)
+}
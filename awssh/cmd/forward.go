@@ -0,0 +1,22 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/youyo/awssh"
+)
+
+var forwardCmd = &cobra.Command{
+	Use:          "forward [instance-id]",
+	Short:        "Forward local ports to ports of the instance without ssh.",
+	Args:         awssh.Validate,
+	RunE:         awssh.Forward,
+	SilenceUsage: true,
+}
+
+func init() {
+	forwardCmd.Flags().StringArrayP("local-forward", "L", []string{}, "forward the local port to the remote port. (LOCAL_PORT:[REMOTE_HOST:]REMOTE_PORT, LOCAL_PORT can be a Unix domain socket path, can be specified multiple times)")
+	forwardCmd.Flags().String("remote-host", "", "forward to the remote host through the instance instead of the instance itself. (e.g. RDS endpoint)")
+	forwardCmd.Flags().String("bind", awssh.ConnectHost, "address to listen on the local ports. (e.g. \"::1\", \"0.0.0.0\")")
+
+	rootCmd.AddCommand(forwardCmd)
+}
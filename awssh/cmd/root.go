@@ -1,9 +1,11 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
+	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/youyo/awssh"
@@ -12,19 +14,28 @@ import (
 var Version string
 
 var rootCmd = &cobra.Command{
-	Use:          "awssh [instance-id]",
-	Short:        "CLI tool to login ec2 instance.",
-	Version:      Version,
-	Args:         awssh.Validate,
-	PreRunE:      awssh.PreRun,
-	RunE:         awssh.Run,
-	SilenceUsage: true,
+	Use:               "awssh [instance-id] [-- ssh args...]",
+	Short:             "CLI tool to login ec2 instance.",
+	Version:           Version,
+	Args:              awssh.Validate,
+	PersistentPreRunE: awssh.PersistentPreRun,
+	PreRunE:           awssh.PreRun,
+	RunE:              awssh.Run,
+	SilenceUsage:      true,
+	SilenceErrors:     true,
 }
 
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		// ssh has already shown why it exited, awssh only passes its exit status through.
+		var exitErr *awssh.CommandExitError
+		if !errors.As(err, &exitErr) {
+			fmt.Fprintln(os.Stderr, err)
+			if hint := awssh.ErrorHint(err); hint != "" {
+				fmt.Fprintln(os.Stderr, "Hint: "+hint)
+			}
+		}
+		os.Exit(awssh.ExitCode(err))
 	}
 }
 
@@ -36,16 +47,50 @@ func init() {
 	rootCmd.Flags().StringP("publickey", "P", "identity-file+'.pub'", "public key file path.")
 	rootCmd.Flags().StringP("port", "p", "22", "ssh login port.")
 	rootCmd.Flags().StringP("external-command", "c", "", "feature use.")
-	rootCmd.Flags().String("profile", "default", "use a specific profile from your credential file.")
-	rootCmd.Flags().Bool("select-profile", false, "select a specific profile from your credential file.")
-	rootCmd.Flags().Bool("cache", false, "enable cache a credentials.")
-	rootCmd.Flags().String("duration", "1 hour", "cache duration.")
+	rootCmd.Flags().String("key-push", awssh.KeyPushAuto, "how to push the public key to the instance. (auto|instance-connect|ssm)")
+	rootCmd.Flags().String("mode", awssh.ModeSSH, "login mode. ssm-shell starts a Session Manager shell session without ssh. (ssh|ssm-shell)")
+	rootCmd.Flags().String("document", "", "session document of --mode=ssm-shell. (default \"SSM-SessionManagerRunShell\")")
+	rootCmd.Flags().StringArray("document-parameter", []string{}, "parameter of the session document. (Key=Value, can be specified multiple times)")
+	rootCmd.PersistentFlags().String("profile", "default", "use a specific profile from your credential file.")
+	rootCmd.PersistentFlags().Bool("select-profile", false, "select a specific profile from your credential file.")
+	rootCmd.PersistentFlags().Bool("cache", false, "enable cache a credentials.")
+	rootCmd.PersistentFlags().String("duration", "1 hour", "assume role duration.")
+	rootCmd.PersistentFlags().String("cache-encryption", "none", "encrypt cached credentials. (none|keyring|passphrase)")
+	rootCmd.PersistentFlags().Bool("aws-cli-cache", true, "share cached assume role credentials with the AWS CLI. (~/.aws/cli/cache)")
 	rootCmd.Flags().Bool("enable-snapshot", false, "enable snapshot.")
+	rootCmd.Flags().Bool("wait-snapshot", false, "wait until the snapshot AMI is available before login.")
+	rootCmd.Flags().String("snapshot-if-older-than", "", "create a snapshot only if the latest awssh AMI is older than this duration. (e.g. \"24h\")")
 	rootCmd.Flags().BoolP("port-forward-only", "f", false, "Only port-forwarding")
+	rootCmd.Flags().String("local-port", "", "local port to forward the ssh port to. (default: local-port-range, or any free port)")
+	rootCmd.Flags().String("local-port-range", "", "derive a stable local port of each instance from this range. (e.g. \"20000-29999\")")
+	rootCmd.Flags().String("bind", awssh.ConnectHost, "address to listen on the local port of --port-forward-only. (e.g. \"::1\", \"0.0.0.0\")")
+	rootCmd.Flags().String("unix-socket", "", "listen on the Unix domain socket instead of the local port of --port-forward-only.")
+	rootCmd.Flags().String("keepalive", awssh.DefaultKeepaliveInterval, "interval of keepalives through the session. 0 disables keepalives.")
+	rootCmd.Flags().StringArrayP("ssh-option", "o", []string{}, "option passed to ssh. (Key=Value, can be specified multiple times)")
+	rootCmd.Flags().String("ssh-command", awssh.CmdSsh, "ssh command to login, such as a wrapped or patched ssh.")
+	rootCmd.Flags().String("transport", awssh.TransportAuto, "how to forward the ssh port. auto uses EC2 Instance Connect Endpoint if SSM is not available. (auto|ssm|eice)")
 
+	viper.BindPFlags(rootCmd.PersistentFlags())
 	viper.BindPFlags(rootCmd.Flags())
 }
 
 func initConfig() {
 	viper.BindEnv("profile", "AWS_PROFILE")
+
+	viper.SetDefault("snapshot.name-template", awssh.DefaultSnapshotNameTemplate)
+	viper.SetDefault("snapshot.copy-tags", awssh.DefaultSnapshotCopyTags)
+
+	configPath, err := homedir.Expand(awssh.ConfigPath)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	viper.SetConfigName("config")
+	viper.AddConfigPath(configPath)
+	if err := viper.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
 }
@@ -0,0 +1,23 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/youyo/awssh"
+)
+
+var rsyncCmd = &cobra.Command{
+	Use:   "rsync [flags --] [rsync args] <src>... <dst>",
+	Short: "Sync files from or to the instance (INSTANCE:PATH) with rsync.",
+	// The args are passed to rsync as they are, the flags of awssh are given before "--".
+	DisableFlagParsing:    true,
+	DisableFlagsInUseLine: true,
+	PersistentPreRunE:     awssh.RsyncPreRun,
+	RunE:                  awssh.Rsync,
+	SilenceUsage:          true,
+}
+
+func init() {
+	addSshFlags(rsyncCmd)
+
+	rootCmd.AddCommand(rsyncCmd)
+}
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/youyo/awssh"
+)
+
+var snapshotsCmd = &cobra.Command{
+	Use:   "snapshots",
+	Short: "Manage AMIs created by awssh.",
+}
+
+var snapshotsListCmd = &cobra.Command{
+	Use:          "list",
+	Short:        "List AMIs created by awssh.",
+	Args:         cobra.NoArgs,
+	RunE:         awssh.SnapshotsList,
+	SilenceUsage: true,
+}
+
+var snapshotsPruneCmd = &cobra.Command{
+	Use:          "prune",
+	Short:        "Delete AMIs created by awssh and their EBS snapshots.",
+	Args:         cobra.NoArgs,
+	RunE:         awssh.SnapshotsPrune,
+	SilenceUsage: true,
+}
+
+func init() {
+	snapshotsPruneCmd.Flags().Int("keep", 0, "number of newest AMIs to keep per instance.")
+	snapshotsPruneCmd.Flags().String("older-than", "", "only delete AMIs older than this duration. (e.g. \"7d\")")
+	snapshotsPruneCmd.Flags().Bool("dry-run", false, "show AMIs to delete without deleting them.")
+
+	snapshotsCmd.AddCommand(snapshotsListCmd)
+	snapshotsCmd.AddCommand(snapshotsPruneCmd)
+	rootCmd.AddCommand(snapshotsCmd)
+}
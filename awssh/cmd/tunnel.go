@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/youyo/awssh"
+)
+
+var tunnelCmd = &cobra.Command{
+	Use:   "tunnel",
+	Short: "Manage port forwarding tunnels kept in the background.",
+}
+
+var tunnelUpCmd = &cobra.Command{
+	Use:          "up [instance-id]",
+	Short:        "Start tunnels to ports of the instance in the background. Without -L, refresh the credentials of its tunnels.",
+	Args:         awssh.Validate,
+	RunE:         awssh.TunnelUp,
+	SilenceUsage: true,
+}
+
+var tunnelDownCmd = &cobra.Command{
+	Use:          "down [tunnel-id|instance-id]...",
+	Short:        "Stop tunnels.",
+	RunE:         awssh.TunnelDown,
+	SilenceUsage: true,
+}
+
+var tunnelListCmd = &cobra.Command{
+	Use:          "ls",
+	Short:        "List tunnels.",
+	Args:         cobra.NoArgs,
+	RunE:         awssh.TunnelList,
+	SilenceUsage: true,
+}
+
+var tunnelDaemonCmd = &cobra.Command{
+	Use:          "daemon",
+	Short:        "Run the tunnel daemon. It is started by `tunnel up`.",
+	Args:         cobra.NoArgs,
+	RunE:         awssh.TunnelServe,
+	Hidden:       true,
+	SilenceUsage: true,
+}
+
+func init() {
+	tunnelUpCmd.Flags().StringArrayP("local-forward", "L", []string{}, "forward the local port to the remote port. (LOCAL_PORT:[REMOTE_HOST:]REMOTE_PORT, LOCAL_PORT can be a Unix domain socket path, can be specified multiple times)")
+	tunnelUpCmd.Flags().String("remote-host", "", "forward to the remote host through the instance instead of the instance itself. (e.g. RDS endpoint)")
+	tunnelUpCmd.Flags().String("bind", awssh.ConnectHost, "address to listen on the local ports. (e.g. \"::1\", \"0.0.0.0\")")
+	tunnelDownCmd.Flags().Bool("all", false, "stop all tunnels.")
+
+	tunnelCmd.AddCommand(tunnelUpCmd)
+	tunnelCmd.AddCommand(tunnelDownCmd)
+	tunnelCmd.AddCommand(tunnelListCmd)
+	tunnelCmd.AddCommand(tunnelDaemonCmd)
+	rootCmd.AddCommand(tunnelCmd)
+}
@@ -0,0 +1,131 @@
+package awssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Generate an authorized_keys formatted public key.
+func testPublicKey(t *testing.T) (publicKey string) {
+	t.Helper()
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey = string(ssh.MarshalAuthorizedKey(sshPub))
+	return publicKey
+}
+
+func TestGuessPublickey(t *testing.T) {
+	tests := []struct {
+		name         string
+		identityFile string
+		publickey    string
+		want         string
+	}{
+		{
+			name:         "default publickey",
+			identityFile: "~/.ssh/id_rsa",
+			publickey:    "identity-file+'.pub'",
+			want:         "~/.ssh/id_rsa.pub",
+		},
+		{
+			name:         "custom identity file",
+			identityFile: "~/.ssh/custom.pem",
+			publickey:    "identity-file+'.pub'",
+			want:         "~/.ssh/custom.pem.pub",
+		},
+		{
+			name:         "explicit publickey",
+			identityFile: "~/.ssh/id_rsa",
+			publickey:    "~/.ssh/other.pub",
+			want:         "~/.ssh/other.pub",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := guessPublickey(tt.identityFile, tt.publickey); got != tt.want {
+				t.Errorf("guessPublickey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchEmptyPort(t *testing.T) {
+	port, err := fetchEmptyPort(ConnectHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port == "" || port == "0" {
+		t.Fatalf("fetchEmptyPort() = %q, want a port number", port)
+	}
+
+	l, err := net.Listen("tcp", net.JoinHostPort(ConnectHost, port))
+	if err != nil {
+		t.Fatalf("fetched port %s is not available: %v", port, err)
+	}
+	l.Close()
+}
+
+func TestFetchEmptyPortInvalidHost(t *testing.T) {
+	if _, err := fetchEmptyPort("256.256.256.256"); err == nil {
+		t.Error("fetchEmptyPort() error = nil, want error")
+	}
+}
+
+func TestReadPublicKey(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "id_ed25519.pub")
+	publicKey := testPublicKey(t)
+	if err := os.WriteFile(path, []byte(publicKey), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readPublicKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != publicKey {
+		t.Errorf("readPublicKey() = %q, want %q", got, publicKey)
+	}
+
+	invalid := filepath.Join(dir, "invalid.pub")
+	if err := os.WriteFile(invalid, []byte("not a public key\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{filepath.Join(dir, "missing.pub"), invalid} {
+		_, err := readPublicKey(path)
+		var keyErr *KeyFileError
+		if !errors.As(err, &keyErr) {
+			t.Errorf("readPublicKey(%q) error = %v, want KeyFileError", path, err)
+		}
+	}
+}
+
+func TestCheckIdentityFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(path, []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkIdentityFile(path); err != nil {
+		t.Errorf("checkIdentityFile() error = %v", err)
+	}
+	if err := checkIdentityFile(filepath.Join(dir, "missing")); ExitCode(err) != ExitCodeKeyFile {
+		t.Errorf("checkIdentityFile() error = %v, want KeyFileError", err)
+	}
+}
@@ -1,96 +1,446 @@
 package awssh
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
 	"time"
 
-	"github.com/adelowo/onecache"
-	"github.com/adelowo/onecache/filesystem"
-	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	homedir "github.com/mitchellh/go-homedir"
+	"github.com/zalando/go-keyring"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 const (
-	CachePath string = "~/.config/awssh/cache"
+	CachePath          string        = ConfigPath + "/cache"
+	CacheFileExt       string        = ".json"
+	CacheRefreshWindow time.Duration = 5 * time.Minute
+
+	CacheEncryptionNone       string = "none"
+	CacheEncryptionKeyring    string = "keyring"
+	CacheEncryptionPassphrase string = "passphrase"
+
+	CacheKeyringService     string = "awssh"
+	CacheKeyringUser        string = "cache-encryption-key"
+	CachePassphraseEnvName  string = "AWSSH_CACHE_PASSPHRASE"
+	cacheFileFormatVersion  int    = 1
+	cacheEncryptionKeyBytes int    = 32
 )
 
-type Cache struct {
-	Store   *filesystem.FSStore
-	Marshal *onecache.CacheSerializer
-	Key     string
-}
+var (
+	ErrCacheNotFound = errors.New("cache not found")
+	ErrCacheExpired  = errors.New("cache expired")
+)
+
+type (
+	Cache struct {
+		Dir        string
+		Key        string
+		Profile    string
+		Encryption string
+	}
+
+	// CacheFile is the on-disk format. Metadata is kept in plaintext so that
+	// entries can be listed without decrypting them.
+	CacheFile struct {
+		Version    int       `json:"Version"`
+		Key        string    `json:"Key"`
+		Profile    string    `json:"Profile"`
+		Expiration time.Time `json:"Expiration"`
+		Encryption string    `json:"Encryption"`
+		Salt       string    `json:"Salt,omitempty"`
+		Nonce      string    `json:"Nonce,omitempty"`
+		Data       string    `json:"Data"`
+	}
 
-func NewCache(path, key string) (c *Cache, err error) {
+	CacheEntry struct {
+		Key        string
+		Profile    string
+		Expiration time.Time
+		Encryption string
+		Path       string
+	}
+	CacheEntries []CacheEntry
+)
+
+// NewCache returns the cache of the key. Key should be ProfileConfig.CacheKey() so that
+// the cache is invalidated when the profile config changes.
+func NewCache(path, key, profile, encryption string) (c *Cache, err error) {
 	fullPath, err := homedir.Expand(path)
 	if err != nil {
 		return nil, err
 	}
 
-	store := filesystem.MustNewFSStore(fullPath)
-	marshal := onecache.NewCacheSerializer()
+	switch encryption {
+	case "":
+		encryption = CacheEncryptionNone
+	case CacheEncryptionNone, CacheEncryptionKeyring, CacheEncryptionPassphrase:
+	default:
+		err = errors.New("unknown cache encryption: " + encryption)
+		return nil, err
+	}
 
 	c = &Cache{
-		Store:   store,
-		Marshal: marshal,
-		Key:     key,
+		Dir:        fullPath,
+		Key:        key,
+		Profile:    profile,
+		Encryption: encryption,
 	}
 
 	return c, nil
 }
 
-func (c *Cache) Save(creds *credentials.Value, expire time.Duration) (err error) {
-	dataByte, err := c.Marshal.Serialize(&creds)
+func (c *Cache) path() (path string) {
+	path = filepath.Join(c.Dir, cacheFileName(c.Key))
+	return path
+}
+
+func (c *Cache) Save(creds aws.Credentials) (err error) {
+	plaintext, err := json.Marshal(creds)
 	if err != nil {
 		return err
 	}
 
-	err = c.Store.Set(c.Key, dataByte, expire)
+	f := CacheFile{
+		Version:    cacheFileFormatVersion,
+		Key:        c.Key,
+		Profile:    c.Profile,
+		Expiration: creds.Expires.UTC(),
+		Encryption: c.Encryption,
+	}
+
+	if c.Encryption == CacheEncryptionNone {
+		f.Data = base64.StdEncoding.EncodeToString(plaintext)
+	} else {
+		salt := make([]byte, 16)
+		if _, err = io.ReadFull(rand.Reader, salt); err != nil {
+			return err
+		}
+
+		key, err := cacheEncryptionKey(c.Encryption, salt, true)
+		if err != nil {
+			return err
+		}
+
+		nonce, ciphertext, err := encrypt(key, plaintext, []byte(c.Key))
+		if err != nil {
+			return err
+		}
+
+		f.Salt = base64.StdEncoding.EncodeToString(salt)
+		f.Nonce = base64.StdEncoding.EncodeToString(nonce)
+		f.Data = base64.StdEncoding.EncodeToString(ciphertext)
+	}
+
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	if err = writeFileAtomic(c.path(), data); err != nil {
+		return err
+	}
+
+	err = c.deleteStaleEntries()
 	return err
 }
 
-func (c *Cache) Load() (creds *credentials.Value, err error) {
-	credsByte, err := c.Store.Get(c.Key)
+// Delete entries of the same profile written with a different config.
+func (c *Cache) deleteStaleEntries() (err error) {
+	entries, err := ListCacheEntries(c.Dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.Profile != c.Profile || entry.Key == c.Key {
+			continue
+		}
+		if err = os.Remove(entry.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Load credentials. ErrCacheExpired is returned if the credentials expire within CacheRefreshWindow.
+func (c *Cache) Load() (creds *aws.Credentials, err error) {
+	data, err := ioutil.ReadFile(c.path())
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrCacheNotFound
+		}
+		return nil, err
+	}
+
+	var f CacheFile
+	if err = json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	if f.Key != c.Key {
+		return nil, ErrCacheNotFound
+	}
+	if f.Version != cacheFileFormatVersion {
+		err = fmt.Errorf("unsupported cache format version: %d", f.Version)
 		return nil, err
 	}
+	if time.Now().Add(CacheRefreshWindow).After(f.Expiration) {
+		return nil, ErrCacheExpired
+	}
 
-	c.Marshal.DeSerialize(credsByte, &creds)
+	plaintext, err := base64.StdEncoding.DecodeString(f.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Encryption != CacheEncryptionNone {
+		salt, err := base64.StdEncoding.DecodeString(f.Salt)
+		if err != nil {
+			return nil, err
+		}
+		nonce, err := base64.StdEncoding.DecodeString(f.Nonce)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := cacheEncryptionKey(f.Encryption, salt, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if plaintext, err = decrypt(key, nonce, plaintext, []byte(f.Key)); err != nil {
+			return nil, err
+		}
+	}
+
+	creds = &aws.Credentials{}
+	if err = json.Unmarshal(plaintext, creds); err != nil {
+		return nil, err
+	}
+	creds.CanExpire = true
+	creds.Expires = f.Expiration
 
 	return creds, nil
 }
 
-/*
-func SaveCache(filePath, key string, creds *credentials.Value, expire time.Duration) (err error) {
-	marshal := onecache.NewCacheSerializer()
-	dataByte, err := marshal.Serialize(&creds)
+func (c *Cache) Delete() (err error) {
+	err = os.Remove(c.path())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func ListCacheEntries(path string) (entries CacheEntries, err error) {
+	fullPath, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != CacheFileExt {
+			continue
+		}
+
+		filePath := filepath.Join(fullPath, file.Name())
+		data, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+
+		var f CacheFile
+		if err := json.Unmarshal(data, &f); err != nil {
+			continue
+		}
+
+		entries = append(entries, CacheEntry{
+			Key:        f.Key,
+			Profile:    f.Profile,
+			Expiration: f.Expiration,
+			Encryption: f.Encryption,
+			Path:       filePath,
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Profile != entries[j].Profile {
+			return entries[i].Profile < entries[j].Profile
+		}
+		return entries[i].Key < entries[j].Key
+	})
+
+	return entries, nil
+}
+
+// Remove all files in the cache directory, including caches written by older versions.
+func ClearCache(path string) (err error) {
+	fullPath, err := homedir.Expand(path)
 	if err != nil {
 		return err
 	}
 
-	fullPath, err := homedir.Expand(filePath)
+	files, err := ioutil.ReadDir(fullPath)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
 		return err
 	}
 
-	store := filesystem.MustNewFSStore(fullPath)
-	err = store.Set(key, dataByte, expire)
-	return err
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if err = os.Remove(filepath.Join(fullPath, file.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func cacheFileName(key string) (name string) {
+	name = key + CacheFileExt
+	return name
 }
 
-func LoadCache(filePath, key string) (creds *credentials.Value, err error) {
-	fullPath, err := homedir.Expand(filePath)
+// Write the file with 0600 permissions via a temporary file and rename,
+// so that readers never see a partially written cache.
+func writeFileAtomic(path string, data []byte) (err error) {
+	dir := filepath.Dir(path)
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
 	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	return err
+}
+
+// Get the encryption key. With keyring, a random key is stored in the OS keyring and created on first use.
+// With passphrase, the key is derived from AWSSH_CACHE_PASSPHRASE or a prompted passphrase.
+func cacheEncryptionKey(encryption string, salt []byte, create bool) (key []byte, err error) {
+	switch encryption {
+	case CacheEncryptionKeyring:
+		encoded, err := keyring.Get(CacheKeyringService, CacheKeyringUser)
+		if err == keyring.ErrNotFound && create {
+			key = make([]byte, cacheEncryptionKeyBytes)
+			if _, err = io.ReadFull(rand.Reader, key); err != nil {
+				return nil, err
+			}
+			err = keyring.Set(CacheKeyringService, CacheKeyringUser, base64.StdEncoding.EncodeToString(key))
+			return key, err
+		} else if err != nil {
+			return nil, err
+		}
+		key, err = base64.StdEncoding.DecodeString(encoded)
+		return key, err
+	case CacheEncryptionPassphrase:
+		passphrase, err := readCachePassphrase()
+		if err != nil {
+			return nil, err
+		}
+		key, err = scrypt.Key(passphrase, salt, 1<<15, 8, 1, cacheEncryptionKeyBytes)
+		return key, err
+	default:
+		err = errors.New("unknown cache encryption: " + encryption)
 		return nil, err
 	}
+}
+
+func readCachePassphrase() (passphrase []byte, err error) {
+	if env := os.Getenv(CachePassphraseEnvName); env != "" {
+		passphrase = []byte(env)
+		return passphrase, nil
+	}
 
-	store := filesystem.MustNewFSStore(fullPath)
-	credsByte, err := store.Get(key)
+	fmt.Fprint(os.Stderr, "Cache passphrase: ")
+	passphrase, err = terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
 	if err != nil {
 		return nil, err
 	}
+	if len(passphrase) == 0 {
+		err = errors.New("empty cache passphrase")
+		return nil, err
+	}
+	return passphrase, nil
+}
 
-	marshal := onecache.NewCacheSerializer()
-	marshal.DeSerialize(credsByte, &creds)
+func encrypt(key, plaintext, additionalData []byte) (nonce, ciphertext []byte, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	return creds, nil
+	nonce = make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+
+	ciphertext = gcm.Seal(nil, nonce, plaintext, additionalData)
+	return nonce, ciphertext, nil
+}
+
+func decrypt(key, nonce, ciphertext, additionalData []byte) (plaintext []byte, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err = gcm.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		err = errors.New("failed to decrypt cache. wrong passphrase or keyring key?")
+		return nil, err
+	}
+	return plaintext, nil
 }
-*/
@@ -0,0 +1,205 @@
+package awssh
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func testCredentials(expires time.Time) (creds aws.Credentials) {
+	creds = aws.Credentials{
+		AccessKeyID:     "AKIAEXAMPLE",
+		SecretAccessKey: "secret",
+		SessionToken:    "token",
+		CanExpire:       true,
+		Expires:         expires,
+	}
+	return creds
+}
+
+func TestCacheSaveLoad(t *testing.T) {
+	t.Setenv(CachePassphraseEnvName, "passphrase")
+
+	tests := []struct {
+		name       string
+		encryption string
+		expires    time.Duration
+		wantErr    error
+	}{
+		{
+			name:       "plaintext",
+			encryption: CacheEncryptionNone,
+			expires:    time.Hour,
+		},
+		{
+			name:       "default encryption",
+			encryption: "",
+			expires:    time.Hour,
+		},
+		{
+			name:       "passphrase",
+			encryption: CacheEncryptionPassphrase,
+			expires:    time.Hour,
+		},
+		{
+			name:       "expired",
+			encryption: CacheEncryptionNone,
+			expires:    -time.Minute,
+			wantErr:    ErrCacheExpired,
+		},
+		{
+			name:       "within refresh window",
+			encryption: CacheEncryptionNone,
+			expires:    CacheRefreshWindow - time.Minute,
+			wantErr:    ErrCacheExpired,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewCache(t.TempDir(), "key", "profile", tt.encryption)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := testCredentials(time.Now().Add(tt.expires).Truncate(time.Second))
+			if err := c.Save(want); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := c.Load()
+			if err != tt.wantErr {
+				t.Fatalf("Load() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if got.AccessKeyID != want.AccessKeyID || got.SecretAccessKey != want.SecretAccessKey || got.SessionToken != want.SessionToken {
+				t.Errorf("Load() = %+v, want %+v", got, want)
+			}
+			if !got.Expires.Equal(want.Expires) || !got.CanExpire {
+				t.Errorf("Load() expires = %v, want %v", got.Expires, want.Expires)
+			}
+		})
+	}
+}
+
+func TestCacheNotFound(t *testing.T) {
+	c, err := NewCache(t.TempDir(), "key", "profile", CacheEncryptionNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Load(); err != ErrCacheNotFound {
+		t.Errorf("Load() error = %v, want %v", err, ErrCacheNotFound)
+	}
+}
+
+func TestCacheWrongPassphrase(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(CachePassphraseEnvName, "passphrase")
+
+	c, err := NewCache(dir, "key", "profile", CacheEncryptionPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Save(testCredentials(time.Now().Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(CachePassphraseEnvName, "wrong")
+	if _, err := c.Load(); err == nil {
+		t.Error("Load() error = nil, want error")
+	}
+}
+
+func TestCacheInvalidEncryption(t *testing.T) {
+	if _, err := NewCache(t.TempDir(), "key", "profile", "rot13"); err == nil {
+		t.Error("NewCache() error = nil, want error")
+	}
+}
+
+func TestCacheFilePermission(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cache")
+	c, err := NewCache(dir, "key", "profile", CacheEncryptionNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Save(testCredentials(time.Now().Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(c.path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("cache file mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("cache dir has %d files, want 1 (no temporary files left)", len(files))
+	}
+}
+
+func TestCacheDeleteStaleEntries(t *testing.T) {
+	dir := t.TempDir()
+	creds := testCredentials(time.Now().Add(time.Hour))
+
+	old, _ := NewCache(dir, "old-key", "profile", CacheEncryptionNone)
+	other, _ := NewCache(dir, "other-key", "other-profile", CacheEncryptionNone)
+	current, _ := NewCache(dir, "new-key", "profile", CacheEncryptionNone)
+	for _, c := range []*Cache{old, other, current} {
+		if err := c.Save(creds); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := ListCacheEntries(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("ListCacheEntries() = %d entries, want 2", len(entries))
+	}
+	if entries[0].Key != "other-key" || entries[1].Key != "new-key" {
+		t.Errorf("ListCacheEntries() = %+v", entries)
+	}
+	if _, err := old.Load(); err != ErrCacheNotFound {
+		t.Errorf("stale entry Load() error = %v, want %v", err, ErrCacheNotFound)
+	}
+}
+
+func TestClearCache(t *testing.T) {
+	dir := t.TempDir()
+	c, _ := NewCache(dir, "key", "profile", CacheEncryptionNone)
+	if err := c.Save(testCredentials(time.Now().Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "legacy"), []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ClearCache(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("cache dir has %d files after clear, want 0", len(files))
+	}
+
+	if err := ClearCache(filepath.Join(dir, "missing")); err != nil {
+		t.Errorf("ClearCache() of missing dir error = %v", err)
+	}
+}
@@ -4,10 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"os"
 	"regexp"
 	"strings"
+	"text/tabwriter"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/k1LoW/duration"
 	"github.com/manifoldco/promptui"
 	"github.com/spf13/cobra"
@@ -15,97 +20,514 @@ import (
 	"github.com/youyo/awsprofile"
 )
 
+var (
+	instanceIdRe = regexp.MustCompile(`^i-([a-zA-Z0-9A0-zZ9]{8}|[a-zA-Z0-9A0-zZ9]{17})$`)
+)
+
 func Run(cmd *cobra.Command, args []string) (err error) {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	ctx, stop := notifyStop(context.Background())
+	defer stop()
+
+	clients, err := newClientsFromConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	args, sshArgs := splitSshArgs(cmd, args)
+	err = RunWithClients(ctx, clients, args, sshArgs)
+	return err
+}
 
-	profile := viper.GetString("profile")
-	cache := viper.GetBool("cache")
+// RunWithClients logs in to the instance using the given AWS clients. sshArgs are passed to ssh after the destination.
+func RunWithClients(ctx context.Context, clients *Clients, args, sshArgs []string) (err error) {
 	enableSnapshot := viper.GetBool("enable-snapshot")
+	waitSnapshot := viper.GetBool("wait-snapshot")
 	portForwardOnly := viper.GetBool("port-forward-only")
-	duration, err := duration.Parse(viper.GetString("duration"))
+
+	instance, err := resolveInstance(ctx, clients, args)
 	if err != nil {
 		return err
 	}
+	instanceID := instance.ID
 
-	awsSession := newAwsSession(profile, cache, duration)
+	// Get snapshot
+	if err = autoSnapshot(ctx, clients, instance, enableSnapshot, waitSnapshot); err != nil {
+		return err
+	}
 
-	var instanceID string
+	if viper.GetString("mode") == ModeSSMShell {
+		err = runShellSession(ctx, clients, instance)
+		return err
+	}
 
-	if len(args) == 1 {
-		instanceID = args[0]
-	} else {
-		instances, err := getRunningInstances(ctx, awsSession)
+	if portForwardOnly {
+		localPorts, err := localPortCandidates(instanceID, viper.GetString("local-port"), viper.GetString("local-port-range"))
 		if err != nil {
 			return err
 		}
+		forward := PortForward{
+			BindAddress: viper.GetString("bind"),
+			LocalSocket: viper.GetString("unix-socket"),
+			RemotePort:  viper.GetString("port"),
+		}
+		pushKey := func(ctx context.Context) error {
+			return pushConfiguredKey(ctx, clients, instance)
+		}
+		err = runPortForwardOnly(ctx, clients, instance, forward, localPorts, pushKey)
+		return err
+	}
 
-		instanceID, err = selectInstance(instances)
+	options, err := sshOptions()
+	if err != nil {
+		return err
+	}
+
+	session, err := startSshSession(ctx, clients, instance)
+	if err != nil {
+		return err
+	}
+	defer session.Stop()
+
+	// ssh owns the terminal, and Ctrl-C is handled by ssh or the remote command.
+	release := holdTerminalSignals()
+	defer release()
+
+	cmdSsh, err := execSshCommand(ctx, viper.GetString("ssh-command"), viper.GetString("username"), ConnectHost, session.Forward().LocalPort, viper.GetString("identity-file"), options, sshArgs)
+	if err != nil {
+		return err
+	}
+
+	err = commandExitError(cmdSsh.Wait())
+	return err
+}
+
+// Start the port forwarding to the ssh port of the instance by the transport, and push the key to login with ssh.
+func startSshSession(ctx context.Context, clients *Clients, instance *Instance) (session LocalForward, err error) {
+	localPorts, err := localPortCandidates(instance.ID, viper.GetString("local-port"), viper.GetString("local-port-range"))
+	if err != nil {
+		return nil, err
+	}
+
+	forward := PortForward{RemotePort: viper.GetString("port")}
+	session, err = startTransport(ctx, clients, instance, forward, localPorts, func() (LocalForward, error) {
+		forwardSession, err := startForwardSessionOnPorts(ctx, clients, instance.ID, forward, localPorts)
 		if err != nil {
+			return nil, err
+		}
+		return forwardSession, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = pushConfiguredKey(ctx, clients, instance); err != nil {
+		session.Stop()
+		return nil, err
+	}
+
+	time.Sleep(1 * time.Second)
+	return session, nil
+}
+
+// Start the forward with startSSM, or through EC2 Instance Connect Endpoint by --transport. With auto, EC2 Instance
+// Connect Endpoint is used if the SSM agent of the instance is not connected to Session Manager.
+func startTransport(ctx context.Context, clients *Clients, instance *Instance, forward PortForward, localPorts []string, startSSM func() (LocalForward, error)) (session LocalForward, err error) {
+	transport := viper.GetString("transport")
+	if transport == TransportEICE {
+		session, err = startEiceSessionOnPorts(ctx, clients, instance, forward, localPorts)
+		return session, err
+	}
+
+	session, err = startSSM()
+	var notConnected *TargetNotConnectedError
+	if transport != TransportSSM && errors.As(err, &notConnected) {
+		fmt.Fprintf(os.Stderr, "%v\nConnecting through EC2 Instance Connect Endpoint instead.\n", err)
+		session, err = startEiceSessionOnPorts(ctx, clients, instance, forward, localPorts)
+	}
+	return session, err
+}
+
+// Check --transport and that its command is installed. With auto, EC2 Instance Connect Endpoint is used
+// if session-manager-plugin is not installed.
+func checkTransport() (err error) {
+	switch transport := viper.GetString("transport"); transport {
+	case TransportAuto:
+		if checkSessionManagerCommandIsExist() != nil {
+			fmt.Fprintln(os.Stderr, "session-manager-plugin is not found. Connecting through EC2 Instance Connect Endpoint instead.")
+			viper.Set("transport", TransportEICE)
+		}
+		return nil
+	case TransportSSM:
+		err = checkSessionManagerCommandIsExist()
+		return err
+	case TransportEICE:
+		return nil
+	default:
+		err = errors.New("invalid --transport: " + transport + " (" + TransportAuto + "|" + TransportSSM + "|" + TransportEICE + ")")
+		return err
+	}
+}
+
+// Push the public key of the config to the instance for the login user.
+func pushConfiguredKey(ctx context.Context, clients *Clients, instance *Instance) (err error) {
+	err = pushPublicKey(ctx, clients, instance, viper.GetString("username"), viper.GetString("publicKey"), viper.GetString("key-push"))
+	return err
+}
+
+// Options of ssh from -o, ssh-args of the config and --keepalive in this order. ssh uses the first value of
+// each option, so -o takes precedence over the config, and the config over the keepalive defaults.
+func sshOptions() (options []string, err error) {
+	keepalive, err := parseKeepaliveInterval(viper.GetString("keepalive"))
+	if err != nil {
+		return nil, err
+	}
+
+	options = sshOptionArgs(viper.GetStringSlice("ssh-option"))
+	options = append(options, viper.GetStringSlice("ssh-args")...)
+	options = append(options, sshKeepaliveOptions(keepalive)...)
+	return options, nil
+}
+
+// Keep the port forwarding to the ssh port until interrupted. When the session is dropped, the tunnel
+// reconnects with a new session and pushes the key again, so clients can connect to the same local port.
+// Through EC2 Instance Connect Endpoint, each connection opens a new tunnel instead.
+func runPortForwardOnly(ctx context.Context, clients *Clients, instance *Instance, forward PortForward, localPorts []string, pushKey func(ctx context.Context) error) (err error) {
+	session, err := startTransport(ctx, clients, instance, forward, localPorts, func() (LocalForward, error) {
+		tunnel, err := startTunnelOnPorts(ctx, clients, instance, forward, localPorts, pushKey)
+		if err != nil {
+			return nil, err
+		}
+		return tunnel, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer session.Stop()
+
+	if err = pushKey(ctx); err != nil {
+		return err
+	}
+
+	time.Sleep(1 * time.Second)
+
+	started := session.Forward()
+	if started.LocalSocket != "" {
+		fmt.Printf("Socket: %v\nIdentityFile: %v\n", started.LocalSocket, viper.GetString("identity-file"))
+	} else {
+		fmt.Printf("Host: %v\nPort: %v\nIdentityFile: %v\n", started.Bind(), started.LocalPort, viper.GetString("identity-file"))
+	}
+	fmt.Println("Press Ctrl-C to stop.")
+
+	<-ctx.Done()
+	return nil
+}
+
+// Describe the instance given as the arg, or select one of the running instances.
+func resolveInstance(ctx context.Context, clients *Clients, args []string) (instance *Instance, err error) {
+	if len(args) == 0 {
+		instances, err := getRunningInstances(ctx, clients.Instances)
+		if err != nil {
+			return nil, err
+		}
+
+		instance, err = selectInstance(instances)
+		return instance, err
+	}
+
+	instance, err = getInstance(ctx, clients.Instances, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if instance.State != string(types.InstanceStateNameRunning) {
+		err = errors.New("instance is not running: " + instance.ID + " (" + instance.State + ")")
+		return nil, err
+	}
+	return instance, nil
+}
+
+// Find the running instance given as the instance-id or the Name tag.
+func findInstance(ctx context.Context, clients *Clients, nameOrID string) (instance *Instance, err error) {
+	if instanceIdRe.MatchString(nameOrID) {
+		instance, err = resolveInstance(ctx, clients, []string{nameOrID})
+		return instance, err
+	}
+
+	instance, err = getRunningInstanceByName(ctx, clients.Instances, nameOrID)
+	return instance, err
+}
+
+// Start an interactive shell session by Session Manager without ssh.
+func runShellSession(ctx context.Context, clients *Clients, instance *Instance) (err error) {
+	parameters, err := parseDocumentParameters(viper.GetStringSlice("document-parameter"))
+	if err != nil {
+		return err
+	}
+
+	tokens, sessionManagerParam, sessionID, err := getSsmShellSessionToken(ctx, clients.Sessions, instance.ID, viper.GetString("document"), parameters)
+	if err != nil {
+		return err
+	}
+	defer warnTerminateSession(clients.Sessions, sessionID)
+
+	// The plugin leaves the terminal signals enabled, and sends Ctrl-C to the remote shell.
+	release := holdTerminalSignals()
+	defer release()
+
+	region := clients.Region
+	cmdSession, err := execSessionManagerSession(ctx, tokens, region, sessionManagerParam, getSsmApiUrl(region))
+	if err != nil {
+		return err
+	}
+
+	err = commandExitError(cmdSession.Wait())
+	return err
+}
+
+func Forward(cmd *cobra.Command, args []string) (err error) {
+	if err = checkSessionManagerCommandIsExist(); err != nil {
+		return err
+	}
+
+	specs, err := cmd.Flags().GetStringArray("local-forward")
+	if err != nil {
+		return err
+	}
+	remoteHost, err := cmd.Flags().GetString("remote-host")
+	if err != nil {
+		return err
+	}
+	bind, err := cmd.Flags().GetString("bind")
+	if err != nil {
+		return err
+	}
+	forwards, err := parsePortForwards(specs, remoteHost, bind)
+	if err != nil {
+		return err
+	}
+	warnBindAddress(bind)
+
+	ctx, stop := notifyStop(context.Background())
+	defer stop()
+
+	clients, err := newClientsFromConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = ForwardWithClients(ctx, clients, args, forwards, os.Stdout)
+	return err
+}
+
+func Copy(cmd *cobra.Command, args []string) (err error) {
+	if err = setSshFlags(cmd); err != nil {
+		return err
+	}
+	if err = checkTransport(); err != nil {
+		return err
+	}
+	if err = prepareKeyPair(); err != nil {
+		return err
+	}
+
+	recursive, err := cmd.Flags().GetBool("recursive")
+	if err != nil {
+		return err
+	}
+	quiet, err := cmd.Flags().GetBool("quiet")
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := notifyStop(context.Background())
+	defer stop()
+
+	clients, err := newClientsFromConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = CopyWithClients(ctx, clients, args[0], args[1], recursive, quiet)
+	return err
+}
+
+// Parse the flags of awssh given before "--" and run PersistentPreRun. cobra does not parse the flags of
+// the rsync command, because the args of rsync have many flags of their own.
+func RsyncPreRun(cmd *cobra.Command, args []string) (err error) {
+	awsshArgs, _ := splitRsyncArgs(args)
+	if err = cmd.ParseFlags(awsshArgs); err != nil {
+		return err
+	}
+
+	err = PersistentPreRun(cmd, args)
+	return err
+}
+
+func Rsync(cmd *cobra.Command, args []string) (err error) {
+	_, rsyncArgs := splitRsyncArgs(args)
+	if help, _ := cmd.Flags().GetBool("help"); help || len(rsyncArgs) == 0 || rsyncArgs[0] == "-h" || rsyncArgs[0] == "--help" {
+		err = cmd.Help()
+		return err
+	}
+
+	if err = setSshFlags(cmd); err != nil {
+		return err
+	}
+	if err = checkTransport(); err != nil {
+		return err
+	}
+	if err = prepareKeyPair(); err != nil {
+		return err
+	}
+
+	ctx, stop := notifyStop(context.Background())
+	defer stop()
+
+	clients, err := newClientsFromConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = RsyncWithClients(ctx, clients, rsyncArgs)
+	return err
+}
+
+func TunnelUp(cmd *cobra.Command, args []string) (err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err = checkSessionManagerCommandIsExist(); err != nil {
+		return err
+	}
+
+	specs, err := cmd.Flags().GetStringArray("local-forward")
+	if err != nil {
+		return err
+	}
+	remoteHost, err := cmd.Flags().GetString("remote-host")
+	if err != nil {
+		return err
+	}
+	bind, err := cmd.Flags().GetString("bind")
+	if err != nil {
+		return err
+	}
+	// Without -L, the credentials of the tunnels of the instance are refreshed.
+	var forwards PortForwards
+	if len(specs) > 0 {
+		if forwards, err = parsePortForwards(specs, remoteHost, bind); err != nil {
 			return err
 		}
+		warnBindAddress(bind)
 	}
 
-	// Get snapshot
-	if enableSnapshot == true {
-		go func() {
-			if imageId, err := createAMI(ctx, awsSession, instanceID); err != nil {
-				fmt.Printf("Failed to create to auto snapshot. error: %T\n", err)
-			} else {
-				fmt.Println("Create AMI ID: " + *imageId)
-			}
-		}()
+	cfg, err := newAwsConfigFromConfig(ctx)
+	if err != nil {
+		return err
 	}
+	clients := NewClients(cfg)
 
-	// fetch empty port
-	localPort, err := fetchEmptyPort(ConnectHost)
+	instance, err := resolveInstance(ctx, clients, args)
 	if err != nil {
 		return err
 	}
 
-	tokens, sessionManagerParam, err := getSsmSessionToken(ctx, awsSession, instanceID, viper.GetString("port"), localPort)
+	// The daemon starts sessions with these credentials, including reconnects. The tunnels of the instance
+	// which are already up get them too.
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return wrapAwsError(err, "sts:AssumeRole")
+	}
+
+	request := TunnelRequest{
+		Command:      TunnelCommandUp,
+		InstanceID:   instance.ID,
+		InstanceName: instance.TagName,
+		Forwards:     forwards,
+		Region:       clients.Region,
+		Credentials:  creds,
+	}
+	response, err := sendTunnelRequest(TunnelSocketPath, request)
+	if err == ErrTunnelDaemonNotRunning {
+		if err = startTunnelDaemon(TunnelSocketPath, TunnelLogPath); err != nil {
+			return err
+		}
+		response, err = sendTunnelRequest(TunnelSocketPath, request)
+	}
 	if err != nil {
 		return err
 	}
 
-	region := getRegion(awsSession)
-	ssmUrl := getSsmApiUrl(region)
+	printTunnelStatuses(os.Stdout, response.Tunnels, time.Now())
+	return nil
+}
 
-	cmdPortForwarding, err := execSessionManagerPortForwarding(ctx, tokens, region, sessionManagerParam, ssmUrl)
+func TunnelDown(cmd *cobra.Command, args []string) (err error) {
+	all, err := cmd.Flags().GetBool("all")
 	if err != nil {
 		return err
 	}
-	if !portForwardOnly {
-		defer cmdPortForwarding.Process.Kill()
+	if len(args) == 0 && !all {
+		err = errors.New("specify tunnel IDs or instance IDs, or --all")
+		return err
 	}
 
-	if err = sendSSHPublicKey(ctx, awsSession, instanceID, viper.GetString("username"), viper.GetString("publicKey")); err != nil {
+	response, err := sendTunnelRequest(TunnelSocketPath, TunnelRequest{Command: TunnelCommandDown, Targets: args})
+	if err == ErrTunnelDaemonNotRunning {
+		fmt.Println("No tunnel.")
+		return nil
+	}
+	if err != nil {
 		return err
 	}
 
-	time.Sleep(1 * time.Second)
+	if len(response.Tunnels) == 0 {
+		fmt.Println("No tunnel matched: " + strings.Join(args, ", "))
+		return nil
+	}
+	for _, status := range response.Tunnels {
+		fmt.Printf("Stopped tunnel %s: %s -> %s %s\n", status.ID, status.Forward.Local(), status.InstanceID, status.Forward.Remote())
+	}
+	return nil
+}
 
-	if portForwardOnly {
-		fmt.Printf("Host: %v\nPort: %v\nIdentityFile: %v\n", ConnectHost, localPort, viper.GetString("identity-file"))
-	} else {
-		cmdSsh, err := execSshCommand(ctx, viper.GetString("username"), ConnectHost, localPort, viper.GetString("identity-file"))
-		cmdSsh.Wait()
+func TunnelList(cmd *cobra.Command, args []string) (err error) {
+	response, err := sendTunnelRequest(TunnelSocketPath, TunnelRequest{Command: TunnelCommandList})
+	if err == ErrTunnelDaemonNotRunning {
+		fmt.Println("No tunnel.")
+		return nil
+	}
+	if err != nil {
 		return err
 	}
 
+	printTunnelStatuses(os.Stdout, response.Tunnels, time.Now())
 	return nil
 }
 
+func TunnelServe(cmd *cobra.Command, args []string) (err error) {
+	ctx, stop := notifyStop(context.Background())
+	defer stop()
+
+	err = NewTunnelDaemon().Serve(ctx, TunnelSocketPath)
+	return err
+}
+
+// Split args into the instance-id and the args after "--" which are passed to ssh.
+func splitSshArgs(cmd *cobra.Command, args []string) (instanceArgs, sshArgs []string) {
+	if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+		return args[:dash], args[dash:]
+	}
+	return args, nil
+}
+
 func Validate(cmd *cobra.Command, args []string) (err error) {
+	args, _ = splitSshArgs(cmd, args)
 	if len(args) > 1 {
 		err = errors.New("accepts only 1 arg")
 		return err
 	}
 
 	if len(args) == 1 {
-		instanceIdRe := regexp.MustCompile(
-			`^i-([a-zA-Z0-9A0-zZ9]{8}|[a-zA-Z0-9A0-zZ9]{17})$`,
-		)
 		if !instanceIdRe.MatchString(args[0]) {
 			err = errors.New("unmatched instance-id")
 			return err
@@ -116,7 +538,62 @@ func Validate(cmd *cobra.Command, args []string) (err error) {
 }
 
 func PreRun(cmd *cobra.Command, args []string) (err error) {
-	if err = checkSessionManagerCommandIsExist(); err != nil {
+	// Option values may contain commas, so they are read as a string array which viper cannot bind.
+	options, err := cmd.Flags().GetStringArray("ssh-option")
+	if err != nil {
+		return err
+	}
+	viper.Set("ssh-option", options)
+	if _, sshArgs := splitSshArgs(cmd, args); len(sshArgs) > 0 && (viper.GetString("mode") != ModeSSH || viper.GetBool("port-forward-only")) {
+		err = errors.New("args after -- are passed to ssh, and cannot be used with --port-forward-only or --mode=" + ModeSSMShell)
+		return err
+	}
+
+	switch mode := viper.GetString("mode"); mode {
+	case ModeSSH:
+		if err = checkTransport(); err != nil {
+			return err
+		}
+	case ModeSSMShell:
+		if viper.GetString("transport") == TransportEICE {
+			err = errors.New("--transport=" + TransportEICE + " cannot be used with --mode=" + ModeSSMShell)
+			return err
+		}
+		if err = checkSessionManagerCommandIsExist(); err != nil {
+			return err
+		}
+		// Values may contain commas, so they are read as a string array which viper cannot bind.
+		if cmd.Flags().Changed("document-parameter") {
+			parameters, err := cmd.Flags().GetStringArray("document-parameter")
+			if err != nil {
+				return err
+			}
+			viper.Set("document-parameter", parameters)
+		}
+		if viper.GetBool("port-forward-only") {
+			err = errors.New("--port-forward-only cannot be used with --mode=" + ModeSSMShell)
+			return err
+		}
+		// Neither the key pair nor the key push is used.
+		return nil
+	default:
+		err = errors.New("invalid --mode: " + mode + " (" + ModeSSH + "|" + ModeSSMShell + ")")
+		return err
+	}
+
+	if bind := viper.GetString("bind"); (bind != "" && bind != ConnectHost || viper.GetString("unix-socket") != "") && !viper.GetBool("port-forward-only") {
+		err = errors.New("--bind and --unix-socket can only be used with --port-forward-only")
+		return err
+	}
+	warnBindAddress(viper.GetString("bind"))
+
+	err = prepareKeyPair()
+	return err
+}
+
+// Validate the key push method, and check the key pair to push and to login with.
+func prepareKeyPair() (err error) {
+	if err = validateKeyPushMethod(viper.GetString("key-push")); err != nil {
 		return err
 	}
 
@@ -126,6 +603,31 @@ func PreRun(cmd *cobra.Command, args []string) (err error) {
 	)
 	viper.Set("publickey", guessedPublickey)
 
+	if err = checkIdentityFile(viper.GetString("identity-file")); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Set the ssh login flags of the subcommand to viper. Only the flags of the root command are bound to viper,
+// so the flags of the subcommand are set if they are given. -o is always set since viper cannot bind it.
+func setSshFlags(cmd *cobra.Command) (err error) {
+	for _, name := range []string{"username", "identity-file", "publickey", "port", "key-push", "ssh-command", "transport"} {
+		if flag := cmd.Flags().Lookup(name); flag != nil && flag.Changed {
+			viper.Set(name, flag.Value.String())
+		}
+	}
+
+	options, err := cmd.Flags().GetStringArray("ssh-option")
+	if err != nil {
+		return err
+	}
+	viper.Set("ssh-option", options)
+	return nil
+}
+
+func PersistentPreRun(cmd *cobra.Command, args []string) (err error) {
 	selectProfile := viper.GetBool("select-profile")
 	if selectProfile {
 		awsProfile := awsprofile.New()
@@ -171,3 +673,320 @@ func PreRun(cmd *cobra.Command, args []string) (err error) {
 
 	return nil
 }
+
+func newClientsFromConfig(ctx context.Context) (clients *Clients, err error) {
+	cfg, err := newAwsConfigFromConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	clients = NewClients(cfg)
+	return clients, nil
+}
+
+func newAwsConfigFromConfig(ctx context.Context) (cfg aws.Config, err error) {
+	duration, err := duration.Parse(viper.GetString("duration"))
+	if err != nil {
+		return aws.Config{}, err
+	}
+
+	cfg, err = newAwsConfig(
+		ctx,
+		viper.GetString("profile"),
+		viper.GetBool("cache"),
+		duration,
+		viper.GetString("cache-encryption"),
+		viper.GetBool("aws-cli-cache"),
+	)
+	return cfg, err
+}
+
+func autoSnapshot(ctx context.Context, clients *Clients, instance *Instance, enableSnapshot, waitSnapshot bool) (err error) {
+	snapshotOptions, err := snapshotOptionsFromConfig()
+	if err != nil {
+		return err
+	}
+
+	instanceID := instance.ID
+	instanceTags := instance.Tags
+
+	// The AMIs are only listed if snapshots are enabled for the instance.
+	if enabled, reason := snapshotEnabled(enableSnapshot, instanceTags); !enabled {
+		if reason != "" {
+			fmt.Println("Skip snapshot: " + reason)
+		}
+		return nil
+	}
+
+	var latest *Image
+	if snapshotOptions.IfOlderThan > 0 {
+		images, err := getAwsshImages(ctx, clients.Images, instanceID)
+		if err != nil {
+			fmt.Printf("Failed to list awssh AMIs. error: %v\n", err)
+			return nil
+		}
+		latest = latestImage(images)
+	}
+
+	create, reason := decideSnapshot(enableSnapshot, instanceTags, latest, snapshotOptions.IfOlderThan, time.Now())
+	if !create {
+		if reason != "" {
+			fmt.Println("Skip snapshot: " + reason)
+		}
+		return nil
+	}
+
+	imageId, err := createAMI(ctx, clients, instanceID, instanceTags, snapshotOptions)
+	if err != nil {
+		fmt.Printf("Failed to create to auto snapshot. error: %v\n", err)
+		return nil
+	}
+	fmt.Println("Create AMI ID: " + *imageId + " (" + reason + ")")
+
+	if waitSnapshot {
+		fmt.Println("Waiting for AMI to become available...")
+		if err := waitImageAvailable(ctx, clients.Images, *imageId); err != nil {
+			fmt.Printf("Failed to wait for auto snapshot. error: %v\n", err)
+		} else {
+			fmt.Println("AMI is available: " + *imageId)
+		}
+	}
+
+	return nil
+}
+
+func snapshotOptionsFromConfig() (opts SnapshotOptions, err error) {
+	tags, err := parseTags(viper.GetStringSlice("snapshot.tags"))
+	if err != nil {
+		return SnapshotOptions{}, err
+	}
+
+	var ifOlderThan time.Duration
+	if s := viper.GetString("snapshot-if-older-than"); s != "" {
+		if ifOlderThan, err = duration.Parse(s); err != nil {
+			return SnapshotOptions{}, err
+		}
+	}
+
+	opts = SnapshotOptions{
+		NameTemplate: viper.GetString("snapshot.name-template"),
+		CopyTags:     viper.GetStringSlice("snapshot.copy-tags"),
+		Tags:         tags,
+		IfOlderThan:  ifOlderThan,
+	}
+	return opts, nil
+}
+
+func SnapshotsList(cmd *cobra.Command, args []string) (err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clients, err := newClientsFromConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	images, err := getAwsshImages(ctx, clients.Images, "")
+	if err != nil {
+		return err
+	}
+
+	printImages(os.Stdout, images)
+	return nil
+}
+
+func SnapshotsPrune(cmd *cobra.Command, args []string) (err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if !cmd.Flags().Changed("keep") && !cmd.Flags().Changed("older-than") {
+		err = errors.New("specify --keep and/or --older-than")
+		return err
+	}
+
+	keep, err := cmd.Flags().GetInt("keep")
+	if err != nil {
+		return err
+	}
+	if keep < 0 {
+		err = errors.New("--keep must be 0 or greater")
+		return err
+	}
+
+	var olderThan time.Duration
+	if cmd.Flags().Changed("older-than") {
+		olderThanString, err := cmd.Flags().GetString("older-than")
+		if err != nil {
+			return err
+		}
+		if olderThan, err = duration.Parse(olderThanString); err != nil {
+			return err
+		}
+	}
+
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+
+	clients, err := newClientsFromConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	images, err := getAwsshImages(ctx, clients.Images, "")
+	if err != nil {
+		return err
+	}
+
+	pruneImages := selectPruneImages(images, keep, olderThan, time.Now())
+	if len(pruneImages) == 0 {
+		fmt.Println("No AMI to prune.")
+		return nil
+	}
+
+	for _, image := range pruneImages {
+		if dryRun {
+			fmt.Printf("Would delete AMI ID: %s (%s) snapshots: %s\n", image.ID, image.InstanceID, strings.Join(image.SnapshotIDs, ","))
+			continue
+		}
+		if err = deleteImage(ctx, clients.Images, image); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted AMI ID: %s (%s) snapshots: %s\n", image.ID, image.InstanceID, strings.Join(image.SnapshotIDs, ","))
+	}
+
+	return nil
+}
+
+func printImages(w io.Writer, images Images) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "IMAGE ID\tINSTANCE ID\tNAME\tSTATE\tCREATED\tSNAPSHOTS")
+	for _, image := range images {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			image.ID,
+			image.InstanceID,
+			image.Name,
+			image.State,
+			image.CreationDate.Local().Format("2006-01-02 15:04:05"),
+			strings.Join(image.SnapshotIDs, ","),
+		)
+	}
+	tw.Flush()
+}
+
+func CacheList(cmd *cobra.Command, args []string) (err error) {
+	entries, err := ListCacheEntries(CachePath)
+	if err != nil {
+		return err
+	}
+
+	printCacheEntries(os.Stdout, entries, time.Now())
+	return nil
+}
+
+func CacheClear(cmd *cobra.Command, args []string) (err error) {
+	if len(args) == 0 {
+		if err = ClearCache(CachePath); err != nil {
+			return err
+		}
+		fmt.Println("Cleared all credentials cache.")
+		return nil
+	}
+
+	entries, err := ListCacheEntries(CachePath)
+	if err != nil {
+		return err
+	}
+
+	for _, profile := range args {
+		found := false
+		for _, entry := range entries {
+			if entry.Profile != profile {
+				continue
+			}
+			if err = os.Remove(entry.Path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			found = true
+		}
+		if !found {
+			fmt.Println("No credentials cache: " + profile)
+			continue
+		}
+		fmt.Println("Cleared credentials cache: " + profile)
+	}
+
+	return nil
+}
+
+func printCacheEntries(w io.Writer, entries CacheEntries, now time.Time) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROFILE\tKEY\tEXPIRES\tREMAINING\tENCRYPTION")
+	for _, entry := range entries {
+		remaining := "expired"
+		if entry.Expiration.After(now) {
+			remaining = entry.Expiration.Sub(now).Round(time.Second).String()
+		}
+		fmt.Fprintf(tw, "%s\t%.12s\t%s\t%s\t%s\n",
+			entry.Profile,
+			entry.Key,
+			entry.Expiration.Local().Format("2006-01-02 15:04:05"),
+			remaining,
+			entry.Encryption,
+		)
+	}
+	tw.Flush()
+}
+
+func Doctor(cmd *cobra.Command, args []string) (err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var instanceID string
+	if len(args) == 1 {
+		instanceID = args[0]
+	}
+
+	identityFile, err := cmd.Flags().GetString("identity-file")
+	if err != nil {
+		return err
+	}
+	publickey, err := cmd.Flags().GetString("publickey")
+	if err != nil {
+		return err
+	}
+
+	// The login method defaults to the config, like the root command.
+	for _, name := range []string{"mode", "transport", "key-push", "document"} {
+		if flag := cmd.Flags().Lookup(name); flag != nil && flag.Changed {
+			viper.Set(name, flag.Value.String())
+		}
+	}
+	target := DoctorTarget{
+		InstanceID: instanceID,
+		Mode:       viper.GetString("mode"),
+		Transport:  viper.GetString("transport"),
+		KeyPush:    viper.GetString("key-push"),
+		Document:   viper.GetString("document"),
+	}
+
+	checks := DoctorChecks{checkPlugin()}
+
+	clients, err := newClientsFromConfig(ctx)
+	if err != nil {
+		checks = append(checks, failCheck("credentials", err, "Check --profile and the credentials of the profile."))
+	} else {
+		checks = append(checks, runDoctorAwsChecks(ctx, clients, target)...)
+	}
+
+	checks = append(checks, checkKeyFiles(identityFile, guessPublickey(identityFile, publickey))...)
+
+	printDoctorChecks(os.Stdout, checks)
+
+	if failed := checks.failed(); failed > 0 {
+		err = fmt.Errorf("%d check(s) failed", failed)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package awssh
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{
+			name: "no args",
+			args: []string{},
+		},
+		{
+			name: "short instance-id",
+			args: []string{"i-0123abcd"},
+		},
+		{
+			name: "long instance-id",
+			args: []string{"i-0123456789abcdef0"},
+		},
+		{
+			name:    "too many args",
+			args:    []string{"i-0123abcd", "i-4567abcd"},
+			wantErr: true,
+		},
+		{
+			name: "ssh args",
+			args: []string{"i-0123abcd", "--", "-A", "uptime"},
+		},
+		{
+			name: "ssh args without instance-id",
+			args: []string{"--", "uptime"},
+		},
+		{
+			name:    "invalid prefix",
+			args:    []string{"x-0123abcd"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid length",
+			args:    []string{"i-0123abc"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid character",
+			args:    []string{"i-0123abc!"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := &cobra.Command{}
+			if err := cmd.Flags().Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if err := Validate(cmd, cmd.Flags().Args()); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSplitSshArgs(t *testing.T) {
+	cmd := &cobra.Command{}
+	if err := cmd.Flags().Parse([]string{"i-0123abcd", "--", "-A", "-L", "8080:localhost:80", "uptime"}); err != nil {
+		t.Fatal(err)
+	}
+
+	instanceArgs, sshArgs := splitSshArgs(cmd, cmd.Flags().Args())
+	if !reflect.DeepEqual(instanceArgs, []string{"i-0123abcd"}) {
+		t.Errorf("instance args = %v", instanceArgs)
+	}
+	if !reflect.DeepEqual(sshArgs, []string{"-A", "-L", "8080:localhost:80", "uptime"}) {
+		t.Errorf("ssh args = %v", sshArgs)
+	}
+}
+
+func TestCheckTransport(t *testing.T) {
+	t.Cleanup(viper.Reset)
+	// session-manager-plugin is not installed.
+	t.Setenv("PATH", t.TempDir())
+
+	viper.Set("transport", TransportAuto)
+	if err := checkTransport(); err != nil || viper.GetString("transport") != TransportEICE {
+		t.Errorf("checkTransport() of auto = %v, transport %s, want %s", err, viper.GetString("transport"), TransportEICE)
+	}
+
+	viper.Set("transport", TransportSSM)
+	var notFound *PluginNotFoundError
+	if err := checkTransport(); !errors.As(err, &notFound) {
+		t.Errorf("checkTransport() of ssm error = %v, want PluginNotFoundError", err)
+	}
+
+	viper.Set("transport", "ssh")
+	if err := checkTransport(); err == nil {
+		t.Error("checkTransport() of an invalid transport succeeded")
+	}
+}
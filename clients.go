@@ -0,0 +1,211 @@
+package awssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2instanceconnect"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssooidc"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+type (
+	// InstanceDiscoverer finds instances to connect to.
+	InstanceDiscoverer interface {
+		DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error)
+	}
+
+	// SessionStarter starts Session Manager sessions, and terminates them on exit.
+	SessionStarter interface {
+		StartSession(ctx context.Context, params *ssm.StartSessionInput, optFns ...func(*ssm.Options)) (*ssm.StartSessionOutput, error)
+		TerminateSession(ctx context.Context, params *ssm.TerminateSessionInput, optFns ...func(*ssm.Options)) (*ssm.TerminateSessionOutput, error)
+	}
+
+	// KeyPusher pushes a temporary ssh public key to an instance.
+	KeyPusher interface {
+		SendSSHPublicKey(ctx context.Context, params *ec2instanceconnect.SendSSHPublicKeyInput, optFns ...func(*ec2instanceconnect.Options)) (*ec2instanceconnect.SendSSHPublicKeyOutput, error)
+	}
+
+	// ImageCreator creates and manages AMIs of instances.
+	ImageCreator interface {
+		CreateImage(ctx context.Context, params *ec2.CreateImageInput, optFns ...func(*ec2.Options)) (*ec2.CreateImageOutput, error)
+		DescribeImages(ctx context.Context, params *ec2.DescribeImagesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeImagesOutput, error)
+		DeregisterImage(ctx context.Context, params *ec2.DeregisterImageInput, optFns ...func(*ec2.Options)) (*ec2.DeregisterImageOutput, error)
+		DeleteSnapshot(ctx context.Context, params *ec2.DeleteSnapshotInput, optFns ...func(*ec2.Options)) (*ec2.DeleteSnapshotOutput, error)
+	}
+
+	// CallerIdentifier returns the IAM principal of the credentials.
+	CallerIdentifier interface {
+		GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error)
+	}
+
+	// CommandSender runs commands on instances by SSM Run Command.
+	CommandSender interface {
+		SendCommand(ctx context.Context, params *ssm.SendCommandInput, optFns ...func(*ssm.Options)) (*ssm.SendCommandOutput, error)
+		GetCommandInvocation(ctx context.Context, params *ssm.GetCommandInvocationInput, optFns ...func(*ssm.Options)) (*ssm.GetCommandInvocationOutput, error)
+	}
+
+	// InventoryLister lists the SSM inventory of managed instances, such as the installed applications.
+	InventoryLister interface {
+		ListInventoryEntries(ctx context.Context, params *ssm.ListInventoryEntriesInput, optFns ...func(*ssm.Options)) (*ssm.ListInventoryEntriesOutput, error)
+	}
+
+	// AgentStatusChecker returns the SSM agent status of managed instances.
+	AgentStatusChecker interface {
+		DescribeInstanceInformation(ctx context.Context, params *ssm.DescribeInstanceInformationInput, optFns ...func(*ssm.Options)) (*ssm.DescribeInstanceInformationOutput, error)
+	}
+
+	// PolicySimulator evaluates the IAM policies of a principal.
+	PolicySimulator interface {
+		GetRole(ctx context.Context, params *iam.GetRoleInput, optFns ...func(*iam.Options)) (*iam.GetRoleOutput, error)
+		SimulatePrincipalPolicy(ctx context.Context, params *iam.SimulatePrincipalPolicyInput, optFns ...func(*iam.Options)) (*iam.SimulatePrincipalPolicyOutput, error)
+	}
+
+	// SSOTokenIssuer issues IAM Identity Center tokens by the OIDC device authorization flow, and refreshes them.
+	SSOTokenIssuer interface {
+		RegisterClient(ctx context.Context, params *ssooidc.RegisterClientInput, optFns ...func(*ssooidc.Options)) (*ssooidc.RegisterClientOutput, error)
+		StartDeviceAuthorization(ctx context.Context, params *ssooidc.StartDeviceAuthorizationInput, optFns ...func(*ssooidc.Options)) (*ssooidc.StartDeviceAuthorizationOutput, error)
+		CreateToken(ctx context.Context, params *ssooidc.CreateTokenInput, optFns ...func(*ssooidc.Options)) (*ssooidc.CreateTokenOutput, error)
+	}
+
+	// InstanceConnectEndpointFinder finds the EC2 Instance Connect Endpoints of VPCs.
+	InstanceConnectEndpointFinder interface {
+		DescribeInstanceConnectEndpoints(ctx context.Context, params *ec2.DescribeInstanceConnectEndpointsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstanceConnectEndpointsOutput, error)
+	}
+
+	// EndpointTunnelOpener opens tunnels to the port of instances through EC2 Instance Connect Endpoints.
+	EndpointTunnelOpener interface {
+		OpenTunnel(ctx context.Context, endpoint InstanceConnectEndpoint, privateIPAddress, remotePort string) (conn net.Conn, err error)
+	}
+
+	Clients struct {
+		Region          string
+		Instances       InstanceDiscoverer
+		Sessions        SessionStarter
+		Keys            KeyPusher
+		Images          ImageCreator
+		Identity        CallerIdentifier
+		Commands        CommandSender
+		Inventory       InventoryLister
+		Agents          AgentStatusChecker
+		Policies        PolicySimulator
+		Endpoints       InstanceConnectEndpointFinder
+		EndpointTunnels EndpointTunnelOpener
+	}
+)
+
+func NewClients(cfg aws.Config) (clients *Clients) {
+	ec2Client := ec2.NewFromConfig(cfg)
+	ssmClient := ssm.NewFromConfig(cfg)
+	clients = &Clients{
+		Region:          cfg.Region,
+		Instances:       ec2Client,
+		Sessions:        ssmClient,
+		Keys:            ec2instanceconnect.NewFromConfig(cfg),
+		Images:          ec2Client,
+		Identity:        sts.NewFromConfig(cfg),
+		Commands:        ssmClient,
+		Inventory:       ssmClient,
+		Agents:          ssmClient,
+		Policies:        iam.NewFromConfig(cfg),
+		Endpoints:       ec2Client,
+		EndpointTunnels: NewEiceTunnelOpener(cfg),
+	}
+	return clients
+}
+
+func loadAwsConfig(ctx context.Context, profile string, duration time.Duration, optFns ...func(*config.LoadOptions) error) (cfg aws.Config, err error) {
+	optFns = append([]func(*config.LoadOptions) error{
+		config.WithSharedConfigProfile(profile),
+		config.WithAssumeRoleCredentialOptions(func(o *stscreds.AssumeRoleOptions) {
+			o.TokenProvider = stscreds.StdinTokenProvider
+			o.Duration = duration
+		}),
+	}, optFns...)
+
+	cfg, err = config.LoadDefaultConfig(ctx, optFns...)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	if cfg.Region == "" {
+		err = errors.New("region is not configured for profile: " + profile)
+		return aws.Config{}, err
+	}
+	return cfg, nil
+}
+
+func newAwsConfig(ctx context.Context, profile string, cache bool, duration time.Duration, cacheEncryption string, awsCliCache bool) (cfg aws.Config, err error) {
+	profileConfig, err := ResolveProfileConfig(profile)
+	if err != nil {
+		return aws.Config{}, err
+	}
+
+	if !cache {
+		if err = ensureSSOToken(ctx, profileConfig); err != nil {
+			return aws.Config{}, err
+		}
+		cfg, err = loadAwsConfig(ctx, profile, duration)
+		return cfg, err
+	}
+
+	c, err := NewCache(CachePath, profileConfig.CacheKey(), profile, cacheEncryption)
+	if err != nil {
+		return aws.Config{}, err
+	}
+
+	credsCache, err := c.Load()
+	if err != nil && err != ErrCacheNotFound && err != ErrCacheExpired {
+		fmt.Fprintf(os.Stderr, "Ignore credentials cache. error: %v\n", err)
+	}
+	if err != nil && awsCliCache {
+		credsCache, err = loadAwsCliCache(profileConfig)
+		if err != nil && err != ErrCacheNotFound && err != ErrCacheExpired {
+			fmt.Fprintf(os.Stderr, "Ignore AWS CLI credentials cache. error: %v\n", err)
+		}
+	}
+	if err == nil {
+		provider := credentials.StaticCredentialsProvider{Value: *credsCache}
+		cfg, err = loadAwsConfig(ctx, profile, duration, config.WithCredentialsProvider(provider))
+		return cfg, err
+	}
+
+	if err = ensureSSOToken(ctx, profileConfig); err != nil {
+		return aws.Config{}, err
+	}
+	cfg, err = loadAwsConfig(ctx, profile, duration)
+	if err != nil {
+		return aws.Config{}, err
+	}
+
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return aws.Config{}, wrapAwsError(err, "sts:AssumeRole")
+	}
+
+	// Credentials without expiration (e.g. static access keys) are not cached.
+	if !creds.CanExpire {
+		return cfg, nil
+	}
+	if err = c.Save(creds); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to save credentials cache. error: %v\n", err)
+	}
+	// The AWS CLI cache is plaintext, so it is written only if the awssh cache is not encrypted.
+	if awsCliCache && c.Encryption == CacheEncryptionNone {
+		if err = saveAwsCliCache(profileConfig, creds); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to save AWS CLI credentials cache. error: %v\n", err)
+		}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,122 @@
+package awssh
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	CmdScp string = "scp"
+)
+
+type (
+	// RemotePath is a path on the instance given as "INSTANCE:PATH". Instance is the instance-id or the Name tag.
+	RemotePath struct {
+		Instance string
+		Path     string
+	}
+)
+
+// Parse "INSTANCE:PATH" like scp. It is a local path if there is no colon before the first slash,
+// so local paths containing a colon can be given as "./a:b". Nil is returned for local paths.
+func parseRemotePath(arg string) (remote *RemotePath) {
+	i := strings.Index(arg, ":")
+	if i <= 0 || strings.Contains(arg[:i], "/") {
+		return nil
+	}
+	remote = &RemotePath{
+		Instance: arg[:i],
+		Path:     arg[i+1:],
+	}
+	return remote
+}
+
+// Pick the remote path of src and dst. Only one of them can be on the instance.
+func remotePathOf(src, dst string) (remote *RemotePath, err error) {
+	srcRemote, dstRemote := parseRemotePath(src), parseRemotePath(dst)
+	switch {
+	case srcRemote != nil && dstRemote != nil:
+		err = errors.New("copying between instances is not supported, either <src> or <dst> must be a local path")
+		return nil, err
+	case srcRemote != nil:
+		return srcRemote, nil
+	case dstRemote != nil:
+		return dstRemote, nil
+	}
+	err = errors.New("either <src> or <dst> must be INSTANCE:PATH")
+	return nil, err
+}
+
+// Replace "INSTANCE:PATH" of the arg with the destination of ssh through the local port.
+func sshDestinationPath(arg string) (path string) {
+	remote := parseRemotePath(arg)
+	if remote == nil {
+		return arg
+	}
+	path = viper.GetString("username") + "@" + ConnectHost + ":" + remote.Path
+	return path
+}
+
+// Select the -o options from the options of ssh. scp does not take the other options of ssh, so the other
+// ssh-args of the config are not passed to scp.
+func scpOptions(options []string) (selected []string) {
+	selected = []string{}
+	for i := 0; i < len(options); i++ {
+		switch {
+		case options[i] == "-o" && i+1 < len(options):
+			selected = append(selected, options[i], options[i+1])
+			i++
+		case strings.HasPrefix(options[i], "-o") && len(options[i]) > 2:
+			selected = append(selected, options[i])
+		}
+	}
+	return selected
+}
+
+// CopyWithClients copies files between the local host and the instance with scp through the port forwarding.
+// The host key is saved as the instance-id, so that it does not change with the local port.
+func CopyWithClients(ctx context.Context, clients *Clients, src, dst string, recursive, quiet bool) (err error) {
+	remote, err := remotePathOf(src, dst)
+	if err != nil {
+		return err
+	}
+
+	instance, err := findInstance(ctx, clients, remote.Instance)
+	if err != nil {
+		return err
+	}
+
+	options, err := sshOptions()
+	if err != nil {
+		return err
+	}
+
+	session, err := startSshSession(ctx, clients, instance)
+	if err != nil {
+		return err
+	}
+	defer session.Stop()
+
+	args := append(scpOptions(options), "-o", "HostKeyAlias="+instance.ID, "-P", session.Forward().LocalPort, "-i", viper.GetString("identity-file"))
+	if sshCommand := viper.GetString("ssh-command"); sshCommand != "" && sshCommand != CmdSsh {
+		args = append(args, "-S", sshCommand)
+	}
+	if recursive {
+		args = append(args, "-r")
+	}
+	if quiet {
+		args = append(args, "-q")
+	}
+	args = append(args, sshDestinationPath(src), sshDestinationPath(dst))
+
+	cmdScp, err := execExternalCommand(ctx, CmdScp, args)
+	if err != nil {
+		return err
+	}
+
+	err = commandExitError(cmdScp.Wait())
+	return err
+}
@@ -0,0 +1,59 @@
+package awssh
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRemotePath(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want *RemotePath
+	}{
+		{"i-0123456789abcdef0:/tmp/app.tar.gz", &RemotePath{Instance: "i-0123456789abcdef0", Path: "/tmp/app.tar.gz"}},
+		{"web:logs", &RemotePath{Instance: "web", Path: "logs"}},
+		{"web:", &RemotePath{Instance: "web", Path: ""}},
+		{"./app.tar.gz", nil},
+		{"/tmp/a:b", nil},
+		{"./a:b", nil},
+		{":path", nil},
+	}
+
+	for _, tt := range tests {
+		if got := parseRemotePath(tt.arg); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRemotePath(%q) = %+v, want %+v", tt.arg, got, tt.want)
+		}
+	}
+}
+
+func TestRemotePathOf(t *testing.T) {
+	tests := []struct {
+		src, dst string
+		want     string
+		wantErr  bool
+	}{
+		{src: "web:/var/log", dst: "./logs", want: "web"},
+		{src: "./app.tar.gz", dst: "i-0123456789abcdef0:/tmp/", want: "i-0123456789abcdef0"},
+		{src: "web:/a", dst: "db:/b", wantErr: true},
+		{src: "./a", dst: "./b", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := remotePathOf(tt.src, tt.dst)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("remotePathOf(%q, %q) error = %v, wantErr %v", tt.src, tt.dst, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got.Instance != tt.want {
+			t.Errorf("remotePathOf(%q, %q) = %s, want %s", tt.src, tt.dst, got.Instance, tt.want)
+		}
+	}
+}
+
+func TestScpOptions(t *testing.T) {
+	options := []string{"-o", "ServerAliveInterval=10", "-A", "-oForwardX11=yes", "-L", "8080:localhost:80", "-o"}
+	want := []string{"-o", "ServerAliveInterval=10", "-oForwardX11=yes"}
+	if got := scpOptions(options); !reflect.DeepEqual(got, want) {
+		t.Errorf("scpOptions() = %v, want %v", got, want)
+	}
+}
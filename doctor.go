@@ -0,0 +1,490 @@
+package awssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	iamtypes "github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	homedir "github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	DoctorStatusPass string = "PASS"
+	DoctorStatusWarn string = "WARN"
+	DoctorStatusFail string = "FAIL"
+	DoctorStatusSkip string = "SKIP"
+)
+
+type (
+	DoctorCheck struct {
+		Name   string
+		Status string
+		Detail string
+		Fix    string
+	}
+	DoctorChecks []DoctorCheck
+
+	// DoctorAction is an IAM action awssh calls. Optional actions are only needed by some features.
+	// The action is simulated on Resources, or on all resources if it is empty.
+	DoctorAction struct {
+		Name      string
+		Required  bool
+		Feature   string
+		Resources []string
+	}
+
+	// DoctorTarget is the instance and the login method the IAM permissions are simulated for.
+	// Partition and Account are those of the caller. InstanceID is optional.
+	DoctorTarget struct {
+		Partition  string
+		Region     string
+		Account    string
+		InstanceID string
+		Mode       string
+		Transport  string
+		KeyPush    string
+		Document   string
+	}
+)
+
+// Resources of DoctorAction, which are resolved to the ARNs of DoctorTarget.
+const (
+	DoctorResourceInstance        string = "instance"
+	DoctorResourceSessionDocument string = "session document"
+	DoctorResourceCommandDocument string = "command document"
+)
+
+// IAM actions checked by doctor, which are required by the default login (--mode=ssh --transport=auto --key-push=auto).
+// Keep in sync with the IAM Policy section of the README.
+var DoctorActions = []DoctorAction{
+	{Name: "ec2:DescribeInstances", Required: true},
+	{Name: "ssm:StartSession", Required: true, Feature: "--transport=ssm", Resources: []string{DoctorResourceInstance, DoctorResourceSessionDocument}},
+	{Name: "ssm:TerminateSession", Feature: "session cleanup"},
+	{Name: "ec2-instance-connect:SendSSHPublicKey", Required: true, Feature: "--key-push=instance-connect", Resources: []string{DoctorResourceInstance}},
+	{Name: "ssm:SendCommand", Feature: "--key-push=ssm", Resources: []string{DoctorResourceInstance, DoctorResourceCommandDocument}},
+	{Name: "ssm:GetCommandInvocation", Feature: "--key-push=ssm"},
+	{Name: "ssm:ListInventoryEntries", Feature: "the package check of --key-push=auto", Resources: []string{DoctorResourceInstance}},
+	{Name: "ec2:CreateImage", Feature: "snapshot"},
+	{Name: "ec2:CreateTags", Feature: "snapshot"},
+	{Name: "ec2:DescribeImages", Feature: "snapshot"},
+	{Name: "ec2:DeregisterImage", Feature: "snapshot"},
+	{Name: "ec2:DeleteSnapshot", Feature: "snapshot"},
+	{Name: "sts:GetCallerIdentity", Feature: "snapshot"},
+	{Name: "ec2:DescribeInstanceConnectEndpoints", Feature: "--transport=eice"},
+	{Name: "ec2-instance-connect:OpenTunnel", Feature: "--transport=eice"},
+}
+
+func (checks DoctorChecks) failed() (count int) {
+	for _, check := range checks {
+		if check.Status == DoctorStatusFail {
+			count++
+		}
+	}
+	return count
+}
+
+func passCheck(name, detail string) (check DoctorCheck) {
+	check = DoctorCheck{Name: name, Status: DoctorStatusPass, Detail: detail}
+	return check
+}
+
+// A failed check takes its fix from the hint of typed errors unless fix is given.
+func failCheck(name string, err error, fix string) (check DoctorCheck) {
+	if fix == "" {
+		fix = ErrorHint(err)
+	}
+	check = DoctorCheck{Name: name, Status: DoctorStatusFail, Detail: err.Error(), Fix: fix}
+	return check
+}
+
+func skipCheck(name, detail string) (check DoctorCheck) {
+	check = DoctorCheck{Name: name, Status: DoctorStatusSkip, Detail: detail}
+	return check
+}
+
+func checkPlugin() (check DoctorCheck) {
+	const name = "session-manager-plugin"
+
+	output, err := exec.Command(CmdSessionManagerPlugin, "--version").Output()
+	if err != nil {
+		return failCheck(name, &PluginNotFoundError{Err: err}, "")
+	}
+
+	check = passCheck(name, "version "+strings.TrimSpace(string(output)))
+	return check
+}
+
+func checkIdentity(ctx context.Context, client CallerIdentifier) (check DoctorCheck, callerArn string) {
+	const name = "credentials"
+
+	result, err := client.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return failCheck(name, wrapAwsError(err, "sts:GetCallerIdentity"), "Check --profile and the credentials of the profile, e.g. run `aws sts get-caller-identity --profile <profile>`."), ""
+	}
+
+	callerArn = aws.ToString(result.Arn)
+	check = passCheck(name, callerArn)
+	return check, callerArn
+}
+
+func checkRegion(region string) (check DoctorCheck) {
+	const name = "region"
+
+	if region == "" {
+		return failCheck(name, errors.New("region is not configured"), "Set region in the profile or AWS_REGION.")
+	}
+
+	check = passCheck(name, region)
+	return check
+}
+
+func checkInstance(ctx context.Context, client InstanceDiscoverer, instanceID string) (check DoctorCheck) {
+	const name = "instance"
+
+	instance, err := getInstance(ctx, client, instanceID)
+	if err != nil {
+		return failCheck(name, err, "")
+	}
+
+	detail := fmt.Sprintf("%s %s (%s, %s, %s)", instance.ID, instance.TagName, instance.State, instance.AvailabilityZone, instance.Platform)
+	if instance.State != "running" {
+		return failCheck(name, errors.New(detail), "Start the instance.")
+	}
+
+	check = passCheck(name, detail)
+	return check
+}
+
+func checkAgent(ctx context.Context, client AgentStatusChecker, instanceID string) (check DoctorCheck) {
+	const name = "ssm agent"
+
+	result, err := client.DescribeInstanceInformation(ctx, &ssm.DescribeInstanceInformationInput{
+		Filters: []ssmtypes.InstanceInformationStringFilter{
+			{
+				Key:    aws.String("InstanceIds"),
+				Values: []string{instanceID},
+			},
+		},
+	})
+	if err != nil {
+		err = wrapAwsError(err, "ssm:DescribeInstanceInformation")
+		var denied *AccessDeniedError
+		if errors.As(err, &denied) {
+			return skipCheck(name, err.Error())
+		}
+		return failCheck(name, err, "")
+	}
+
+	notConnected := &TargetNotConnectedError{InstanceID: instanceID, Err: errors.New("not registered as a managed instance")}
+	if len(result.InstanceInformationList) == 0 {
+		return failCheck(name, notConnected, "")
+	}
+
+	information := result.InstanceInformationList[0]
+	detail := fmt.Sprintf("%s, agent %s, %s", information.PingStatus, aws.ToString(information.AgentVersion), aws.ToString(information.PlatformName))
+	if information.PingStatus != ssmtypes.PingStatusOnline {
+		notConnected.Err = errors.New(detail)
+		return failCheck(name, notConnected, "")
+	}
+
+	check = passCheck(name, detail)
+	return check
+}
+
+// Resolve the IAM principal to simulate. An assumed role session is simulated as its role,
+// whose ARN includes the path (e.g. /aws-reserved/sso.amazonaws.com/ for IAM Identity Center).
+func principalArnForSimulation(ctx context.Context, client PolicySimulator, callerArn string) (principalArn string, err error) {
+	parsed, err := arn.Parse(callerArn)
+	if err != nil {
+		return "", err
+	}
+
+	resource := strings.Split(parsed.Resource, "/")
+	switch {
+	case parsed.Service == "iam" && resource[0] == "user":
+		return callerArn, nil
+	case parsed.Service == "sts" && resource[0] == "assumed-role" && len(resource) >= 2:
+		result, err := client.GetRole(ctx, &iam.GetRoleInput{RoleName: aws.String(resource[1])})
+		if err != nil {
+			return "", wrapAwsError(err, "iam:GetRole")
+		}
+		return aws.ToString(result.Role.Arn), nil
+	}
+
+	err = errors.New("cannot simulate the policy of " + callerArn)
+	return "", err
+}
+
+// The actions of the target. --transport=eice forwards the port through EC2 Instance Connect Endpoint instead of
+// Session Manager, and auto falls back to it. --mode=ssm-shell always uses Session Manager. The public key is not
+// pushed by --mode=ssm-shell, and is pushed by SSM Run Command instead of EC2 Instance Connect by --key-push=ssm.
+func (target DoctorTarget) actions() (actions []DoctorAction) {
+	transport := target.Transport
+	keyPush := target.KeyPush
+	if target.Mode == ModeSSMShell {
+		transport = TransportSSM
+		keyPush = ""
+	}
+
+	for _, action := range DoctorActions {
+		switch action.Name {
+		case "ssm:StartSession":
+			action.Required = transport != TransportEICE
+		case "ec2:DescribeInstanceConnectEndpoints", "ec2-instance-connect:OpenTunnel":
+			action.Required = transport == TransportEICE
+		case "ec2-instance-connect:SendSSHPublicKey":
+			action.Required = keyPush == KeyPushAuto || keyPush == KeyPushInstanceConnect
+		case "ssm:SendCommand", "ssm:GetCommandInvocation":
+			action.Required = keyPush == KeyPushSSM
+		}
+		actions = append(actions, action)
+	}
+	return actions
+}
+
+// The ARNs of the resources of the action. The instance is all instances of the account if InstanceID is empty.
+func (target DoctorTarget) resourceArns(action DoctorAction) (arns []string) {
+	for _, resource := range action.Resources {
+		switch resource {
+		case DoctorResourceInstance:
+			instanceID := target.InstanceID
+			if instanceID == "" {
+				instanceID = "*"
+			}
+			arns = append(arns, target.arn("ec2", target.Account, "instance/"+instanceID))
+		case DoctorResourceSessionDocument:
+			document := DocumentNameAwsStartPortForwardingSession
+			if target.Mode == ModeSSMShell {
+				document = DocumentNameSsmSessionManagerRunShell
+				if target.Document != "" {
+					document = target.Document
+				}
+			}
+			arns = append(arns, target.documentArn(document))
+		case DoctorResourceCommandDocument:
+			arns = append(arns, target.documentArn(DocumentNameAwsRunShellScript))
+		}
+	}
+	return arns
+}
+
+func (target DoctorTarget) arn(service, account, resource string) string {
+	return arn.ARN{Partition: target.Partition, Service: service, Region: target.Region, AccountID: account, Resource: resource}.String()
+}
+
+// The ARN of the SSM document. Documents owned by AWS, whose names start with "AWS-", have no account.
+func (target DoctorTarget) documentArn(document string) string {
+	if arn.IsARN(document) {
+		return document
+	}
+	account := target.Account
+	if strings.HasPrefix(document, "AWS-") {
+		account = ""
+	}
+	return target.arn("ssm", account, "document/"+document)
+}
+
+// Simulate the policy of the caller for the actions of the target. The actions with the same resources are
+// simulated at once, and an action is allowed only if it is allowed on all of its resources.
+func simulateActions(ctx context.Context, client PolicySimulator, principalArn string, target DoctorTarget, actions []DoctorAction) (decisions map[string]iamtypes.PolicyEvaluationDecisionType, err error) {
+	var contextEntries []iamtypes.ContextEntry
+	if target.Region != "" {
+		contextEntries = append(contextEntries, iamtypes.ContextEntry{
+			ContextKeyName:   aws.String("aws:RequestedRegion"),
+			ContextKeyType:   iamtypes.ContextKeyTypeEnumString,
+			ContextKeyValues: []string{target.Region},
+		})
+	}
+
+	groups := []string{}
+	groupActions := map[string][]string{}
+	groupArns := map[string][]string{}
+	for _, action := range actions {
+		arns := target.resourceArns(action)
+		group := strings.Join(arns, " ")
+		if _, ok := groupActions[group]; !ok {
+			groups = append(groups, group)
+			groupArns[group] = arns
+		}
+		groupActions[group] = append(groupActions[group], action.Name)
+	}
+
+	decisions = map[string]iamtypes.PolicyEvaluationDecisionType{}
+	decide := func(action string, decision iamtypes.PolicyEvaluationDecisionType) {
+		if current, ok := decisions[action]; !ok || current == iamtypes.PolicyEvaluationDecisionTypeAllowed {
+			decisions[action] = decision
+		}
+	}
+	for _, group := range groups {
+		paginator := iam.NewSimulatePrincipalPolicyPaginator(client, &iam.SimulatePrincipalPolicyInput{
+			PolicySourceArn: aws.String(principalArn),
+			ActionNames:     groupActions[group],
+			ResourceArns:    groupArns[group],
+			ContextEntries:  contextEntries,
+		})
+		for paginator.HasMorePages() {
+			result, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, wrapAwsError(err, "iam:SimulatePrincipalPolicy")
+			}
+			for _, evaluation := range result.EvaluationResults {
+				action := aws.ToString(evaluation.EvalActionName)
+				decide(action, evaluation.EvalDecision)
+				for _, resourceResult := range evaluation.ResourceSpecificResults {
+					decide(action, resourceResult.EvalResourceDecision)
+				}
+			}
+		}
+	}
+	return decisions, nil
+}
+
+func checkPermissions(ctx context.Context, client PolicySimulator, callerArn string, target DoctorTarget) (checks DoctorChecks) {
+	const name = "iam"
+
+	principalArn, err := principalArnForSimulation(ctx, client, callerArn)
+	if err != nil {
+		return DoctorChecks{skipCheck(name, err.Error())}
+	}
+
+	caller, _ := arn.Parse(callerArn)
+	target.Partition = caller.Partition
+	target.Account = caller.AccountID
+
+	actions := target.actions()
+	decisions, err := simulateActions(ctx, client, principalArn, target, actions)
+	if err != nil {
+		return DoctorChecks{skipCheck(name, err.Error())}
+	}
+
+	for _, action := range actions {
+		checkName := name + " " + action.Name
+		decision := decisions[action.Name]
+		switch {
+		case decision == iamtypes.PolicyEvaluationDecisionTypeAllowed:
+			checks = append(checks, passCheck(checkName, "allowed"))
+		case action.Required:
+			checks = append(checks, failCheck(checkName, &AccessDeniedError{Action: action.Name, Err: errors.New(string(decision))}, ""))
+		default:
+			checks = append(checks, DoctorCheck{
+				Name:   checkName,
+				Status: DoctorStatusWarn,
+				Detail: string(decision) + " (needed for " + action.Feature + ")",
+				Fix:    "Allow " + action.Name + " to use " + action.Feature + ".",
+			})
+		}
+	}
+	return checks
+}
+
+// Check that the identity file is readable with safe permissions and the public key is its pair.
+func checkKeyFiles(identityFile, publickeyFile string) (checks DoctorChecks) {
+	var privatePublicKey ssh.PublicKey
+
+	identityCheck := func() DoctorCheck {
+		const name = "identity file"
+
+		fullPath, err := homedir.Expand(identityFile)
+		if err != nil {
+			return failCheck(name, &KeyFileError{Path: identityFile, Err: err}, "")
+		}
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			return failCheck(name, &KeyFileError{Path: identityFile, Err: err}, "")
+		}
+		if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+			err = fmt.Errorf("permissions %#o are too open", info.Mode().Perm())
+			return failCheck(name, &KeyFileError{Path: identityFile, Err: err}, "chmod 600 "+identityFile)
+		}
+
+		data, err := ioutil.ReadFile(fullPath)
+		if err != nil {
+			return failCheck(name, &KeyFileError{Path: identityFile, Err: err}, "")
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		var passphraseErr *ssh.PassphraseMissingError
+		if errors.As(err, &passphraseErr) {
+			privatePublicKey = passphraseErr.PublicKey
+			return passCheck(name, identityFile+" (encrypted)")
+		} else if err != nil {
+			return failCheck(name, &KeyFileError{Path: identityFile, Err: err}, "")
+		}
+
+		privatePublicKey = signer.PublicKey()
+		return passCheck(name, identityFile+" ("+signer.PublicKey().Type()+")")
+	}
+	checks = append(checks, identityCheck())
+
+	publickeyCheck := func() DoctorCheck {
+		const name = "public key"
+
+		publicKey, err := readPublicKey(publickeyFile)
+		if err != nil {
+			return failCheck(name, err, "")
+		}
+		parsed, _, _, _, _ := ssh.ParseAuthorizedKey([]byte(publicKey))
+
+		if privatePublicKey != nil && !bytes.Equal(privatePublicKey.Marshal(), parsed.Marshal()) {
+			err = errors.New("does not match the identity file " + identityFile)
+			return failCheck(name, &KeyFileError{Path: publickeyFile, Err: err}, "Regenerate it with `ssh-keygen -y -f "+identityFile+"`.")
+		}
+		return passCheck(name, publickeyFile+" ("+parsed.Type()+")")
+	}
+	checks = append(checks, publickeyCheck())
+
+	return checks
+}
+
+// Run the checks which need AWS clients. The instance of the target is optional.
+func runDoctorAwsChecks(ctx context.Context, clients *Clients, target DoctorTarget) (checks DoctorChecks) {
+	instanceID := target.InstanceID
+	target.Region = clients.Region
+
+	checks = append(checks, checkRegion(clients.Region))
+
+	identityCheck, callerArn := checkIdentity(ctx, clients.Identity)
+	checks = append(checks, identityCheck)
+
+	if instanceID == "" {
+		checks = append(checks, skipCheck("instance", "no instance-id given"))
+	} else {
+		checks = append(checks, checkInstance(ctx, clients.Instances, instanceID))
+		checks = append(checks, checkAgent(ctx, clients.Agents, instanceID))
+	}
+
+	if callerArn == "" {
+		checks = append(checks, skipCheck("iam", "credentials are not available"))
+	} else {
+		checks = append(checks, checkPermissions(ctx, clients.Policies, callerArn, target)...)
+	}
+
+	return checks
+}
+
+func printDoctorChecks(w io.Writer, checks DoctorChecks) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tCHECK\tDETAIL")
+	for _, check := range checks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", check.Status, check.Name, check.Detail)
+		if check.Fix != "" && check.Status != DoctorStatusPass {
+			fmt.Fprintf(tw, "\t\tfix: %s\n", check.Fix)
+		}
+	}
+	tw.Flush()
+}
@@ -0,0 +1,378 @@
+package awssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	iamtypes "github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"golang.org/x/crypto/ssh"
+)
+
+type (
+	fakeIAM struct {
+		roleArn   string
+		allowed   map[string]bool
+		simulated []*iam.SimulatePrincipalPolicyInput
+	}
+	fakeAgents struct {
+		information []ssmtypes.InstanceInformation
+	}
+)
+
+func (f *fakeIAM) GetRole(ctx context.Context, params *iam.GetRoleInput, optFns ...func(*iam.Options)) (*iam.GetRoleOutput, error) {
+	return &iam.GetRoleOutput{Role: &iamtypes.Role{Arn: aws.String(f.roleArn)}}, nil
+}
+
+// An action is allowed on all resources by allowed[action], or on a resource by allowed[action+" "+resource].
+func (f *fakeIAM) SimulatePrincipalPolicy(ctx context.Context, params *iam.SimulatePrincipalPolicyInput, optFns ...func(*iam.Options)) (*iam.SimulatePrincipalPolicyOutput, error) {
+	f.simulated = append(f.simulated, params)
+	resources := params.ResourceArns
+	if len(resources) == 0 {
+		resources = []string{"*"}
+	}
+	output := &iam.SimulatePrincipalPolicyOutput{}
+	for _, action := range params.ActionNames {
+		for _, resource := range resources {
+			decision := iamtypes.PolicyEvaluationDecisionTypeImplicitDeny
+			if f.allowed[action] || f.allowed[action+" "+resource] {
+				decision = iamtypes.PolicyEvaluationDecisionTypeAllowed
+			}
+			output.EvaluationResults = append(output.EvaluationResults, iamtypes.EvaluationResult{
+				EvalActionName:   aws.String(action),
+				EvalResourceName: aws.String(resource),
+				EvalDecision:     decision,
+			})
+		}
+	}
+	return output, nil
+}
+
+func (f *fakeAgents) DescribeInstanceInformation(ctx context.Context, params *ssm.DescribeInstanceInformationInput, optFns ...func(*ssm.Options)) (*ssm.DescribeInstanceInformationOutput, error) {
+	return &ssm.DescribeInstanceInformationOutput{InstanceInformationList: f.information}, nil
+}
+
+// Write an ed25519 key pair and return the identity file path.
+func writeTestKeyPair(t *testing.T, dir, name string) (identityFile string) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identityFile = filepath.Join(dir, name)
+	if err := os.WriteFile(identityFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(identityFile+".pub", ssh.MarshalAuthorizedKey(sshPub), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return identityFile
+}
+
+func checkStatuses(checks DoctorChecks) (statuses map[string]string) {
+	statuses = map[string]string{}
+	for _, check := range checks {
+		statuses[check.Name] = check.Status
+	}
+	return statuses
+}
+
+func TestCheckKeyFiles(t *testing.T) {
+	dir := t.TempDir()
+	key := writeTestKeyPair(t, dir, "id_ed25519")
+	other := writeTestKeyPair(t, dir, "other")
+
+	open := filepath.Join(dir, "open")
+	data, _ := os.ReadFile(key)
+	if err := os.WriteFile(open, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		identityFile string
+		publickey    string
+		want         map[string]string
+	}{
+		{
+			name:         "valid pair",
+			identityFile: key,
+			publickey:    key + ".pub",
+			want:         map[string]string{"identity file": DoctorStatusPass, "public key": DoctorStatusPass},
+		},
+		{
+			name:         "mismatched pair",
+			identityFile: key,
+			publickey:    other + ".pub",
+			want:         map[string]string{"identity file": DoctorStatusPass, "public key": DoctorStatusFail},
+		},
+		{
+			name:         "too open",
+			identityFile: open,
+			publickey:    key + ".pub",
+			want:         map[string]string{"identity file": DoctorStatusFail, "public key": DoctorStatusPass},
+		},
+		{
+			name:         "missing",
+			identityFile: filepath.Join(dir, "missing"),
+			publickey:    filepath.Join(dir, "missing.pub"),
+			want:         map[string]string{"identity file": DoctorStatusFail, "public key": DoctorStatusFail},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := checkStatuses(checkKeyFiles(tt.identityFile, tt.publickey))
+			for name, status := range tt.want {
+				if got[name] != status {
+					t.Errorf("%s = %s, want %s", name, got[name], status)
+				}
+			}
+		})
+	}
+}
+
+func TestPrincipalArnForSimulation(t *testing.T) {
+	client := &fakeIAM{roleArn: "arn:aws:iam::123456789012:role/aws-reserved/sso.amazonaws.com/AWSReservedSSO_Admin_0123"}
+
+	tests := []struct {
+		callerArn string
+		want      string
+		wantErr   bool
+	}{
+		{callerArn: "arn:aws:iam::123456789012:user/alice", want: "arn:aws:iam::123456789012:user/alice"},
+		{callerArn: "arn:aws:sts::123456789012:assumed-role/AWSReservedSSO_Admin_0123/alice", want: client.roleArn},
+		{callerArn: "arn:aws:iam::123456789012:root", wantErr: true},
+		{callerArn: "invalid", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := principalArnForSimulation(context.Background(), client, tt.callerArn)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("principalArnForSimulation(%q) error = %v, wantErr %v", tt.callerArn, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("principalArnForSimulation(%q) = %q, want %q", tt.callerArn, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPermissions(t *testing.T) {
+	client := &fakeIAM{allowed: map[string]bool{
+		"ec2:DescribeInstances": true,
+		"ssm:StartSession":      true,
+	}}
+
+	checks := checkPermissions(context.Background(), client, "arn:aws:iam::123456789012:user/alice", DoctorTarget{Mode: ModeSSH, KeyPush: KeyPushAuto})
+	got := checkStatuses(checks)
+
+	want := map[string]string{
+		"iam ec2:DescribeInstances":                 DoctorStatusPass,
+		"iam ssm:StartSession":                      DoctorStatusPass,
+		"iam ec2-instance-connect:SendSSHPublicKey": DoctorStatusFail,
+		"iam ec2:CreateImage":                       DoctorStatusWarn,
+	}
+	for name, status := range want {
+		if got[name] != status {
+			t.Errorf("%s = %s, want %s", name, got[name], status)
+		}
+	}
+	if len(checks) != len(DoctorActions) {
+		t.Errorf("checkPermissions() = %d checks, want %d", len(checks), len(DoctorActions))
+	}
+	if checks.failed() != 1 {
+		t.Errorf("failed() = %d, want 1", checks.failed())
+	}
+
+	root := checkPermissions(context.Background(), client, "arn:aws:iam::123456789012:root", DoctorTarget{})
+	if len(root) != 1 || root[0].Status != DoctorStatusSkip {
+		t.Errorf("checkPermissions() of root = %+v, want skip", root)
+	}
+}
+
+func TestCheckPermissionsTarget(t *testing.T) {
+	const (
+		callerArn   = "arn:aws:iam::123456789012:user/alice"
+		instanceArn = "arn:aws:ec2:ap-northeast-1:123456789012:instance/i-0123"
+	)
+
+	tests := []struct {
+		name    string
+		target  DoctorTarget
+		allowed map[string]bool
+		want    map[string]string
+	}{
+		{
+			name:   "ssh with instance connect",
+			target: DoctorTarget{Mode: ModeSSH, KeyPush: KeyPushInstanceConnect},
+			allowed: map[string]bool{
+				"ssm:StartSession " + instanceArn: true,
+				"ssm:StartSession arn:aws:ssm:ap-northeast-1::document/AWS-StartPortForwardingSession": true,
+				"ec2-instance-connect:SendSSHPublicKey " + instanceArn:                                 true,
+			},
+			want: map[string]string{
+				"iam ssm:StartSession":                      DoctorStatusPass,
+				"iam ec2-instance-connect:SendSSHPublicKey": DoctorStatusPass,
+				"iam ssm:SendCommand":                       DoctorStatusWarn,
+			},
+		},
+		{
+			name:   "start session denied on the document",
+			target: DoctorTarget{Mode: ModeSSH, KeyPush: KeyPushInstanceConnect},
+			allowed: map[string]bool{
+				"ssm:StartSession " + instanceArn: true,
+			},
+			want: map[string]string{
+				"iam ssm:StartSession":                      DoctorStatusFail,
+				"iam ec2-instance-connect:SendSSHPublicKey": DoctorStatusFail,
+			},
+		},
+		{
+			name:   "ssh with ssm key push",
+			target: DoctorTarget{Mode: ModeSSH, KeyPush: KeyPushSSM},
+			allowed: map[string]bool{
+				"ssm:SendCommand " + instanceArn:                                          true,
+				"ssm:SendCommand arn:aws:ssm:ap-northeast-1::document/AWS-RunShellScript": true,
+			},
+			want: map[string]string{
+				"iam ec2-instance-connect:SendSSHPublicKey": DoctorStatusWarn,
+				"iam ssm:SendCommand":                       DoctorStatusPass,
+				"iam ssm:GetCommandInvocation":              DoctorStatusFail,
+			},
+		},
+		{
+			name:   "eice",
+			target: DoctorTarget{Mode: ModeSSH, Transport: TransportEICE, KeyPush: KeyPushInstanceConnect},
+			allowed: map[string]bool{
+				"ec2:DescribeInstanceConnectEndpoints":                 true,
+				"ec2-instance-connect:SendSSHPublicKey " + instanceArn: true,
+			},
+			want: map[string]string{
+				"iam ssm:StartSession":                      DoctorStatusWarn,
+				"iam ec2:DescribeInstanceConnectEndpoints":  DoctorStatusPass,
+				"iam ec2-instance-connect:OpenTunnel":       DoctorStatusFail,
+				"iam ec2-instance-connect:SendSSHPublicKey": DoctorStatusPass,
+			},
+		},
+		{
+			name:   "auto transport",
+			target: DoctorTarget{Mode: ModeSSH, Transport: TransportAuto, KeyPush: KeyPushInstanceConnect},
+			want: map[string]string{
+				"iam ssm:StartSession":                DoctorStatusFail,
+				"iam ec2-instance-connect:OpenTunnel": DoctorStatusWarn,
+				"iam sts:GetCallerIdentity":           DoctorStatusWarn,
+			},
+		},
+		{
+			name:   "ssm shell ignores eice",
+			target: DoctorTarget{Mode: ModeSSMShell, Transport: TransportEICE},
+			want: map[string]string{
+				"iam ssm:StartSession":                DoctorStatusFail,
+				"iam ec2-instance-connect:OpenTunnel": DoctorStatusWarn,
+			},
+		},
+		{
+			name:   "ssm shell with the document",
+			target: DoctorTarget{Mode: ModeSSMShell, KeyPush: KeyPushInstanceConnect, Document: "MyShell"},
+			allowed: map[string]bool{
+				"ssm:StartSession " + instanceArn:                                           true,
+				"ssm:StartSession arn:aws:ssm:ap-northeast-1:123456789012:document/MyShell": true,
+			},
+			want: map[string]string{
+				"iam ssm:StartSession":                      DoctorStatusPass,
+				"iam ec2-instance-connect:SendSSHPublicKey": DoctorStatusWarn,
+				"iam ssm:SendCommand":                       DoctorStatusWarn,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeIAM{allowed: tt.allowed}
+			tt.target.Region = "ap-northeast-1"
+			tt.target.InstanceID = "i-0123"
+
+			got := checkStatuses(checkPermissions(context.Background(), client, callerArn, tt.target))
+			for name, status := range tt.want {
+				if got[name] != status {
+					t.Errorf("%s = %s, want %s", name, got[name], status)
+				}
+			}
+
+			for _, input := range client.simulated {
+				if len(input.ContextEntries) != 1 || input.ContextEntries[0].ContextKeyValues[0] != "ap-northeast-1" {
+					t.Errorf("ContextEntries = %+v, want aws:RequestedRegion", input.ContextEntries)
+				}
+			}
+		})
+	}
+}
+
+func TestDoctorTargetResourceArns(t *testing.T) {
+	target := DoctorTarget{Partition: "aws", Region: "us-east-1", Account: "123456789012", Mode: ModeSSMShell}
+	startSession := DoctorActions[1]
+
+	want := []string{"arn:aws:ec2:us-east-1:123456789012:instance/*", "arn:aws:ssm:us-east-1:123456789012:document/SSM-SessionManagerRunShell"}
+	if got := target.resourceArns(startSession); !reflect.DeepEqual(got, want) {
+		t.Errorf("resourceArns() = %v, want %v", got, want)
+	}
+
+	target.Document = "arn:aws:ssm:us-east-1:111122223333:document/Shared"
+	if got := target.resourceArns(startSession); got[1] != target.Document {
+		t.Errorf("resourceArns() = %v, want the document ARN as is", got)
+	}
+}
+
+func TestCheckAgent(t *testing.T) {
+	tests := []struct {
+		name        string
+		information []ssmtypes.InstanceInformation
+		want        string
+	}{
+		{
+			name:        "online",
+			information: []ssmtypes.InstanceInformation{{PingStatus: ssmtypes.PingStatusOnline, AgentVersion: aws.String("3.0.0")}},
+			want:        DoctorStatusPass,
+		},
+		{
+			name:        "connection lost",
+			information: []ssmtypes.InstanceInformation{{PingStatus: ssmtypes.PingStatusConnectionLost}},
+			want:        DoctorStatusFail,
+		},
+		{
+			name: "not managed",
+			want: DoctorStatusFail,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check := checkAgent(context.Background(), &fakeAgents{information: tt.information}, "i-0123")
+			if check.Status != tt.want {
+				t.Errorf("checkAgent() = %+v, want %s", check, tt.want)
+			}
+			if tt.want == DoctorStatusFail && check.Fix == "" {
+				t.Error("checkAgent() has no fix")
+			}
+		})
+	}
+}
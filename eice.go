@@ -0,0 +1,241 @@
+package awssh
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/gorilla/websocket"
+)
+
+// Transports to forward the ssh port of the instance. auto uses Session Manager, and EC2 Instance Connect
+// Endpoint if Session Manager is not available.
+const (
+	TransportAuto string = "auto"
+	TransportSSM  string = "ssm"
+	TransportEICE string = "eice"
+
+	// The service name to sign OpenTunnel requests, and how long the signed URL is valid.
+	EiceSigningName    string        = "ec2-instance-connect"
+	EicePresignExpires time.Duration = 60 * time.Second
+)
+
+type (
+	// InstanceConnectEndpoint is an EC2 Instance Connect Endpoint to open tunnels to the instances of its VPC.
+	InstanceConnectEndpoint struct {
+		ID       string
+		DNSName  string
+		VpcID    string
+		SubnetID string
+	}
+
+	// EiceTunnelOpener opens tunnels by the OpenTunnel WebSocket API of EC2 Instance Connect Endpoint,
+	// signed with the credentials of the config.
+	EiceTunnelOpener struct {
+		credentials aws.CredentialsProvider
+		region      string
+		scheme      string
+		dialer      *websocket.Dialer
+	}
+
+	// EiceSession forwards the local port to the instance through EC2 Instance Connect Endpoint. Each connection
+	// to the local port opens a new tunnel, so there is no session to reconnect.
+	EiceSession struct {
+		PortForward
+		proxy  *LocalProxy
+		cancel context.CancelFunc
+	}
+
+	// websocketConn is a net.Conn over the binary messages of a WebSocket connection.
+	websocketConn struct {
+		*websocket.Conn
+		reader io.Reader
+	}
+)
+
+func NewEiceTunnelOpener(cfg aws.Config) (o *EiceTunnelOpener) {
+	o = &EiceTunnelOpener{
+		credentials: cfg.Credentials,
+		region:      cfg.Region,
+		scheme:      "wss",
+		dialer:      websocket.DefaultDialer,
+	}
+	return o
+}
+
+// Find the available endpoint in the VPC of the instance. The endpoint in the subnet of the instance is preferred.
+func findInstanceConnectEndpoint(ctx context.Context, client InstanceConnectEndpointFinder, instance *Instance) (endpoint InstanceConnectEndpoint, err error) {
+	input := &ec2.DescribeInstanceConnectEndpointsInput{
+		Filters: []types.Filter{
+			{Name: aws.String("vpc-id"), Values: []string{instance.VpcID}},
+			{Name: aws.String("state"), Values: []string{string(types.Ec2InstanceConnectEndpointStateCreateComplete)}},
+		},
+	}
+
+	var endpoints []InstanceConnectEndpoint
+	paginator := ec2.NewDescribeInstanceConnectEndpointsPaginator(client, input)
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return endpoint, wrapAwsError(err, "ec2:DescribeInstanceConnectEndpoints")
+		}
+		for _, e := range output.InstanceConnectEndpoints {
+			endpoints = append(endpoints, InstanceConnectEndpoint{
+				ID:       aws.ToString(e.InstanceConnectEndpointId),
+				DNSName:  aws.ToString(e.DnsName),
+				VpcID:    aws.ToString(e.VpcId),
+				SubnetID: aws.ToString(e.SubnetId),
+			})
+		}
+	}
+
+	if len(endpoints) == 0 {
+		return endpoint, &InstanceConnectEndpointNotFoundError{InstanceID: instance.ID, VpcID: instance.VpcID}
+	}
+	for _, e := range endpoints {
+		if e.SubnetID == instance.SubnetID {
+			return e, nil
+		}
+	}
+	return endpoints[0], nil
+}
+
+// Sign the URL of OpenTunnel to the port of the private IP address through the endpoint.
+func (o *EiceTunnelOpener) presignOpenTunnelURL(ctx context.Context, endpoint InstanceConnectEndpoint, privateIPAddress, remotePort string, now time.Time) (signedURL string, err error) {
+	query := url.Values{}
+	query.Set("instanceConnectEndpointId", endpoint.ID)
+	query.Set("remotePort", remotePort)
+	query.Set("privateIpAddress", privateIPAddress)
+	query.Set("X-Amz-Expires", strconv.Itoa(int(EicePresignExpires/time.Second)))
+	u := url.URL{
+		Scheme:   o.scheme,
+		Host:     endpoint.DNSName,
+		Path:     "/openTunnel",
+		RawQuery: query.Encode(),
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	credentials, err := o.credentials.Retrieve(ctx)
+	if err != nil {
+		return "", err
+	}
+	emptyPayloadHash := sha256.Sum256(nil)
+	signedURL, _, err = v4.NewSigner().PresignHTTP(ctx, credentials, req, hex.EncodeToString(emptyPayloadHash[:]), EiceSigningName, o.region, now)
+	return signedURL, err
+}
+
+// OpenTunnel opens a tunnel to the port of the private IP address through the endpoint.
+func (o *EiceTunnelOpener) OpenTunnel(ctx context.Context, endpoint InstanceConnectEndpoint, privateIPAddress, remotePort string) (conn net.Conn, err error) {
+	signedURL, err := o.presignOpenTunnelURL(ctx, endpoint, privateIPAddress, remotePort, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	ws, resp, err := o.dialer.DialContext(ctx, signedURL, nil)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusForbidden {
+			return nil, &AccessDeniedError{Action: "ec2-instance-connect:OpenTunnel", Err: err}
+		}
+		return nil, fmt.Errorf("failed to open the tunnel through %s: %w", endpoint.ID, err)
+	}
+	return &websocketConn{Conn: ws}, nil
+}
+
+func (c *websocketConn) Read(p []byte) (n int, err error) {
+	for {
+		if c.reader == nil {
+			_, c.reader, err = c.NextReader()
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				return 0, io.EOF
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		n, err = c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *websocketConn) Write(p []byte) (n int, err error) {
+	if err = c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *websocketConn) SetDeadline(t time.Time) (err error) {
+	if err = c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	err = c.SetWriteDeadline(t)
+	return err
+}
+
+// Listen on the local address of the forward, and open a tunnel to the instance through the endpoint of its VPC
+// for each connection. Failures to open tunnels are shown, since ssh only sees the connection closed.
+func startEiceSession(ctx context.Context, clients *Clients, instance *Instance, forward PortForward) (session *EiceSession, err error) {
+	if instance.PrivateIPAddress == "" {
+		return nil, errors.New("instance has no private IP address to connect through EC2 Instance Connect Endpoint: " + instance.ID)
+	}
+	endpoint, err := findInstanceConnectEndpoint(ctx, clients.Endpoints, instance)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := listenLocal(&forward)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	dial := func() (net.Conn, error) {
+		conn, err := clients.EndpointTunnels.OpenTunnel(ctx, endpoint, instance.PrivateIPAddress, forward.RemotePort)
+		if err != nil && ctx.Err() == nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+		return conn, err
+	}
+	session = &EiceSession{
+		PortForward: forward,
+		proxy:       NewLocalProxyWithDialer(listener, dial),
+		cancel:      cancel,
+	}
+	go session.proxy.Serve()
+	return session, nil
+}
+
+func (s *EiceSession) Forward() PortForward {
+	return s.PortForward
+}
+
+// Stop listening on the local port. Connections already accepted are kept until they are closed.
+func (s *EiceSession) Stop() {
+	s.proxy.Close()
+	s.cancel()
+}
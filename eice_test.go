@@ -0,0 +1,236 @@
+package awssh
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/gorilla/websocket"
+)
+
+type (
+	fakeEndpointFinder struct {
+		endpoints []types.Ec2InstanceConnectEndpoint
+		input     *ec2.DescribeInstanceConnectEndpointsInput
+	}
+
+	// fakeEndpointTunnels opens tunnels which echo the data back.
+	fakeEndpointTunnels struct {
+		mu     sync.Mutex
+		opened []string
+	}
+)
+
+func (f *fakeEndpointFinder) DescribeInstanceConnectEndpoints(ctx context.Context, params *ec2.DescribeInstanceConnectEndpointsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstanceConnectEndpointsOutput, error) {
+	f.input = params
+	return &ec2.DescribeInstanceConnectEndpointsOutput{InstanceConnectEndpoints: f.endpoints}, nil
+}
+
+func (f *fakeEndpointTunnels) OpenTunnel(ctx context.Context, endpoint InstanceConnectEndpoint, privateIPAddress, remotePort string) (net.Conn, error) {
+	f.mu.Lock()
+	f.opened = append(f.opened, endpoint.ID+" "+net.JoinHostPort(privateIPAddress, remotePort))
+	f.mu.Unlock()
+
+	conn, remote := net.Pipe()
+	go func() {
+		defer remote.Close()
+		io.Copy(remote, remote)
+	}()
+	return conn, nil
+}
+
+func (f *fakeEndpointTunnels) openedTunnels() (opened []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.opened...)
+}
+
+func testEndpoint(id, subnetID string) types.Ec2InstanceConnectEndpoint {
+	return types.Ec2InstanceConnectEndpoint{
+		InstanceConnectEndpointId: aws.String(id),
+		DnsName:                   aws.String(id + ".ec2-instance-connect-endpoint.ap-northeast-1.amazonaws.com"),
+		VpcId:                     aws.String("vpc-0123"),
+		SubnetId:                  aws.String(subnetID),
+	}
+}
+
+func TestFindInstanceConnectEndpoint(t *testing.T) {
+	instance := &Instance{ID: "i-0123", VpcID: "vpc-0123", SubnetID: "subnet-b"}
+
+	tests := []struct {
+		name      string
+		endpoints []types.Ec2InstanceConnectEndpoint
+		want      string
+	}{
+		{"subnet of the instance", []types.Ec2InstanceConnectEndpoint{testEndpoint("eice-a", "subnet-a"), testEndpoint("eice-b", "subnet-b")}, "eice-b"},
+		{"other subnet", []types.Ec2InstanceConnectEndpoint{testEndpoint("eice-a", "subnet-a"), testEndpoint("eice-c", "subnet-c")}, "eice-a"},
+	}
+	for _, tt := range tests {
+		client := &fakeEndpointFinder{endpoints: tt.endpoints}
+		endpoint, err := findInstanceConnectEndpoint(context.Background(), client, instance)
+		if err != nil || endpoint.ID != tt.want || endpoint.DNSName != tt.want+".ec2-instance-connect-endpoint.ap-northeast-1.amazonaws.com" {
+			t.Errorf("%s: findInstanceConnectEndpoint() = %+v, %v, want %s", tt.name, endpoint, err, tt.want)
+		}
+		filters := map[string]string{}
+		for _, filter := range client.input.Filters {
+			filters[aws.ToString(filter.Name)] = strings.Join(filter.Values, ",")
+		}
+		if filters["vpc-id"] != "vpc-0123" || filters["state"] != "create-complete" {
+			t.Errorf("%s: filters = %v", tt.name, filters)
+		}
+	}
+
+	_, err := findInstanceConnectEndpoint(context.Background(), &fakeEndpointFinder{}, instance)
+	var notFound *InstanceConnectEndpointNotFoundError
+	if !errors.As(err, &notFound) || notFound.VpcID != "vpc-0123" || ExitCode(err) != ExitCodeEndpointNotFound {
+		t.Errorf("findInstanceConnectEndpoint() without endpoints error = %v, want InstanceConnectEndpointNotFoundError", err)
+	}
+}
+
+func TestPresignOpenTunnelURL(t *testing.T) {
+	opener := NewEiceTunnelOpener(aws.Config{
+		Region:      "ap-northeast-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKIAEXAMPLE", "secret", "token"),
+	})
+	endpoint := InstanceConnectEndpoint{ID: "eice-0123", DNSName: "eice-0123.ec2-instance-connect-endpoint.ap-northeast-1.amazonaws.com"}
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	signedURL, err := opener.presignOpenTunnelURL(context.Background(), endpoint, "10.0.0.1", "22", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(signedURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "wss" || u.Host != endpoint.DNSName || u.Path != "/openTunnel" {
+		t.Errorf("url = %s", signedURL)
+	}
+
+	query := u.Query()
+	want := map[string]string{
+		"instanceConnectEndpointId": "eice-0123",
+		"remotePort":                "22",
+		"privateIpAddress":          "10.0.0.1",
+		"X-Amz-Expires":             "60",
+		"X-Amz-Date":                "20240102T030405Z",
+		"X-Amz-Credential":          "AKIAEXAMPLE/20240102/ap-northeast-1/ec2-instance-connect/aws4_request",
+		"X-Amz-Security-Token":      "token",
+	}
+	for key, value := range want {
+		if query.Get(key) != value {
+			t.Errorf("%s = %q, want %q", key, query.Get(key), value)
+		}
+	}
+	if query.Get("X-Amz-Signature") == "" {
+		t.Error("url is not signed")
+	}
+}
+
+func TestEiceTunnelOpener(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path != "/openTunnel" || query.Get("instanceConnectEndpointId") != "eice-0123" || query.Get("X-Amz-Signature") == "" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			messageType, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			ws.WriteMessage(messageType, data)
+		}
+	}))
+	defer ts.Close()
+
+	opener := NewEiceTunnelOpener(aws.Config{
+		Region:      "ap-northeast-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKIAEXAMPLE", "secret", ""),
+	})
+	opener.scheme = "ws"
+	host := strings.TrimPrefix(ts.URL, "http://")
+
+	conn, err := opener.OpenTunnel(context.Background(), InstanceConnectEndpoint{ID: "eice-0123", DNSName: host}, "10.0.0.1", "22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Messages are read as a stream.
+	conn.Write([]byte("hel"))
+	conn.Write([]byte("lo"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("read %q, %v", buf, err)
+	}
+
+	_, err = opener.OpenTunnel(context.Background(), InstanceConnectEndpoint{ID: "eice-other", DNSName: host}, "10.0.0.1", "22")
+	var denied *AccessDeniedError
+	if !errors.As(err, &denied) || denied.Action != "ec2-instance-connect:OpenTunnel" {
+		t.Errorf("OpenTunnel() of the forbidden endpoint error = %v, want AccessDeniedError", err)
+	}
+}
+
+func TestStartEiceSession(t *testing.T) {
+	tunnels := &fakeEndpointTunnels{}
+	clients := &Clients{
+		Endpoints:       &fakeEndpointFinder{endpoints: []types.Ec2InstanceConnectEndpoint{testEndpoint("eice-a", "subnet-a")}},
+		EndpointTunnels: tunnels,
+	}
+	instance := &Instance{ID: "i-0123", VpcID: "vpc-0123", SubnetID: "subnet-a", PrivateIPAddress: "10.0.0.1"}
+
+	session, err := startEiceSession(context.Background(), clients, instance, PortForward{RemotePort: "22"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := session.Forward().Local()
+
+	// Each connection opens a tunnel.
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+			t.Errorf("read %q, %v", buf, err)
+		}
+		conn.Close()
+	}
+	if opened := tunnels.openedTunnels(); len(opened) != 2 || opened[0] != "eice-a 10.0.0.1:22" {
+		t.Errorf("opened tunnels = %v", opened)
+	}
+
+	session.Stop()
+	if conn, err := net.Dial("tcp", address); err == nil {
+		conn.Close()
+		t.Error("local port is listened after Stop()")
+	}
+
+	instance.PrivateIPAddress = ""
+	if _, err := startEiceSession(context.Background(), clients, instance, PortForward{RemotePort: "22"}); err == nil {
+		t.Error("startEiceSession() of the instance without a private IP address succeeded")
+	}
+}
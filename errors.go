@@ -0,0 +1,302 @@
+package awssh
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/aws/smithy-go"
+	"golang.org/x/crypto/ssh"
+)
+
+// Exit codes of awssh failures. Scripts can branch on the kind of failure. They are reserved in
+// ExitCodeReservedMin-ExitCodeReservedMax, so that other codes are the exit status of ssh or the remote command.
+const (
+	ExitCodeReservedMin int = 200
+	ExitCodeReservedMax int = 250
+
+	ExitCodeError                      int = 250
+	ExitCodePluginNotFound             int = 200
+	ExitCodeInstanceNotFound           int = 201
+	ExitCodeTargetNotConnected         int = 202
+	ExitCodeInstanceConnectUnavailable int = 203
+	ExitCodeAccessDenied               int = 204
+	ExitCodeMFAFailed                  int = 205
+	ExitCodeKeyFile                    int = 206
+	ExitCodeKeyPushFailed              int = 207
+	ExitCodeLocalPortUnavailable       int = 208
+	ExitCodeEndpointNotFound           int = 209
+)
+
+var (
+	notAuthorizedActionRe = regexp.MustCompile(`not authorized to perform:? ([a-zA-Z0-9-]+:[a-zA-Z0-9]+)`)
+)
+
+type (
+	// Error is implemented by the errors awssh knows how to remediate.
+	Error interface {
+		error
+		ExitCode() int
+		Hint() string
+	}
+
+	// PluginNotFoundError is returned when session-manager-plugin is not installed.
+	PluginNotFoundError struct {
+		Err error
+	}
+
+	// InstanceNotFoundError is returned when the instance-id does not exist in the region.
+	InstanceNotFoundError struct {
+		InstanceID string
+	}
+
+	// TargetNotConnectedError is returned when the SSM agent of the instance is not online.
+	TargetNotConnectedError struct {
+		InstanceID string
+		Err        error
+	}
+
+	// InstanceConnectUnavailableError is returned when EC2 Instance Connect cannot push a key to the instance.
+	InstanceConnectUnavailableError struct {
+		InstanceID string
+		Err        error
+	}
+
+	// AccessDeniedError is returned when the IAM principal is not allowed to call Action.
+	AccessDeniedError struct {
+		Action string
+		Err    error
+	}
+
+	// MFAError is returned when assuming a role with the MFA token code failed.
+	MFAError struct {
+		Err error
+	}
+
+	// KeyFileError is returned when the identity file or the public key is missing or malformed.
+	KeyFileError struct {
+		Path string
+		Err  error
+	}
+
+	// LocalPortUnavailableError is returned when the local port to forward is in use.
+	LocalPortUnavailableError struct {
+		Port string
+		Err  error
+	}
+
+	// InstanceConnectEndpointNotFoundError is returned when there is no EC2 Instance Connect Endpoint in the VPC of the instance.
+	InstanceConnectEndpointNotFoundError struct {
+		InstanceID string
+		VpcID      string
+	}
+
+	// CommandExitError is the exit status of ssh or the remote command. awssh exits with the same code
+	// without printing the error, because ssh has shown it already.
+	CommandExitError struct {
+		Code int
+		Err  error
+	}
+
+	// SSMCommandError is returned when the command sent by SSM to push the key failed on the instance.
+	SSMCommandError struct {
+		InstanceID string
+		CommandID  string
+		Status     string
+		ExitStatus int32
+		Stderr     string
+	}
+)
+
+func (e *PluginNotFoundError) Error() string {
+	return "session-manager-plugin is not found: " + e.Err.Error()
+}
+
+func (e *PluginNotFoundError) Unwrap() error { return e.Err }
+
+func (e *PluginNotFoundError) ExitCode() int { return ExitCodePluginNotFound }
+
+func (e *PluginNotFoundError) Hint() string {
+	return "Install the Session Manager plugin and make sure it is in PATH. See https://docs.aws.amazon.com/systems-manager/latest/userguide/session-manager-working-with-install-plugin.html"
+}
+
+func (e *InstanceNotFoundError) Error() string {
+	return "instance not found: " + e.InstanceID
+}
+
+func (e *InstanceNotFoundError) ExitCode() int { return ExitCodeInstanceNotFound }
+
+func (e *InstanceNotFoundError) Hint() string {
+	return "Check the instance-id, and that --profile and the region point to the account the instance belongs to."
+}
+
+func (e *TargetNotConnectedError) Error() string {
+	return "instance is not connected to Session Manager: " + e.InstanceID + ": " + e.Err.Error()
+}
+
+func (e *TargetNotConnectedError) Unwrap() error { return e.Err }
+
+func (e *TargetNotConnectedError) ExitCode() int { return ExitCodeTargetNotConnected }
+
+func (e *TargetNotConnectedError) Hint() string {
+	return "Make sure the SSM agent is running on the instance, the instance profile has AmazonSSMManagedInstanceCore, and the instance can reach the SSM endpoints."
+}
+
+func (e *InstanceConnectUnavailableError) Error() string {
+	return "EC2 Instance Connect is not available on the instance: " + e.InstanceID + ": " + e.Err.Error()
+}
+
+func (e *InstanceConnectUnavailableError) Unwrap() error { return e.Err }
+
+func (e *InstanceConnectUnavailableError) ExitCode() int { return ExitCodeInstanceConnectUnavailable }
+
+func (e *InstanceConnectUnavailableError) Hint() string {
+	return "Install the ec2-instance-connect package on the instance, and make sure the instance is running a supported OS."
+}
+
+func (e *AccessDeniedError) Error() string {
+	return "access denied to " + e.Action + ": " + e.Err.Error()
+}
+
+func (e *AccessDeniedError) Unwrap() error { return e.Err }
+
+func (e *AccessDeniedError) ExitCode() int { return ExitCodeAccessDenied }
+
+func (e *AccessDeniedError) Hint() string {
+	return "Allow " + e.Action + " in the IAM policy of the profile. See the IAM Policy section of the README."
+}
+
+func (e *MFAError) Error() string {
+	return "MFA authentication failed: " + e.Err.Error()
+}
+
+func (e *MFAError) Unwrap() error { return e.Err }
+
+func (e *MFAError) ExitCode() int { return ExitCodeMFAFailed }
+
+func (e *MFAError) Hint() string {
+	return "Enter a current token code of the MFA device configured as mfa_serial of the profile."
+}
+
+func (e *KeyFileError) Error() string {
+	return "invalid key file: " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *KeyFileError) Unwrap() error { return e.Err }
+
+func (e *KeyFileError) ExitCode() int { return ExitCodeKeyFile }
+
+func (e *KeyFileError) Hint() string {
+	return "Specify an existing key pair with --identity-file and --publickey, or create one with ssh-keygen."
+}
+
+func (e *SSMCommandError) Error() string {
+	message := fmt.Sprintf("failed to push the key by SSM: %s: command %s %s (exit status %d)", e.InstanceID, e.CommandID, e.Status, e.ExitStatus)
+	if e.Stderr != "" {
+		message += ": " + e.Stderr
+	}
+	return message
+}
+
+func (e *SSMCommandError) ExitCode() int { return ExitCodeKeyPushFailed }
+
+func (e *SSMCommandError) Hint() string {
+	return "Check the command output with `aws ssm get-command-invocation --command-id " + e.CommandID + " --instance-id " + e.InstanceID + "`, and that --username exists on the instance."
+}
+
+func (e *LocalPortUnavailableError) Error() string {
+	return "local port is not available: " + e.Port + ": " + e.Err.Error()
+}
+
+func (e *LocalPortUnavailableError) Unwrap() error { return e.Err }
+
+func (e *LocalPortUnavailableError) ExitCode() int { return ExitCodeLocalPortUnavailable }
+
+func (e *LocalPortUnavailableError) Hint() string {
+	return "Stop the process using the port, or specify another port with --local-port or local-port-range."
+}
+
+func (e *InstanceConnectEndpointNotFoundError) Error() string {
+	return "EC2 Instance Connect Endpoint not found in the VPC of the instance: " + e.InstanceID + " (" + e.VpcID + ")"
+}
+
+func (e *InstanceConnectEndpointNotFoundError) ExitCode() int { return ExitCodeEndpointNotFound }
+
+func (e *InstanceConnectEndpointNotFoundError) Hint() string {
+	return "Create an EC2 Instance Connect Endpoint in " + e.VpcID + " and allow the ssh port from its security group, or connect through Session Manager with --transport=ssm."
+}
+
+func (e *CommandExitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CommandExitError) Unwrap() error { return e.Err }
+
+func (e *CommandExitError) ExitCode() int { return e.Code }
+
+func (e *CommandExitError) Hint() string { return "" }
+
+// Convert the error of waiting for ssh or the native ssh session into CommandExitError with its exit
+// status. A process killed by a signal exits with 128 + the signal number like shells. Other errors are returned as is.
+func commandExitError(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code := exitErr.ExitCode()
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			code = 128 + int(status.Signal())
+		}
+		return &CommandExitError{Code: code, Err: err}
+	}
+
+	var sshExitErr *ssh.ExitError
+	if errors.As(err, &sshExitErr) {
+		return &CommandExitError{Code: sshExitErr.ExitStatus(), Err: err}
+	}
+	return err
+}
+
+// ExitCode returns the exit code for err. Errors without a specific code exit with ExitCodeError.
+func ExitCode(err error) (code int) {
+	var e Error
+	if errors.As(err, &e) {
+		return e.ExitCode()
+	}
+	return ExitCodeError
+}
+
+// ErrorHint returns how to fix err, or an empty string.
+func ErrorHint(err error) (hint string) {
+	var e Error
+	if errors.As(err, &e) {
+		return e.Hint()
+	}
+	return ""
+}
+
+// Convert an AWS API error of the IAM action into the typed errors. Other errors are returned as is.
+func wrapAwsError(err error, action string) error {
+	if err == nil {
+		return nil
+	}
+
+	message := err.Error()
+	if strings.Contains(message, "MultiFactorAuthentication") {
+		return &MFAError{Err: err}
+	}
+
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	switch apiErr.ErrorCode() {
+	case "AccessDenied", "AccessDeniedException", "UnauthorizedOperation", "UnauthorizedException":
+		if m := notAuthorizedActionRe.FindStringSubmatch(apiErr.ErrorMessage()); m != nil {
+			action = m[1]
+		}
+		return &AccessDeniedError{Action: action, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,163 @@
+package awssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/smithy-go"
+)
+
+type fakeFailingSSM struct {
+	err error
+}
+
+func (f *fakeFailingSSM) StartSession(ctx context.Context, params *ssm.StartSessionInput, optFns ...func(*ssm.Options)) (*ssm.StartSessionOutput, error) {
+	return nil, f.err
+}
+
+func (f *fakeFailingSSM) TerminateSession(ctx context.Context, params *ssm.TerminateSessionInput, optFns ...func(*ssm.Options)) (*ssm.TerminateSessionOutput, error) {
+	return nil, f.err
+}
+
+func TestWrapAwsError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantCode   int
+		wantAction string
+	}{
+		{
+			name:     "nil",
+			err:      nil,
+			wantCode: 0,
+		},
+		{
+			name:     "not an api error",
+			err:      errors.New("connection refused"),
+			wantCode: ExitCodeError,
+		},
+		{
+			name:     "other api error",
+			err:      &smithy.GenericAPIError{Code: "Throttling", Message: "rate exceeded"},
+			wantCode: ExitCodeError,
+		},
+		{
+			name:       "access denied",
+			err:        &smithy.GenericAPIError{Code: "AccessDeniedException", Message: "User: arn:aws:iam::123456789012:user/alice is not authorized to perform: ssm:StartSession on resource: i-0123"},
+			wantCode:   ExitCodeAccessDenied,
+			wantAction: "ssm:StartSession",
+		},
+		{
+			name:       "unauthorized operation without action in message",
+			err:        &smithy.GenericAPIError{Code: "UnauthorizedOperation", Message: "You are not authorized to perform this operation."},
+			wantCode:   ExitCodeAccessDenied,
+			wantAction: "ec2:DescribeInstances",
+		},
+		{
+			name:     "mfa",
+			err:      fmt.Errorf("assume role: %w", &smithy.GenericAPIError{Code: "AccessDenied", Message: "MultiFactorAuthentication failed with invalid MFA one time pass code."}),
+			wantCode: ExitCodeMFAFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := wrapAwsError(tt.err, "ec2:DescribeInstances")
+			if tt.err == nil {
+				if err != nil {
+					t.Errorf("wrapAwsError() = %v, want nil", err)
+				}
+				return
+			}
+
+			if got := ExitCode(err); got != tt.wantCode {
+				t.Errorf("ExitCode() = %d, want %d", got, tt.wantCode)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("wrapAwsError() does not wrap the original error")
+			}
+
+			var denied *AccessDeniedError
+			if errors.As(err, &denied) && denied.Action != tt.wantAction {
+				t.Errorf("Action = %q, want %q", denied.Action, tt.wantAction)
+			}
+		})
+	}
+}
+
+func TestErrorHint(t *testing.T) {
+	errs := []Error{
+		&PluginNotFoundError{Err: errors.New("exec: not found")},
+		&InstanceNotFoundError{InstanceID: "i-0123"},
+		&TargetNotConnectedError{InstanceID: "i-0123", Err: errors.New("offline")},
+		&InstanceConnectUnavailableError{InstanceID: "i-0123", Err: errors.New("unavailable")},
+		&AccessDeniedError{Action: "ssm:StartSession", Err: errors.New("denied")},
+		&MFAError{Err: errors.New("invalid code")},
+		&KeyFileError{Path: "~/.ssh/id_rsa", Err: errors.New("no such file")},
+		&InstanceConnectEndpointNotFoundError{InstanceID: "i-0123", VpcID: "vpc-0123"},
+	}
+
+	codes := map[int]bool{}
+	for _, err := range errs {
+		if ErrorHint(fmt.Errorf("wrapped: %w", err)) == "" {
+			t.Errorf("%T has no hint", err)
+		}
+		code := ExitCode(err)
+		if code == ExitCodeError || codes[code] {
+			t.Errorf("%T exit code %d is not distinct", err, code)
+		}
+		if code < ExitCodeReservedMin || code > ExitCodeReservedMax {
+			t.Errorf("%T exit code %d is out of the reserved range", err, code)
+		}
+		codes[code] = true
+	}
+
+	if ErrorHint(errors.New("plain")) != "" {
+		t.Error("ErrorHint() of a plain error is not empty")
+	}
+}
+
+func TestGetSsmSessionTokenTargetNotConnected(t *testing.T) {
+	client := &fakeFailingSSM{err: &smithy.GenericAPIError{Code: "TargetNotConnected", Message: "i-0123 is not connected."}}
+
+	_, _, _, err := getSsmSessionToken(context.Background(), client, "i-0123", "", "22", "10022")
+	var notConnected *TargetNotConnectedError
+	if !errors.As(err, &notConnected) || notConnected.InstanceID != "i-0123" {
+		t.Errorf("getSsmSessionToken() error = %v, want TargetNotConnectedError", err)
+	}
+}
+
+func TestCommandExitError(t *testing.T) {
+	tests := []struct {
+		script string
+		want   int
+	}{
+		{"exit 3", 3},
+		{"exit 1", 1},
+		{"kill -TERM $$", 128 + int(syscall.SIGTERM)},
+	}
+
+	for _, tt := range tests {
+		err := commandExitError(exec.Command("sh", "-c", tt.script).Run())
+		var exitErr *CommandExitError
+		if !errors.As(err, &exitErr) || ExitCode(err) != tt.want {
+			t.Errorf("commandExitError() of %q = %v (exit code %d), want %d", tt.script, err, ExitCode(err), tt.want)
+		}
+		if ErrorHint(err) != "" {
+			t.Errorf("ErrorHint() of %q = %q, want empty", tt.script, ErrorHint(err))
+		}
+	}
+
+	if err := commandExitError(nil); err != nil {
+		t.Errorf("commandExitError(nil) = %v", err)
+	}
+	plain := errors.New("plain")
+	if err := commandExitError(plain); err != plain || ExitCode(err) != ExitCodeError {
+		t.Errorf("commandExitError() of a plain error = %v", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"os/exec"
+	"syscall"
 	"time"
 )
 
@@ -11,6 +12,9 @@ const (
 	CmdSessionManagerPlugin      string = "session-manager-plugin"
 	CmdSessionManagerPluginOrder string = "StartSession"
 	CmdSsh                       string = "ssh"
+
+	// How long to wait for a child process to exit after the signal before killing it.
+	CmdStopTimeout time.Duration = 5 * time.Second
 )
 
 func execExternalCommand(ctx context.Context, externalCommand string, args []string) (command *exec.Cmd, err error) {
@@ -18,24 +22,76 @@ func execExternalCommand(ctx context.Context, externalCommand string, args []str
 	command.Stdout = os.Stdout
 	command.Stderr = os.Stderr
 	command.Stdin = os.Stdin
+	setStopSignal(ctx, command)
 	err = command.Start()
 	return command, err
 }
 
-func execSessionManagerPortForwarding(ctx context.Context, tokens, region, sessionManagerParam, url string) (command *exec.Cmd, err error) {
+// Start a port forwarding session in the background. The plugin does not read stdin and
+// its messages are discarded so that multiple sessions can run side by side. Errors are shown.
+// It runs in its own process group, so that Ctrl-C stops it through awssh instead of directly.
+func startSessionManagerPortForwarding(ctx context.Context, tokens, region, sessionManagerParam, url string) (command *exec.Cmd, err error) {
+	args := []string{tokens, region, CmdSessionManagerPluginOrder, "", sessionManagerParam, url}
+	command = exec.CommandContext(ctx, CmdSessionManagerPlugin, args...)
+	command.Stderr = os.Stderr
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	setStopSignal(ctx, command)
+	err = command.Start()
+	return command, err
+}
+
+// Stop the command by the signal which stopped awssh instead of SIGKILL when ctx is done, so that
+// it can clean up. It is killed if it does not exit in CmdStopTimeout.
+func setStopSignal(ctx context.Context, command *exec.Cmd) {
+	command.Cancel = func() error {
+		return command.Process.Signal(stopSignalOf(ctx))
+	}
+	command.WaitDelay = CmdStopTimeout
+}
+
+// Send SIGTERM to the command and wait until done is closed after it exits.
+// It is killed if it does not exit in CmdStopTimeout.
+func stopCommand(command *exec.Cmd, done <-chan struct{}) {
+	command.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(CmdStopTimeout):
+		command.Process.Kill()
+		<-done
+	}
+}
+
+func execSessionManagerSession(ctx context.Context, tokens, region, sessionManagerParam, url string) (command *exec.Cmd, err error) {
 	args := []string{tokens, region, CmdSessionManagerPluginOrder, "", sessionManagerParam, url}
 	command, err = execExternalCommand(ctx, CmdSessionManagerPlugin, args)
-	time.Sleep(1 * time.Second)
 	return command, err
 }
 
 func checkSessionManagerCommandIsExist() (err error) {
-	err = exec.Command(CmdSessionManagerPlugin, "--version").Run()
-	return err
+	if err = exec.Command(CmdSessionManagerPlugin, "--version").Run(); err != nil {
+		return &PluginNotFoundError{Err: err}
+	}
+	return nil
 }
 
-func execSshCommand(ctx context.Context, username, host, port, identityFilePath string) (command *exec.Cmd, err error) {
-	args := []string{"-p", port, "-i", identityFilePath, username + "@" + host}
-	command, err = execExternalCommand(ctx, CmdSsh, args)
+// Run sshCommand (ssh if empty) to login. options are put before the destination, and args after it,
+// which are the options and the remote command passed after "--".
+func execSshCommand(ctx context.Context, sshCommand, username, host, port, identityFilePath string, options, args []string) (command *exec.Cmd, err error) {
+	if sshCommand == "" {
+		sshCommand = CmdSsh
+	}
+	sshArgs := append([]string{}, options...)
+	sshArgs = append(sshArgs, "-p", port, "-i", identityFilePath, username+"@"+host)
+	sshArgs = append(sshArgs, args...)
+	command, err = execExternalCommand(ctx, sshCommand, sshArgs)
 	return command, err
 }
+
+// Convert "Key=Value" options of -o into the args of ssh.
+func sshOptionArgs(options []string) (args []string) {
+	args = []string{}
+	for _, option := range options {
+		args = append(args, "-o", option)
+	}
+	return args
+}
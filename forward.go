@@ -0,0 +1,312 @@
+package awssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// How long to wait for session-manager-plugin to listen on the local port.
+	ForwardListenTimeout time.Duration = 30 * time.Second
+	// How many times to pick a free local port when another process took it before the plugin listened on it.
+	ForwardPortAttempts int = 3
+)
+
+type (
+	// PortForward is a port forwarding from the local port to the remote port of the instance,
+	// or of RemoteHost through the instance if it is not empty. The local port listens on
+	// BindAddress (ConnectHost if empty), or LocalSocket is listened on instead if it is not empty.
+	PortForward struct {
+		BindAddress string
+		LocalPort   string
+		LocalSocket string
+		RemoteHost  string
+		RemotePort  string
+	}
+	PortForwards []PortForward
+
+	// ForwardSession is a running session-manager-plugin of a PortForward. The plugin only listens on
+	// the loopback address, other local addresses are proxied by Tunnel.
+	ForwardSession struct {
+		PortForward
+		sessionID string
+		sessions  SessionStarter
+		command   *exec.Cmd
+		done      chan struct{}
+		err       error
+		stopOnce  sync.Once
+	}
+
+	// LocalForward is a running forward started by one of the transports, such as ForwardSession,
+	// Tunnel and EiceSession.
+	LocalForward interface {
+		Forward() PortForward
+		Stop()
+	}
+)
+
+func (f PortForward) String() string {
+	if f.LocalSocket != "" {
+		return f.LocalSocket + ":" + f.Remote()
+	}
+	return f.LocalPort + ":" + f.Remote()
+}
+
+// The ID of the tunnel of the forward, which is the local port or the socket path.
+func (f PortForward) tunnelID() string {
+	if f.LocalSocket != "" {
+		return f.LocalSocket
+	}
+	return f.LocalPort
+}
+
+// Bind returns the address the local port listens on.
+func (f PortForward) Bind() string {
+	if f.BindAddress == "" {
+		return ConnectHost
+	}
+	return f.BindAddress
+}
+
+// Local returns the local address of the forward.
+func (f PortForward) Local() string {
+	if f.LocalSocket != "" {
+		return f.LocalSocket
+	}
+	return net.JoinHostPort(f.Bind(), f.LocalPort)
+}
+
+// Whether session-manager-plugin can listen on the local address itself.
+func (f PortForward) direct() bool {
+	return f.LocalSocket == "" && f.Bind() == ConnectHost
+}
+
+// Remote returns the forwarded remote address. It is only the port for the instance itself.
+func (f PortForward) Remote() string {
+	if f.RemoteHost == "" {
+		return f.RemotePort
+	}
+	return net.JoinHostPort(f.RemoteHost, f.RemotePort)
+}
+
+// Parse "[LOCAL_PORT:][REMOTE_HOST:]REMOTE_PORT" formatted specs of -L. A free local port is used if
+// the local port is not given, and LOCAL_PORT containing "/" is the path of a Unix domain socket.
+// remoteHost is the remote host of the specs without REMOTE_HOST. The local ports listen on bind.
+func parsePortForwards(specs []string, remoteHost, bind string) (forwards PortForwards, err error) {
+	if len(specs) == 0 {
+		err = errors.New("specify at least one -L LOCAL_PORT:REMOTE_PORT")
+		return nil, err
+	}
+
+	for _, spec := range specs {
+		forward := PortForward{BindAddress: bind, RemoteHost: remoteHost}
+		ports := strings.Split(spec, ":")
+		switch len(ports) {
+		case 1:
+			forward.RemotePort = ports[0]
+		case 2:
+			forward.LocalPort = ports[0]
+			forward.RemotePort = ports[1]
+		case 3:
+			forward.LocalPort = ports[0]
+			forward.RemoteHost = ports[1]
+			forward.RemotePort = ports[2]
+			if forward.RemoteHost == "" {
+				err = errors.New("invalid -L " + spec + ": empty remote host")
+				return nil, err
+			}
+		default:
+			err = errors.New("invalid -L " + spec + " (expected LOCAL_PORT:[REMOTE_HOST:]REMOTE_PORT)")
+			return nil, err
+		}
+		if strings.Contains(forward.LocalPort, "/") {
+			forward.LocalSocket = forward.LocalPort
+			forward.LocalPort = ""
+		} else if len(ports) > 1 {
+			if err = validatePortNumber(forward.LocalPort); err != nil {
+				return nil, errors.New("invalid -L " + spec + ": " + err.Error())
+			}
+		}
+		if err = validatePortNumber(forward.RemotePort); err != nil {
+			return nil, errors.New("invalid -L " + spec + ": " + err.Error())
+		}
+		forwards = append(forwards, forward)
+	}
+
+	return forwards, nil
+}
+
+func validatePortNumber(port string) (err error) {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		err = errors.New("port must be 1-65535: " + port)
+		return err
+	}
+	return nil
+}
+
+// ForwardWithClients opens the port forwarding tunnels to the instance and keeps them until ctx is done.
+// The tunnels reconnect when their sessions are dropped.
+func ForwardWithClients(ctx context.Context, clients *Clients, args []string, forwards PortForwards, w io.Writer) (err error) {
+	instance, err := resolveInstance(ctx, clients, args)
+	if err != nil {
+		return err
+	}
+
+	tunnels := []*Tunnel{}
+	defer func() {
+		for _, tunnel := range tunnels {
+			tunnel.Stop()
+		}
+	}()
+
+	for _, forward := range forwards {
+		tunnel, err := startTunnel(ctx, clients, instance.ID, instance.TagName, forward, nil)
+		if err != nil {
+			return err
+		}
+		tunnels = append(tunnels, tunnel)
+	}
+
+	statuses := TunnelStatuses{}
+	for _, tunnel := range tunnels {
+		statuses = append(statuses, tunnel.Status())
+	}
+	printForwardStatuses(w, statuses)
+	fmt.Fprintln(w, "Press Ctrl-C to stop.")
+
+	<-ctx.Done()
+	return nil
+}
+
+// Start session-manager-plugin for the forward and wait until it listens on the local port. If the local port
+// of the forward is empty and another process took the free port picked for the plugin, another one is picked.
+func startPluginSession(ctx context.Context, clients *Clients, instanceID string, forward PortForward) (session *ForwardSession, err error) {
+	for attempt := 1; ; attempt++ {
+		session, err = startPluginSessionOnPort(ctx, clients, instanceID, forward)
+		var unavailable *LocalPortUnavailableError
+		if forward.LocalPort != "" || attempt == ForwardPortAttempts || !errors.As(err, &unavailable) {
+			return session, err
+		}
+	}
+}
+
+// Start session-manager-plugin on the local port of the forward, or a free port if it is empty. The port is
+// reserved while the session is started, and released right before the plugin starts because the plugin listens
+// on it by itself, so another process can take it in between. The plugin is stopped if it does not listen,
+// and LocalPortUnavailableError is returned if the port was taken.
+func startPluginSessionOnPort(ctx context.Context, clients *Clients, instanceID string, forward PortForward) (session *ForwardSession, err error) {
+	listener, localPort, err := reserveLocalPort(ConnectHost, forward.LocalPort)
+	if err != nil {
+		return nil, err
+	}
+	forward.LocalPort = localPort
+
+	tokens, sessionManagerParam, sessionID, err := getSsmSessionToken(ctx, clients.Sessions, instanceID, forward.RemoteHost, forward.RemotePort, forward.LocalPort)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	region := clients.Region
+	listener.Close()
+	command, err := startSessionManagerPortForwarding(ctx, tokens, region, sessionManagerParam, getSsmApiUrl(region))
+	if err != nil {
+		warnTerminateSession(clients.Sessions, sessionID)
+		return nil, err
+	}
+
+	session = &ForwardSession{
+		PortForward: forward,
+		sessionID:   sessionID,
+		sessions:    clients.Sessions,
+		command:     command,
+		done:        make(chan struct{}),
+	}
+	go func() {
+		session.err = command.Wait()
+		close(session.done)
+	}()
+
+	if err = waitForwardListening(ctx, session, ConnectHost, ForwardListenTimeout); err != nil {
+		session.Stop()
+		// Another process took the port before the plugin listened on it.
+		if l, listenErr := net.Listen("tcp", net.JoinHostPort(ConnectHost, forward.LocalPort)); listenErr != nil {
+			err = &LocalPortUnavailableError{Port: forward.LocalPort, Err: err}
+		} else {
+			l.Close()
+		}
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *ForwardSession) Forward() PortForward {
+	return s.PortForward
+}
+
+// Stop the plugin gracefully, wait for it to exit, and terminate the session. It is safe to call
+// Stop after the plugin exited by itself.
+func (s *ForwardSession) Stop() {
+	s.stopOnce.Do(func() {
+		stopCommand(s.command, s.done)
+		warnTerminateSession(s.sessions, s.sessionID)
+	})
+}
+
+// Terminate the session, and only warn on failure because it is closed by the idle timeout anyway.
+func warnTerminateSession(client SessionStarter, sessionID string) {
+	if err := terminateSsmSession(client, sessionID); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to terminate the session %s: %v\n", sessionID, err)
+	}
+}
+
+// Wait until the local port accepts connections. Fails if the plugin exits before that.
+func waitForwardListening(ctx context.Context, session *ForwardSession, host string, timeout time.Duration) (err error) {
+	address := net.JoinHostPort(host, session.LocalPort)
+	deadline := time.After(timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", address, 200*time.Millisecond)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+
+		select {
+		case <-session.done:
+			err = fmt.Errorf("session-manager-plugin of %s exited: %v", session.PortForward, session.err)
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			err = errors.New("timed out waiting for session-manager-plugin to listen on " + address)
+			return err
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func printForwardStatuses(w io.Writer, statuses TunnelStatuses) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "LOCAL\tREMOTE\tINSTANCE ID\tNAME\tSTATUS")
+	for _, status := range statuses {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			status.Forward.Local(),
+			status.Forward.Remote(),
+			status.InstanceID,
+			status.InstanceName,
+			status.Status,
+		)
+	}
+	tw.Flush()
+}
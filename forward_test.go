@@ -0,0 +1,110 @@
+package awssh
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePortForwards(t *testing.T) {
+	tests := []struct {
+		specs      []string
+		remoteHost string
+		bind       string
+		want       PortForwards
+		wantErr    bool
+	}{
+		{
+			specs: []string{"15432:5432", "8080:80"},
+			want: PortForwards{
+				{LocalPort: "15432", RemotePort: "5432"},
+				{LocalPort: "8080", RemotePort: "80"},
+			},
+		},
+		{
+			specs: []string{"3306"},
+			want:  PortForwards{{RemotePort: "3306"}},
+		},
+		{
+			specs: []string{"15432:db.example.com:5432", "6379:cache.example.com:6379"},
+			want: PortForwards{
+				{LocalPort: "15432", RemoteHost: "db.example.com", RemotePort: "5432"},
+				{LocalPort: "6379", RemoteHost: "cache.example.com", RemotePort: "6379"},
+			},
+		},
+		{
+			specs:      []string{"15432:5432", "6379:cache.example.com:6379"},
+			remoteHost: "db.example.com",
+			want: PortForwards{
+				{LocalPort: "15432", RemoteHost: "db.example.com", RemotePort: "5432"},
+				{LocalPort: "6379", RemoteHost: "cache.example.com", RemotePort: "6379"},
+			},
+		},
+		{
+			specs: []string{"15432:5432", "/tmp/db.sock:db.example.com:5432"},
+			bind:  "::1",
+			want: PortForwards{
+				{BindAddress: "::1", LocalPort: "15432", RemotePort: "5432"},
+				{BindAddress: "::1", LocalSocket: "/tmp/db.sock", RemoteHost: "db.example.com", RemotePort: "5432"},
+			},
+		},
+		{specs: []string{}, wantErr: true},
+		{specs: []string{"15432::5432"}, wantErr: true},
+		{specs: []string{"1:db:5432:1"}, wantErr: true},
+		{specs: []string{"15432:"}, wantErr: true},
+		{specs: []string{"0:5432"}, wantErr: true},
+		{specs: []string{"15432:65536"}, wantErr: true},
+		{specs: []string{"http:80"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parsePortForwards(tt.specs, tt.remoteHost, tt.bind)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePortForwards(%v) error = %v, wantErr %v", tt.specs, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parsePortForwards(%v) = %v, want %v", tt.specs, got, tt.want)
+		}
+	}
+}
+
+func TestPortForwardString(t *testing.T) {
+	tests := []struct {
+		forward PortForward
+		want    string
+	}{
+		{forward: PortForward{LocalPort: "15432", RemotePort: "5432"}, want: "15432:5432"},
+		{forward: PortForward{LocalPort: "15432", RemoteHost: "db.example.com", RemotePort: "5432"}, want: "15432:db.example.com:5432"},
+		{forward: PortForward{LocalPort: "15432", RemoteHost: "fd00::1", RemotePort: "5432"}, want: "15432:[fd00::1]:5432"},
+		{forward: PortForward{LocalSocket: "/tmp/db.sock", RemotePort: "5432"}, want: "/tmp/db.sock:5432"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.forward.String(); got != tt.want {
+			t.Errorf("PortForward.String() = %s, want %s", got, tt.want)
+		}
+	}
+}
+
+func TestPortForwardLocal(t *testing.T) {
+	tests := []struct {
+		forward    PortForward
+		want       string
+		wantDirect bool
+	}{
+		{forward: PortForward{LocalPort: "15432"}, want: "127.0.0.1:15432", wantDirect: true},
+		{forward: PortForward{BindAddress: "127.0.0.1", LocalPort: "15432"}, want: "127.0.0.1:15432", wantDirect: true},
+		{forward: PortForward{BindAddress: "::1", LocalPort: "15432"}, want: "[::1]:15432"},
+		{forward: PortForward{BindAddress: "0.0.0.0", LocalPort: "15432"}, want: "0.0.0.0:15432"},
+		{forward: PortForward{LocalSocket: "/tmp/db.sock"}, want: "/tmp/db.sock"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.forward.Local(); got != tt.want {
+			t.Errorf("PortForward.Local() = %s, want %s", got, tt.want)
+		}
+		if got := tt.forward.direct(); got != tt.wantDirect {
+			t.Errorf("PortForward.direct() of %s = %v, want %v", tt.want, got, tt.wantDirect)
+		}
+	}
+}
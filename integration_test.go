@@ -0,0 +1,829 @@
+package awssh
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/spf13/viper"
+)
+
+const (
+	testInstanceID = "i-0123456789abcdef0"
+
+	// The test binary runs as session-manager-plugin if the environment variable is set.
+	fakePluginEnv = "AWSSH_TEST_FAKE_PLUGIN_DIR"
+	// The fake ssh exits with the status of the environment variable.
+	fakeSshExitEnv = "AWSSH_TEST_FAKE_SSH_EXIT"
+	// The fake shell session runs for a second if the environment variable is set, recording SIGINT it gets.
+	fakeShellWaitEnv = "AWSSH_TEST_FAKE_SHELL_WAIT"
+
+	testDescribeInstancesResponse = `<DescribeInstancesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>request-id</requestId>
+  <reservationSet>
+    <item>
+      <reservationId>r-0123456789abcdef0</reservationId>
+      <instancesSet>
+        <item>
+          <instanceId>i-0123456789abcdef0</instanceId>
+          <subnetId>subnet-a</subnetId>
+          <vpcId>vpc-0123</vpcId>
+          <privateIpAddress>10.0.0.1</privateIpAddress>
+          <instanceState><code>16</code><name>running</name></instanceState>
+          <placement><availabilityZone>ap-northeast-1a</availabilityZone></placement>
+          <tagSet>
+            <item><key>Name</key><value>web</value></item>
+          </tagSet>
+        </item>
+      </instancesSet>
+    </item>
+  </reservationSet>
+</DescribeInstancesResponse>`
+	testCreateImageResponse = `<CreateImageResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>request-id</requestId>
+  <imageId>ami-0123456789abcdef0</imageId>
+</CreateImageResponse>`
+	testDescribeInstanceConnectEndpointsResponse = `<DescribeInstanceConnectEndpointsResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>request-id</requestId>
+  <instanceConnectEndpointSet>
+    <item>
+      <instanceConnectEndpointId>eice-0123456789abcdef0</instanceConnectEndpointId>
+      <dnsName>eice-0123456789abcdef0.ec2-instance-connect-endpoint.ap-northeast-1.amazonaws.com</dnsName>
+      <vpcId>vpc-0123</vpcId>
+      <subnetId>subnet-a</subnetId>
+      <state>create-complete</state>
+    </item>
+  </instanceConnectEndpointSet>
+</DescribeInstanceConnectEndpointsResponse>`
+	testGetCallerIdentityResponse = `<GetCallerIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <GetCallerIdentityResult>
+    <Arn>arn:aws:iam::123456789012:user/alice</Arn>
+    <UserId>AIDAEXAMPLE</UserId>
+    <Account>123456789012</Account>
+  </GetCallerIdentityResult>
+</GetCallerIdentityResponse>`
+)
+
+type (
+	// fakeAwsServer serves the EC2, STS (query protocol), SSM and EC2 Instance Connect (JSON protocol) APIs awssh calls.
+	fakeAwsServer struct {
+		mu       sync.Mutex
+		requests map[string]map[string]interface{}
+		// failures are the error codes returned for the JSON targets.
+		failures map[string]string
+	}
+)
+
+func (s *fakeAwsServer) record(action string, params map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[action] = params
+}
+
+func (s *fakeAwsServer) request(action string) (params map[string]interface{}, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	params, ok = s.requests[action]
+	return params, ok
+}
+
+func (s *fakeAwsServer) fail(target, code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[target] = code
+}
+
+func (s *fakeAwsServer) failure(target string) (code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failures[target]
+}
+
+func (s *fakeAwsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if target := r.Header.Get("X-Amz-Target"); target != "" {
+		params := map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.record(target, params)
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		if code := s.failure(target); code != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"__type":%q,"message":"failed by the test"}`, code)
+			return
+		}
+		switch target {
+		case "AmazonSSM.StartSession":
+			w.Write([]byte(`{"SessionId":"session-id","StreamUrl":"wss://example.com/stream","TokenValue":"token"}`))
+		case "AmazonSSM.TerminateSession":
+			w.Write([]byte(`{"SessionId":"session-id"}`))
+		case "AmazonSSM.ListInventoryEntries":
+			w.Write([]byte(`{"Entries":[],"InstanceId":"i-0123456789abcdef0","TypeName":"AWS:Application"}`))
+		case "AWSEC2InstanceConnectService.SendSSHPublicKey":
+			w.Write([]byte(`{"RequestId":"request-id","Success":true}`))
+		default:
+			http.Error(w, "unknown target: "+target, http.StatusBadRequest)
+		}
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	action := r.PostForm.Get("Action")
+	params := map[string]interface{}{}
+	for key := range r.PostForm {
+		params[key] = r.PostForm.Get(key)
+	}
+	s.record(action, params)
+
+	w.Header().Set("Content-Type", "text/xml")
+	switch action {
+	case "DescribeInstances":
+		w.Write([]byte(testDescribeInstancesResponse))
+	case "CreateImage":
+		w.Write([]byte(testCreateImageResponse))
+	case "DescribeInstanceConnectEndpoints":
+		w.Write([]byte(testDescribeInstanceConnectEndpointsResponse))
+	case "GetCallerIdentity":
+		w.Write([]byte(testGetCallerIdentityResponse))
+	default:
+		http.Error(w, "unknown action: "+action, http.StatusBadRequest)
+	}
+}
+
+// TestMain runs the test binary as the fake session-manager-plugin if fakePluginEnv is set.
+func TestMain(m *testing.M) {
+	if dir := os.Getenv(fakePluginEnv); dir != "" {
+		os.Exit(runFakePlugin(dir, os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+// runFakePlugin listens on the local port of the session parameter like the real plugin, and echoes
+// connections back instead of forwarding them. Its pid is written to plugin.pid of dir.
+func runFakePlugin(dir string, args []string) (code int) {
+	var param SsmDocument
+	if len(args) < 5 || json.Unmarshal([]byte(args[4]), &param) != nil || len(param.Parameters.LocalPortNumber) != 1 {
+		fmt.Fprintf(os.Stderr, "fake plugin: invalid args: %v\n", args)
+		return 1
+	}
+
+	l, err := net.Listen("tcp", net.JoinHostPort(ConnectHost, param.Parameters.LocalPortNumber[0]))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fake plugin: %v\n", err)
+		return 1
+	}
+	ioutil.WriteFile(filepath.Join(dir, "plugin.pid"), []byte(strconv.Itoa(os.Getpid())), 0644)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return 1
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+func newFakeAwsClients(t *testing.T) (clients *Clients, server *fakeAwsServer) {
+	t.Helper()
+
+	server = &fakeAwsServer{requests: map[string]map[string]interface{}{}, failures: map[string]string{}}
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+
+	clients = NewClients(aws.Config{
+		Region:           "ap-northeast-1",
+		Credentials:      credentials.NewStaticCredentialsProvider("AKIAEXAMPLE", "secret", ""),
+		BaseEndpoint:     aws.String(ts.URL),
+		RetryMaxAttempts: 1,
+	})
+	return clients, server
+}
+
+// Put fake session-manager-plugin and ssh commands which record their arguments on PATH.
+func setupFakeCommands(t *testing.T) (dir string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake commands are shell scripts")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir = t.TempDir()
+	// Port forwarding sessions run the fake plugin of the test binary, shell sessions exit or wait by fakeShellWaitEnv.
+	// The plugin appends its arguments since multiple sessions may be started.
+	pluginScript := "#!/bin/sh\necho \"$@\" >> \"$(dirname \"$0\")/plugin.args\"\ncase \"$5\" in *localPortNumber*) " + fakePluginEnv + "=\"$(dirname \"$0\")\" exec " + shellQuote(executable) + " \"$@\";; esac\n" +
+		"if [ -n \"$" + fakeShellWaitEnv + "\" ]; then\n" +
+		"  d=\"$(dirname \"$0\")\"\n" +
+		"  trap 'echo INT >> \"$d/shell.signals\"' INT\n" +
+		"  echo $$ > \"$d/shell.pid\"\n" +
+		"  n=0; while [ $n -lt 10 ]; do sleep 0.1; n=$((n+1)); done\n" +
+		"fi\n"
+	scripts := map[string]string{
+		CmdSessionManagerPlugin: pluginScript,
+		CmdScp:                  "#!/bin/sh\necho \"$@\" > \"$(dirname \"$0\")/scp.args\"\n",
+		CmdRsync:                "#!/bin/sh\nfor arg in \"$@\"; do echo \"$arg\"; done > \"$(dirname \"$0\")/rsync.args\"\n",
+		CmdSsh:                  "#!/bin/sh\necho \"$@\" > \"$(dirname \"$0\")/ssh.args\"\nexit \"${" + fakeSshExitEnv + ":-0}\"\n",
+	}
+	for name, script := range scripts {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return dir
+}
+
+func setupRunConfig(t *testing.T) (identityFile, publicKey string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	identityFile = filepath.Join(dir, "id_ed25519")
+	publicKey = testPublicKey(t)
+	if err := ioutil.WriteFile(identityFile+".pub", []byte(publicKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(viper.Reset)
+	viper.Set("port", "22")
+	viper.Set("username", "ec2-user")
+	viper.Set("identity-file", identityFile)
+	viper.Set("publickey", identityFile+".pub")
+	viper.Set("keepalive", DefaultKeepaliveInterval)
+	return identityFile, publicKey
+}
+
+func readArgs(t *testing.T, path string) (args string) {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args = strings.TrimSpace(string(data))
+	return args
+}
+
+func TestRunWithClients(t *testing.T) {
+	commandDir := setupFakeCommands(t)
+	identityFile, publicKey := setupRunConfig(t)
+	clients, server := newFakeAwsClients(t)
+
+	if err := RunWithClients(context.Background(), clients, []string{testInstanceID}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	startSession, ok := server.request("AmazonSSM.StartSession")
+	if !ok {
+		t.Fatal("StartSession was not called")
+	}
+	if startSession["Target"] != testInstanceID || startSession["DocumentName"] != DocumentNameAwsStartPortForwardingSession {
+		t.Errorf("StartSession = %v", startSession)
+	}
+
+	sendKey, ok := server.request("AWSEC2InstanceConnectService.SendSSHPublicKey")
+	if !ok {
+		t.Fatal("SendSSHPublicKey was not called")
+	}
+	want := map[string]interface{}{
+		"AvailabilityZone": "ap-northeast-1a",
+		"InstanceId":       testInstanceID,
+		"InstanceOSUser":   "ec2-user",
+		"SSHPublicKey":     publicKey,
+	}
+	for key, value := range want {
+		if sendKey[key] != value {
+			t.Errorf("SendSSHPublicKey %s = %v, want %v", key, sendKey[key], value)
+		}
+	}
+
+	if _, ok := server.request("CreateImage"); ok {
+		t.Error("CreateImage was called without enable-snapshot")
+	}
+
+	if terminate, ok := server.request("AmazonSSM.TerminateSession"); !ok || terminate["SessionId"] != "session-id" {
+		t.Errorf("TerminateSession = %v", terminate)
+	}
+
+	pluginArgs := readArgs(t, filepath.Join(commandDir, "plugin.args"))
+	if !strings.Contains(pluginArgs, `"SessionId":"session-id"`) || !strings.Contains(pluginArgs, "ap-northeast-1 StartSession") {
+		t.Errorf("session-manager-plugin args = %s", pluginArgs)
+	}
+
+	sshArgs := strings.Fields(readArgs(t, filepath.Join(commandDir, "ssh.args")))
+	if len(sshArgs) != 9 || strings.Join(sshArgs[:4], " ") != "-o ServerAliveInterval=30 -o ServerAliveCountMax=3" ||
+		sshArgs[4] != "-p" || sshArgs[6] != "-i" || sshArgs[7] != identityFile || sshArgs[8] != "ec2-user@"+ConnectHost {
+		t.Errorf("ssh args = %v", sshArgs)
+	}
+	if len(sshArgs) > 5 && !strings.Contains(pluginArgs, `"localPortNumber":["`+sshArgs[5]+`"]`) {
+		t.Errorf("ssh port %s does not match session-manager-plugin args %s", sshArgs[5], pluginArgs)
+	}
+}
+
+func TestRunWithClientsTransport(t *testing.T) {
+	tests := []struct {
+		transport    string
+		notConnected bool
+		wantEice     bool
+		wantErr      error
+	}{
+		{transport: TransportAuto, wantEice: false},
+		{transport: TransportAuto, notConnected: true, wantEice: true},
+		{transport: TransportEICE, wantEice: true},
+		{transport: TransportSSM, notConnected: true, wantErr: &TargetNotConnectedError{}},
+	}
+	for _, tt := range tests {
+		commandDir := setupFakeCommands(t)
+		setupRunConfig(t)
+		clients, server := newFakeAwsClients(t)
+		tunnels := &fakeEndpointTunnels{}
+		clients.EndpointTunnels = tunnels
+		if tt.notConnected {
+			server.fail("AmazonSSM.StartSession", "TargetNotConnected")
+		}
+		viper.Set("transport", tt.transport)
+
+		err := RunWithClients(context.Background(), clients, []string{testInstanceID}, nil)
+		if tt.wantErr != nil {
+			if ExitCode(err) != ExitCode(tt.wantErr) {
+				t.Errorf("%s: RunWithClients() error = %v, want %T", tt.transport, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.transport, err)
+		}
+
+		describe, described := server.request("DescribeInstanceConnectEndpoints")
+		if described != tt.wantEice {
+			t.Errorf("%s (not connected %v): DescribeInstanceConnectEndpoints called %v, want %v", tt.transport, tt.notConnected, described, tt.wantEice)
+		}
+		if tt.wantEice && (describe["Filter.1.Name"] != "vpc-id" || describe["Filter.1.Value.1"] != "vpc-0123") {
+			t.Errorf("%s: DescribeInstanceConnectEndpoints = %v", tt.transport, describe)
+		}
+		if _, err := os.Stat(filepath.Join(commandDir, "plugin.args")); tt.wantEice == (err == nil) {
+			t.Errorf("%s (not connected %v): session-manager-plugin run %v", tt.transport, tt.notConnected, err == nil)
+		}
+		if _, ok := server.request("AWSEC2InstanceConnectService.SendSSHPublicKey"); !ok {
+			t.Errorf("%s: SendSSHPublicKey was not called", tt.transport)
+		}
+		if sshArgs := strings.Fields(readArgs(t, filepath.Join(commandDir, "ssh.args"))); len(sshArgs) != 9 || sshArgs[4] != "-p" {
+			t.Errorf("%s: ssh args = %v", tt.transport, sshArgs)
+		}
+	}
+}
+
+func TestForwardWithClientsUnixSocket(t *testing.T) {
+	setupFakeCommands(t)
+	clients, _ := newFakeAwsClients(t)
+	path := filepath.Join(t.TempDir(), "db.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	var out bytes.Buffer
+	go func() {
+		done <- ForwardWithClients(ctx, clients, []string{testInstanceID}, PortForwards{{LocalSocket: path, RemotePort: "5432"}}, &out)
+	}()
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("unix", path); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake plugin echoes the data back through the proxy.
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("read %q, %v", buf, err)
+	}
+	conn.Close()
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), path+"  5432") {
+		t.Errorf("output = %s", out.String())
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket is not removed: %v", err)
+	}
+}
+
+func TestRunWithClientsSshArgs(t *testing.T) {
+	commandDir := setupFakeCommands(t)
+	identityFile, _ := setupRunConfig(t)
+	clients, _ := newFakeAwsClients(t)
+
+	// A wrapped ssh is run instead of ssh.
+	wrapped := filepath.Join(commandDir, "wrapped-ssh")
+	if err := os.Rename(filepath.Join(commandDir, CmdSsh), wrapped); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("ssh-command", wrapped)
+	viper.Set("ssh-args", []string{"-A"})
+	viper.Set("ssh-option", []string{"ServerAliveInterval=10", "SetEnv=A=1,B=2"})
+	viper.Set("keepalive", "0")
+
+	if err := RunWithClients(context.Background(), clients, []string{testInstanceID}, []string{"-L", "8080:localhost:80", "uptime"}); err != nil {
+		t.Fatal(err)
+	}
+
+	sshArgs := strings.Fields(readArgs(t, filepath.Join(commandDir, "ssh.args")))
+	if len(sshArgs) != 13 {
+		t.Fatalf("ssh args = %v", sshArgs)
+	}
+	want := "-o ServerAliveInterval=10 -o SetEnv=A=1,B=2 -A -p " + sshArgs[6] + " -i " + identityFile + " ec2-user@" + ConnectHost + " -L 8080:localhost:80 uptime"
+	if strings.Join(sshArgs, " ") != want {
+		t.Errorf("ssh args = %v, want %s", sshArgs, want)
+	}
+}
+
+func TestCopyWithClients(t *testing.T) {
+	commandDir := setupFakeCommands(t)
+	identityFile, _ := setupRunConfig(t)
+	clients, server := newFakeAwsClients(t)
+
+	// The instance is found by the Name tag.
+	if err := CopyWithClients(context.Background(), clients, "web:/var/log/nginx", "./logs", true, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := server.request("AWSEC2InstanceConnectService.SendSSHPublicKey"); !ok {
+		t.Error("SendSSHPublicKey was not called")
+	}
+	if describe, ok := server.request("DescribeInstances"); !ok || describe["Filter.2.Name"] != "tag:Name" || describe["Filter.2.Value.1"] != "web" {
+		t.Errorf("DescribeInstances = %v", describe)
+	}
+
+	scpArgs := strings.Fields(readArgs(t, filepath.Join(commandDir, "scp.args")))
+	if len(scpArgs) != 13 {
+		t.Fatalf("scp args = %v", scpArgs)
+	}
+	want := "-o ServerAliveInterval=30 -o ServerAliveCountMax=3 -o HostKeyAlias=" + testInstanceID + " -P " + scpArgs[7] + " -i " + identityFile + " -r ec2-user@" + ConnectHost + ":/var/log/nginx ./logs"
+	if strings.Join(scpArgs, " ") != want {
+		t.Errorf("scp args = %v, want %s", scpArgs, want)
+	}
+	pluginArgs := readArgs(t, filepath.Join(commandDir, "plugin.args"))
+	if !strings.Contains(pluginArgs, `"localPortNumber":["`+scpArgs[7]+`"]`) {
+		t.Errorf("scp port %s does not match session-manager-plugin args %s", scpArgs[7], pluginArgs)
+	}
+}
+
+func TestRsyncWithClients(t *testing.T) {
+	commandDir := setupFakeCommands(t)
+	identityFile, _ := setupRunConfig(t)
+	clients, _ := newFakeAwsClients(t)
+	viper.Set("ssh-args", []string{"-A"})
+
+	if err := RsyncWithClients(context.Background(), clients, []string{"-avz", "--delete", "--exclude", "cache:*", "./dist/", "web:/srv/app"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// One arg per line, since the remote shell contains spaces.
+	rsyncArgs := strings.Split(readArgs(t, filepath.Join(commandDir, "rsync.args")), "\n")
+	if len(rsyncArgs) != 8 || rsyncArgs[0] != "-e" {
+		t.Fatalf("rsync args = %q", rsyncArgs)
+	}
+	rsh := strings.Fields(rsyncArgs[1])
+	if len(rsh) != 14 {
+		t.Fatalf("remote shell = %s", rsyncArgs[1])
+	}
+	want := "ssh -A -o ServerAliveInterval=30 -o ServerAliveCountMax=3 -o HostName=" + ConnectHost + " -o HostKeyAlias=" + testInstanceID + " -p " + rsh[11] + " -i " + identityFile
+	if rsyncArgs[1] != want {
+		t.Errorf("remote shell = %s, want %s", rsyncArgs[1], want)
+	}
+	if got := strings.Join(rsyncArgs[2:], " "); got != "-avz --delete --exclude cache:* ./dist/ ec2-user@"+testInstanceID+":/srv/app" {
+		t.Errorf("rsync args = %s", got)
+	}
+
+	pluginArgs := readArgs(t, filepath.Join(commandDir, "plugin.args"))
+	if !strings.Contains(pluginArgs, `"localPortNumber":["`+rsh[11]+`"]`) {
+		t.Errorf("ssh port %s does not match session-manager-plugin args %s", rsh[11], pluginArgs)
+	}
+}
+
+func TestRunWithClientsExitCode(t *testing.T) {
+	setupFakeCommands(t)
+	setupRunConfig(t)
+	clients, server := newFakeAwsClients(t)
+	t.Setenv(fakeSshExitEnv, "3")
+
+	err := RunWithClients(context.Background(), clients, []string{testInstanceID}, nil)
+	var exitErr *CommandExitError
+	if !errors.As(err, &exitErr) || ExitCode(err) != 3 {
+		t.Fatalf("RunWithClients() error = %v, want exit code 3", err)
+	}
+	if _, ok := server.request("AmazonSSM.TerminateSession"); !ok {
+		t.Error("TerminateSession was not called after ssh failed")
+	}
+}
+
+func TestRunWithClientsLocalPortRange(t *testing.T) {
+	commandDir := setupFakeCommands(t)
+	setupRunConfig(t)
+	clients, _ := newFakeAwsClients(t)
+
+	// Use a free range, and take the stable port of the instance so that the next port is used.
+	free, err := fetchEmptyPort(ConnectHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	min, _ := strconv.Atoi(free)
+	if min > 65534 {
+		min = 65534
+	}
+	portRange := strconv.Itoa(min) + "-" + strconv.Itoa(min+1)
+	viper.Set("local-port-range", portRange)
+	candidates, err := localPortCandidates(testInstanceID, "", portRange)
+	if err != nil {
+		t.Fatal(err)
+	}
+	taken, err := net.Listen("tcp", net.JoinHostPort(ConnectHost, candidates[0]))
+	if err != nil {
+		t.Skipf("the stable port is not free: %v", err)
+	}
+	defer taken.Close()
+
+	if err := RunWithClients(context.Background(), clients, []string{testInstanceID}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	sshArgs := strings.Fields(readArgs(t, filepath.Join(commandDir, "ssh.args")))
+	if len(sshArgs) < 6 || sshArgs[5] != candidates[1] {
+		t.Errorf("ssh args = %v, want port %s", sshArgs, candidates[1])
+	}
+}
+
+func TestRunWithClientsSnapshot(t *testing.T) {
+	setupFakeCommands(t)
+	setupRunConfig(t)
+	viper.Set("enable-snapshot", true)
+	viper.Set("snapshot.copy-tags", DefaultSnapshotCopyTags)
+	viper.Set("snapshot.tags", []string{"Purpose=test"})
+	clients, server := newFakeAwsClients(t)
+
+	if err := RunWithClients(context.Background(), clients, []string{testInstanceID}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	createImage, ok := server.request("CreateImage")
+	if !ok {
+		t.Fatal("CreateImage was not called")
+	}
+	if createImage["InstanceId"] != testInstanceID || createImage["NoReboot"] != "true" {
+		t.Errorf("CreateImage = %v", createImage)
+	}
+
+	tags := map[string]string{}
+	for i := 1; ; i++ {
+		prefix := "TagSpecification.1.Tag." + strconv.Itoa(i)
+		key, ok := createImage[prefix+".Key"].(string)
+		if !ok {
+			break
+		}
+		tags[key] = createImage[prefix+".Value"].(string)
+	}
+	want := map[string]string{
+		"Name":                   "web",
+		"Purpose":                "test",
+		SnapshotTagKeyInstanceID: testInstanceID,
+		SnapshotTagKeyCreated:    SnapshotTagValueCreated,
+		SnapshotTagKeyCreatedBy:  "arn:aws:iam::123456789012:user/alice",
+	}
+	for key, value := range want {
+		if tags[key] != value {
+			t.Errorf("image tag %s = %q, want %q", key, tags[key], value)
+		}
+	}
+}
+
+func TestRunWithClientsSnapshotDisabled(t *testing.T) {
+	setupFakeCommands(t)
+	setupRunConfig(t)
+	viper.Set("snapshot-if-older-than", "1d")
+	clients, server := newFakeAwsClients(t)
+
+	if err := RunWithClients(context.Background(), clients, []string{testInstanceID}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := server.request("DescribeImages"); ok {
+		t.Error("DescribeImages was called without enable-snapshot")
+	}
+	if _, ok := server.request("CreateImage"); ok {
+		t.Error("CreateImage was called without enable-snapshot")
+	}
+}
+
+func TestRunWithClientsShellSession(t *testing.T) {
+	commandDir := setupFakeCommands(t)
+	setupRunConfig(t)
+	viper.Set("mode", ModeSSMShell)
+	viper.Set("document", "AWS-StartInteractiveCommand")
+	viper.Set("document-parameter", []string{"command=top -b, -n 1"})
+	clients, server := newFakeAwsClients(t)
+
+	if err := RunWithClients(context.Background(), clients, []string{testInstanceID}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	startSession, ok := server.request("AmazonSSM.StartSession")
+	if !ok {
+		t.Fatal("StartSession was not called")
+	}
+	if startSession["DocumentName"] != "AWS-StartInteractiveCommand" {
+		t.Errorf("StartSession = %v", startSession)
+	}
+	if _, ok := server.request("AWSEC2InstanceConnectService.SendSSHPublicKey"); ok {
+		t.Error("SendSSHPublicKey was called in shell session mode")
+	}
+
+	pluginArgs := readArgs(t, filepath.Join(commandDir, "plugin.args"))
+	if !strings.Contains(pluginArgs, `"Parameters":{"command":["top -b, -n 1"]}`) {
+		t.Errorf("session-manager-plugin args = %s", pluginArgs)
+	}
+	if _, err := os.Stat(filepath.Join(commandDir, "ssh.args")); err == nil {
+		t.Error("ssh was executed in shell session mode")
+	}
+}
+
+// Ctrl-C in the shell session goes to the plugin from the terminal. awssh ignores it instead of stopping the plugin.
+func TestRunWithClientsShellSessionInterrupt(t *testing.T) {
+	commandDir := setupFakeCommands(t)
+	setupRunConfig(t)
+	viper.Set("mode", ModeSSMShell)
+	t.Setenv(fakeShellWaitEnv, "1")
+	clients, server := newFakeAwsClients(t)
+
+	ctx, stop := notifyStop(context.Background())
+	defer stop()
+	done := make(chan error, 1)
+	go func() {
+		done <- RunWithClients(ctx, clients, []string{testInstanceID}, nil)
+	}()
+
+	pidPath := filepath.Join(commandDir, "shell.pid")
+	var pid int
+	for i := 0; i < 100 && pid == 0; i++ {
+		if data, err := ioutil.ReadFile(pidPath); err == nil {
+			pid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if pid == 0 {
+		t.Fatal("shell session did not start")
+	}
+
+	// The terminal sends SIGINT to the foreground process group, which has both awssh and the plugin.
+	syscall.Kill(pid, syscall.SIGINT)
+	syscall.Kill(os.Getpid(), syscall.SIGINT)
+
+	if err := <-done; err != nil {
+		t.Fatalf("RunWithClients() error = %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Errorf("context was cancelled by SIGINT: %v", context.Cause(ctx))
+	}
+	if signals := readArgs(t, filepath.Join(commandDir, "shell.signals")); signals != "INT" {
+		t.Errorf("plugin got signals %q, want only the SIGINT of the terminal", signals)
+	}
+	if _, ok := server.request("AmazonSSM.TerminateSession"); !ok {
+		t.Error("TerminateSession was not called")
+	}
+}
+
+func TestForwardWithClients(t *testing.T) {
+	commandDir := setupFakeCommands(t)
+	clients, server := newFakeAwsClients(t)
+
+	var forwards PortForwards
+	for _, remotePort := range []string{"5432", "80"} {
+		localPort, err := fetchEmptyPort(ConnectHost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		forwards = append(forwards, PortForward{LocalPort: localPort, RemotePort: remotePort})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	var out bytes.Buffer
+	if err := ForwardWithClients(ctx, clients, []string{testInstanceID}, forwards, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := server.request("AWSEC2InstanceConnectService.SendSSHPublicKey"); ok {
+		t.Error("SendSSHPublicKey was called by forward")
+	}
+
+	pluginArgs := strings.Split(readArgs(t, filepath.Join(commandDir, "plugin.args")), "\n")
+	if len(pluginArgs) != len(forwards) {
+		t.Fatalf("session-manager-plugin was executed %d times, want %d", len(pluginArgs), len(forwards))
+	}
+	for i, forward := range forwards {
+		// awssh listens on the local port, and proxies to the plugin listening on another port.
+		want := `"portNumber":["` + forward.RemotePort + `"]`
+		if !strings.Contains(pluginArgs[i], want) {
+			t.Errorf("session-manager-plugin args = %s, want %s", pluginArgs[i], want)
+		}
+		if !strings.Contains(out.String(), ConnectHost+":"+forward.LocalPort+"  "+forward.RemotePort) {
+			t.Errorf("status of %s is not printed:\n%s", forward, out.String())
+		}
+	}
+	if !strings.Contains(out.String(), "web") || !strings.Contains(out.String(), "connected") {
+		t.Errorf("output = %s", out.String())
+	}
+}
+
+func TestRunPortForwardOnlyReconnect(t *testing.T) {
+	commandDir := setupFakeCommands(t)
+	setupRunConfig(t)
+	clients, _ := newFakeAwsClients(t)
+	instance := &Instance{ID: testInstanceID, TagName: "web"}
+
+	var pushed int32
+	pushKey := func(ctx context.Context) error {
+		atomic.AddInt32(&pushed, 1)
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- runPortForwardOnly(ctx, clients, instance, PortForward{RemotePort: "22"}, []string{""}, pushKey)
+	}()
+
+	waitPushed := func(n int32) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for atomic.LoadInt32(&pushed) < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("the key was pushed %d times, want %d", atomic.LoadInt32(&pushed), n)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	waitPushed(1)
+
+	// Kill the plugin, the key is pushed again after the session is reconnected.
+	pid, err := ioutil.ReadFile(filepath.Join(commandDir, "plugin.pid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := strconv.Atoi(string(pid))
+	if err := syscall.Kill(n, syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	waitPushed(2)
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("runPortForwardOnly did not return")
+	}
+	if _, err := os.Stat(filepath.Join(commandDir, "ssh.args")); err == nil {
+		t.Error("ssh was executed with port forwarding only")
+	}
+}
@@ -0,0 +1,44 @@
+package awssh
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/k1LoW/duration"
+)
+
+const (
+	DefaultKeepaliveInterval string = "30s"
+	// ssh exits when this number of keepalives are not answered in a row.
+	KeepaliveCountMax int = 3
+)
+
+// Parse the keepalive interval such as "30s". "0" disables keepalives.
+func parseKeepaliveInterval(value string) (interval time.Duration, err error) {
+	if value == "" || value == "0" {
+		return 0, nil
+	}
+	interval, err = duration.Parse(value)
+	if err != nil {
+		return 0, errors.New("invalid keepalive interval: " + value)
+	}
+	return interval, nil
+}
+
+// OpenSSH options to send keepalives through the tunnel, so that ssh exits instead of hanging when
+// the session is dropped. No option is returned if interval is 0.
+func sshKeepaliveOptions(interval time.Duration) (options []string) {
+	if interval <= 0 {
+		return []string{}
+	}
+	seconds := int(interval / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	options = []string{
+		"-o", "ServerAliveInterval=" + strconv.Itoa(seconds),
+		"-o", "ServerAliveCountMax=" + strconv.Itoa(KeepaliveCountMax),
+	}
+	return options
+}
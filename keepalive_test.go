@@ -0,0 +1,45 @@
+package awssh
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseKeepaliveInterval(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"30s", 30 * time.Second, false},
+		{"1m", time.Minute, false},
+		{"0", 0, false},
+		{"", 0, false},
+		{"soon", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseKeepaliveInterval(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseKeepaliveInterval(%q) = %s, %v", tt.value, got, err)
+		}
+	}
+}
+
+func TestSshKeepaliveOptions(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		want     []string
+	}{
+		{30 * time.Second, []string{"-o", "ServerAliveInterval=30", "-o", "ServerAliveCountMax=3"}},
+		{500 * time.Millisecond, []string{"-o", "ServerAliveInterval=1", "-o", "ServerAliveCountMax=3"}},
+		{0, []string{}},
+	}
+
+	for _, tt := range tests {
+		if got := sshKeepaliveOptions(tt.interval); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sshKeepaliveOptions(%s) = %v, want %v", tt.interval, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package awssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/smithy-go"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	KeyPushInstanceConnect string = "instance-connect"
+	KeyPushSSM             string = "ssm"
+	KeyPushAuto            string = "auto"
+
+	DocumentNameAwsRunShellScript string = "AWS-RunShellScript"
+
+	// The package on the instance which EC2 Instance Connect needs.
+	InstanceConnectPackageName string = "ec2-instance-connect"
+
+	// Keys pushed by SSM expire like EC2 Instance Connect keys.
+	SSMKeyPushExpiry    time.Duration = 60 * time.Second
+	SSMKeyPushTimeout   time.Duration = 60 * time.Second
+	SSMKeyPushMarkerKey string        = "awssh-expires="
+)
+
+var (
+	KeyPushMethods = []string{KeyPushAuto, KeyPushInstanceConnect, KeyPushSSM}
+
+	validUsernameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.-]*\$?$`)
+)
+
+// The script appends the key with an expiry marker to authorized_keys, removes expired awssh keys,
+// and schedules the removal of the pushed key. It runs as root by the SSM agent. The removal is scheduled
+// by a systemd timer, or runs in a new session if systemd is not available, so that it is not killed
+// with the process group of the command when the command exits.
+const ssmKeyPushScript = `set -eu
+user=%[1]s
+key=%[2]s
+expires=%[3]d
+marker=%[4]s
+prune=%[6]s
+home=$(getent passwd "$user" | cut -d: -f6)
+if [ -z "$home" ]; then
+  echo "user not found: $user" >&2
+  exit 1
+fi
+group=$(id -gn "$user")
+file="$home/.ssh/authorized_keys"
+mkdir -p "$home/.ssh"
+chown "$user:$group" "$home/.ssh"
+chmod 700 "$home/.ssh"
+touch "$file"
+chown "$user:$group" "$file"
+chmod 600 "$file"
+sh -c "$prune" sh "$marker" "$file"
+echo "$key $marker$expires" >> "$file"
+if ! systemd-run --on-active=%[5]d /bin/sh -c "$prune" sh "$marker" "$file" > /dev/null 2>&1; then
+  nohup setsid sh -c "sleep %[5]d; $prune" sh "$marker" "$file" > /dev/null 2>&1 < /dev/null &
+fi
+`
+
+// The script removes the keys whose expiry marker $1 has passed from the authorized_keys file $2.
+const ssmKeyPruneScript = `set -eu
+now=$(date +%s)
+awk -v now="$now" -v marker="$1" '{ i = index($0, marker); if (i > 0 && substr($0, i + length(marker)) + 0 <= now) next; print }' "$2" > "$2.awssh"
+cat "$2.awssh" > "$2"
+rm -f "$2.awssh"
+`
+
+func validateKeyPushMethod(method string) (err error) {
+	for _, m := range KeyPushMethods {
+		if method == m {
+			return nil
+		}
+	}
+
+	err = errors.New("invalid --key-push: " + method + " (" + strings.Join(KeyPushMethods, "|") + ")")
+	return err
+}
+
+// Push the public key to the instance by the method. "auto" uses EC2 Instance Connect
+// and falls back to SSM when Instance Connect is not available for the instance. Instance Connect
+// accepts the key even if the instance does not have the package, so the SSM inventory is checked first.
+func pushPublicKey(ctx context.Context, clients *Clients, instance *Instance, username, publickeyFilePath, method string) (err error) {
+	switch method {
+	case KeyPushSSM:
+		err = sendSSHPublicKeyBySSM(ctx, clients.Commands, instance, username, publickeyFilePath)
+		return err
+	case KeyPushInstanceConnect:
+		err = sendSSHPublicKey(ctx, clients.Keys, instance, username, publickeyFilePath)
+		return err
+	}
+
+	if installed, known := instanceConnectInstalled(ctx, clients.Inventory, instance.ID); known && !installed {
+		fmt.Fprintln(os.Stderr, InstanceConnectPackageName+" is not installed on the instance, push the key by SSM.")
+		err = sendSSHPublicKeyBySSM(ctx, clients.Commands, instance, username, publickeyFilePath)
+		return err
+	}
+
+	err = sendSSHPublicKey(ctx, clients.Keys, instance, username, publickeyFilePath)
+	var unavailable *InstanceConnectUnavailableError
+	var denied *AccessDeniedError
+	if !errors.As(err, &unavailable) && !errors.As(err, &denied) {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "EC2 Instance Connect is not available, push the key by SSM. (%v)\n", err)
+	err = sendSSHPublicKeyBySSM(ctx, clients.Commands, instance, username, publickeyFilePath)
+	return err
+}
+
+// Whether the Instance Connect package is installed on the instance, according to the applications in the
+// SSM inventory. known is false if the inventory is not collected or cannot be read.
+func instanceConnectInstalled(ctx context.Context, client InventoryLister, instanceID string) (installed, known bool) {
+	if client == nil {
+		return false, false
+	}
+
+	result, err := client.ListInventoryEntries(ctx, &ssm.ListInventoryEntriesInput{
+		InstanceId: aws.String(instanceID),
+		TypeName:   aws.String("AWS:Application"),
+		Filters: []ssmtypes.InventoryFilter{
+			{
+				Key:    aws.String("Name"),
+				Values: []string{InstanceConnectPackageName},
+				Type:   ssmtypes.InventoryQueryOperatorTypeEqual,
+			},
+		},
+	})
+	if err != nil || aws.ToString(result.CaptureTime) == "" {
+		return false, false
+	}
+	return len(result.Entries) > 0, true
+}
+
+func buildSSMKeyPushScript(username, publicKey string, expires time.Time) (script string, err error) {
+	if !validUsernameRe.MatchString(username) {
+		err = errors.New("invalid username: " + username)
+		return "", err
+	}
+
+	// Drop options and the comment of the key, only the key itself is written with the marker.
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(parsed)))
+
+	script = fmt.Sprintf(ssmKeyPushScript,
+		shellQuote(username),
+		shellQuote(key),
+		expires.Unix(),
+		shellQuote(SSMKeyPushMarkerKey),
+		int(SSMKeyPushExpiry/time.Second),
+		shellQuote(ssmKeyPruneScript),
+	)
+	return script, nil
+}
+
+// Quote s as a single word for POSIX sh.
+func shellQuote(s string) (quoted string) {
+	quoted = "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+	return quoted
+}
+
+func sendSSHPublicKeyBySSM(ctx context.Context, client CommandSender, instance *Instance, username, publickeyFilePath string) (err error) {
+	publicKey, err := readPublicKey(publickeyFilePath)
+	if err != nil {
+		return err
+	}
+
+	script, err := buildSSMKeyPushScript(username, publicKey, time.Now().Add(SSMKeyPushExpiry))
+	if err != nil {
+		return err
+	}
+
+	result, err := client.SendCommand(ctx, &ssm.SendCommandInput{
+		InstanceIds:    []string{instance.ID},
+		DocumentName:   aws.String(DocumentNameAwsRunShellScript),
+		Comment:        aws.String("awssh: push ssh public key for " + username),
+		TimeoutSeconds: aws.Int32(int32(SSMKeyPushTimeout / time.Second)),
+		Parameters: map[string][]string{
+			"commands": {script},
+		},
+	})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidInstanceId" {
+			return &TargetNotConnectedError{InstanceID: instance.ID, Err: err}
+		}
+		return wrapAwsError(err, "ssm:SendCommand")
+	}
+
+	commandID := aws.ToString(result.Command.CommandId)
+	invocationInput := &ssm.GetCommandInvocationInput{
+		CommandId:  aws.String(commandID),
+		InstanceId: aws.String(instance.ID),
+	}
+	waiter := ssm.NewCommandExecutedWaiter(client, func(o *ssm.CommandExecutedWaiterOptions) {
+		o.MinDelay = 1 * time.Second
+		o.MaxDelay = 2 * time.Second
+	})
+	waitErr := waiter.Wait(ctx, invocationInput, SSMKeyPushTimeout)
+	if waitErr == nil {
+		return nil
+	}
+
+	invocation, err := client.GetCommandInvocation(ctx, invocationInput)
+	if err != nil {
+		return wrapAwsError(err, "ssm:GetCommandInvocation")
+	}
+	err = &SSMCommandError{
+		InstanceID: instance.ID,
+		CommandID:  commandID,
+		Status:     string(invocation.Status),
+		Stderr:     strings.TrimSpace(aws.ToString(invocation.StandardErrorContent)),
+		ExitStatus: invocation.ResponseCode,
+	}
+	return err
+}
@@ -0,0 +1,244 @@
+package awssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2instanceconnect"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/smithy-go"
+)
+
+type (
+	fakeCommands struct {
+		status ssmtypes.CommandInvocationStatus
+		stderr string
+		sent   *ssm.SendCommandInput
+	}
+	fakeKeys struct {
+		err  error
+		sent *ec2instanceconnect.SendSSHPublicKeyInput
+	}
+	fakeInventory struct {
+		captured bool
+		packages []string
+		err      error
+	}
+)
+
+func (f *fakeCommands) SendCommand(ctx context.Context, params *ssm.SendCommandInput, optFns ...func(*ssm.Options)) (*ssm.SendCommandOutput, error) {
+	f.sent = params
+	return &ssm.SendCommandOutput{Command: &ssmtypes.Command{CommandId: aws.String("command-id")}}, nil
+}
+
+func (f *fakeCommands) GetCommandInvocation(ctx context.Context, params *ssm.GetCommandInvocationInput, optFns ...func(*ssm.Options)) (*ssm.GetCommandInvocationOutput, error) {
+	output := &ssm.GetCommandInvocationOutput{
+		Status:               f.status,
+		StandardErrorContent: aws.String(f.stderr),
+	}
+	if f.status == ssmtypes.CommandInvocationStatusFailed {
+		output.ResponseCode = 1
+	}
+	return output, nil
+}
+
+func (f *fakeKeys) SendSSHPublicKey(ctx context.Context, params *ec2instanceconnect.SendSSHPublicKeyInput, optFns ...func(*ec2instanceconnect.Options)) (*ec2instanceconnect.SendSSHPublicKeyOutput, error) {
+	f.sent = params
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &ec2instanceconnect.SendSSHPublicKeyOutput{Success: true}, nil
+}
+
+func (f *fakeInventory) ListInventoryEntries(ctx context.Context, params *ssm.ListInventoryEntriesInput, optFns ...func(*ssm.Options)) (*ssm.ListInventoryEntriesOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	output := &ssm.ListInventoryEntriesOutput{InstanceId: params.InstanceId, TypeName: params.TypeName}
+	if !f.captured {
+		return output, nil
+	}
+	output.CaptureTime = aws.String("2024-01-01T00:00:00Z")
+	for _, name := range f.packages {
+		if name == params.Filters[0].Values[0] {
+			output.Entries = append(output.Entries, map[string]string{"Name": name})
+		}
+	}
+	return output, nil
+}
+
+func writeTestPublicKey(t *testing.T) (path string) {
+	t.Helper()
+	path = filepath.Join(t.TempDir(), "id_ed25519.pub")
+	if err := os.WriteFile(path, []byte(testPublicKey(t)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidateKeyPushMethod(t *testing.T) {
+	for _, method := range KeyPushMethods {
+		if err := validateKeyPushMethod(method); err != nil {
+			t.Errorf("validateKeyPushMethod(%q) error = %v", method, err)
+		}
+	}
+	if err := validateKeyPushMethod("scp"); err == nil {
+		t.Error("validateKeyPushMethod() error = nil, want error")
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "ec2-user", want: `'ec2-user'`},
+		{input: "it's", want: `'it'"'"'s'`},
+		{input: "$(rm -rf /)", want: `'$(rm -rf /)'`},
+	}
+
+	for _, tt := range tests {
+		if got := shellQuote(tt.input); got != tt.want {
+			t.Errorf("shellQuote(%q) = %s, want %s", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestBuildSSMKeyPushScript(t *testing.T) {
+	publicKey := testPublicKey(t)
+	expires := time.Unix(1700000000, 0)
+
+	script, err := buildSSMKeyPushScript("ec2-user", "no-pty "+strings.TrimSpace(publicKey)+" alice@laptop\n", expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(script, "key='"+strings.TrimSpace(publicKey)+"'\n") {
+		t.Errorf("script does not contain the key without options and comment:\n%s", script)
+	}
+	if !strings.Contains(script, "expires=1700000000\n") || !strings.Contains(script, "sleep 60;") {
+		t.Errorf("script does not contain the expiry:\n%s", script)
+	}
+
+	if _, err := exec.LookPath("sh"); err == nil {
+		if output, err := exec.Command("sh", "-n", "-c", script).CombinedOutput(); err != nil {
+			t.Errorf("script has syntax errors: %v: %s", err, output)
+		}
+	}
+
+	for _, username := range []string{"root; rm -rf /", "$(id)", ""} {
+		if _, err := buildSSMKeyPushScript(username, publicKey, expires); err == nil {
+			t.Errorf("buildSSMKeyPushScript(%q) error = nil, want error", username)
+		}
+	}
+}
+
+func TestSSMKeyPruneScript(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+
+	file := filepath.Join(t.TempDir(), "authorized_keys")
+	now := time.Now().Unix()
+	keys := fmt.Sprintf("ssh-ed25519 AAAA alice\nssh-ed25519 BBBB %[1]s%[2]d\nssh-ed25519 CCCC %[1]s%[3]d\n", SSMKeyPushMarkerKey, now-1, now+60)
+	if err := os.WriteFile(file, []byte(keys), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if output, err := exec.Command("sh", "-c", ssmKeyPruneScript, "sh", SSMKeyPushMarkerKey, file).CombinedOutput(); err != nil {
+		t.Fatalf("prune script error = %v: %s", err, output)
+	}
+
+	got, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("ssh-ed25519 AAAA alice\nssh-ed25519 CCCC %s%d\n", SSMKeyPushMarkerKey, now+60)
+	if string(got) != want {
+		t.Errorf("authorized_keys = %q, want %q", got, want)
+	}
+}
+
+func TestSendSSHPublicKeyBySSM(t *testing.T) {
+	instance := &Instance{ID: "i-0123", AvailabilityZone: "ap-northeast-1a"}
+	publickey := writeTestPublicKey(t)
+
+	client := &fakeCommands{status: ssmtypes.CommandInvocationStatusSuccess}
+	if err := sendSSHPublicKeyBySSM(context.Background(), client, instance, "ec2-user", publickey); err != nil {
+		t.Fatal(err)
+	}
+	if aws.ToString(client.sent.DocumentName) != DocumentNameAwsRunShellScript || client.sent.InstanceIds[0] != "i-0123" {
+		t.Errorf("SendCommand input = %+v", client.sent)
+	}
+
+	failing := &fakeCommands{status: ssmtypes.CommandInvocationStatusFailed, stderr: "user not found: nobody\n"}
+	err := sendSSHPublicKeyBySSM(context.Background(), failing, instance, "nobody", publickey)
+	var commandErr *SSMCommandError
+	if !errors.As(err, &commandErr) {
+		t.Fatalf("sendSSHPublicKeyBySSM() error = %v, want SSMCommandError", err)
+	}
+	if commandErr.Stderr != "user not found: nobody" || commandErr.ExitStatus != 1 || commandErr.CommandID != "command-id" {
+		t.Errorf("SSMCommandError = %+v", commandErr)
+	}
+}
+
+func TestPushPublicKey(t *testing.T) {
+	instance := &Instance{ID: "i-0123", AvailabilityZone: "ap-northeast-1a"}
+	publickey := writeTestPublicKey(t)
+	unavailable := &smithy.GenericAPIError{Code: "EC2InstanceUnavailableException", Message: "unavailable"}
+
+	installed := &fakeInventory{captured: true, packages: []string{"amazon-ssm-agent", InstanceConnectPackageName}}
+	notInstalled := &fakeInventory{captured: true, packages: []string{"amazon-ssm-agent"}}
+
+	tests := []struct {
+		name      string
+		method    string
+		keysErr   error
+		inventory *fakeInventory
+		wantIC    bool
+		wantSSM   bool
+		wantErr   bool
+	}{
+		{name: "instance-connect", method: KeyPushInstanceConnect, wantIC: true},
+		{name: "instance-connect unavailable", method: KeyPushInstanceConnect, keysErr: unavailable, wantIC: true, wantErr: true},
+		{name: "instance-connect not installed", method: KeyPushInstanceConnect, inventory: notInstalled, wantIC: true},
+		{name: "ssm", method: KeyPushSSM, wantSSM: true},
+		{name: "auto", method: KeyPushAuto, wantIC: true},
+		{name: "auto fallback", method: KeyPushAuto, keysErr: unavailable, wantIC: true, wantSSM: true},
+		{name: "auto other error", method: KeyPushAuto, keysErr: errors.New("network error"), wantIC: true, wantErr: true},
+		{name: "auto installed", method: KeyPushAuto, inventory: installed, wantIC: true},
+		{name: "auto not installed", method: KeyPushAuto, inventory: notInstalled, wantSSM: true},
+		{name: "auto inventory not collected", method: KeyPushAuto, inventory: &fakeInventory{}, wantIC: true},
+		{name: "auto inventory denied", method: KeyPushAuto, inventory: &fakeInventory{err: errors.New("AccessDeniedException")}, wantIC: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := &fakeKeys{err: tt.keysErr}
+			commands := &fakeCommands{status: ssmtypes.CommandInvocationStatusSuccess}
+			clients := &Clients{Keys: keys, Commands: commands}
+			if tt.inventory != nil {
+				clients.Inventory = tt.inventory
+			}
+
+			err := pushPublicKey(context.Background(), clients, instance, "ec2-user", publickey, tt.method)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("pushPublicKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (keys.sent != nil) != tt.wantIC {
+				t.Errorf("Instance Connect called = %v, want %v", keys.sent != nil, tt.wantIC)
+			}
+			if (commands.sent != nil) != tt.wantSSM {
+				t.Errorf("SSM called = %v, want %v", commands.sent != nil, tt.wantSSM)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package awssh
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Number of local ports tried from the stable port of the instance if they are in use.
+	LocalPortRetries int = 10
+)
+
+// Local ports to forward to the instance, in the order to try. An empty port means any free port.
+// localPort is used as is. With portRange ("MIN-MAX"), the ports start from the stable port of the instance.
+func localPortCandidates(instanceID, localPort, portRange string) (candidates []string, err error) {
+	if localPort != "" {
+		if err = validatePortNumber(localPort); err != nil {
+			return nil, errors.New("invalid --local-port: " + err.Error())
+		}
+		return []string{localPort}, nil
+	}
+	if portRange == "" {
+		return []string{""}, nil
+	}
+
+	min, max, err := parsePortRange(portRange)
+	if err != nil {
+		return nil, err
+	}
+	size := max - min + 1
+	offset := stableLocalPort(instanceID, min, max) - min
+	for i := 0; i < LocalPortRetries && i < size; i++ {
+		candidates = append(candidates, strconv.Itoa(min+(offset+i)%size))
+	}
+	return candidates, nil
+}
+
+// Parse "MIN-MAX" formatted port range.
+func parsePortRange(portRange string) (min, max int, err error) {
+	bounds := strings.SplitN(portRange, "-", 2)
+	if len(bounds) != 2 || validatePortNumber(bounds[0]) != nil || validatePortNumber(bounds[1]) != nil {
+		err = errors.New("invalid local port range: " + portRange + " (expected MIN-MAX, e.g. 20000-29999)")
+		return 0, 0, err
+	}
+	min, _ = strconv.Atoi(bounds[0])
+	max, _ = strconv.Atoi(bounds[1])
+	if min > max {
+		err = errors.New("invalid local port range: " + portRange + " (MIN is greater than MAX)")
+		return 0, 0, err
+	}
+	return min, max, nil
+}
+
+// Derive the local port of the instance from the hash of the instance-id, so that it is the same every time.
+func stableLocalPort(instanceID string, min, max int) (port int) {
+	h := fnv.New32a()
+	h.Write([]byte(instanceID))
+	port = min + int(h.Sum32()%uint32(max-min+1))
+	return port
+}
+
+// Listen on the local port to keep it while the session is started. Any free port is used if port is empty.
+func reserveLocalPort(host, port string) (listener net.Listener, reserved string, err error) {
+	listener, err = net.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, "", &LocalPortUnavailableError{Port: port, Err: err}
+	}
+	_, reserved, err = net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		listener.Close()
+		return nil, "", err
+	}
+	return listener, reserved, nil
+}
+
+// Start the forward on the first local port of candidates which is not in use.
+func startForwardSessionOnPorts(ctx context.Context, clients *Clients, instanceID string, forward PortForward, candidates []string) (session *ForwardSession, err error) {
+	for _, port := range candidates {
+		forward.LocalPort = port
+		session, err = startPluginSession(ctx, clients, instanceID, forward)
+		var unavailable *LocalPortUnavailableError
+		if !errors.As(err, &unavailable) {
+			return session, err
+		}
+	}
+	return nil, err
+}
+
+// Start the tunnel on the first local port of candidates which is not in use.
+func startTunnelOnPorts(ctx context.Context, clients *Clients, instance *Instance, forward PortForward, candidates []string, onReconnect func(ctx context.Context) error) (tunnel *Tunnel, err error) {
+	for _, port := range candidates {
+		forward.LocalPort = port
+		tunnel, err = startTunnel(ctx, clients, instance.ID, instance.TagName, forward, onReconnect)
+		var unavailable *LocalPortUnavailableError
+		if !errors.As(err, &unavailable) {
+			return tunnel, err
+		}
+	}
+	return nil, err
+}
+
+// Start the forward through EC2 Instance Connect Endpoint on the first local port of candidates which is not in use.
+func startEiceSessionOnPorts(ctx context.Context, clients *Clients, instance *Instance, forward PortForward, candidates []string) (session LocalForward, err error) {
+	for _, port := range candidates {
+		forward.LocalPort = port
+		var eiceSession *EiceSession
+		eiceSession, err = startEiceSession(ctx, clients, instance, forward)
+		if err == nil {
+			return eiceSession, nil
+		}
+		var unavailable *LocalPortUnavailableError
+		if !errors.As(err, &unavailable) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,116 @@
+package awssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestLocalPortCandidates(t *testing.T) {
+	stable := stableLocalPort(testInstanceID, 20000, 20009)
+
+	tests := []struct {
+		name      string
+		localPort string
+		portRange string
+		want      []string
+		wantErr   bool
+	}{
+		{name: "any free port", want: []string{""}},
+		{name: "local port", localPort: "15432", portRange: "20000-29999", want: []string{"15432"}},
+		{name: "invalid local port", localPort: "70000", wantErr: true},
+		{
+			name:      "stable port wraps around the range",
+			portRange: "20000-20009",
+			want: func() (ports []string) {
+				for i := 0; i < 10; i++ {
+					ports = append(ports, strconv.Itoa(20000+(stable-20000+i)%10))
+				}
+				return ports
+			}(),
+		},
+		{name: "single port range", portRange: "20000-20000", want: []string{"20000"}},
+		{name: "invalid range", portRange: "20000", wantErr: true},
+		{name: "reversed range", portRange: "29999-20000", wantErr: true},
+		{name: "out of range", portRange: "0-100", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := localPortCandidates(testInstanceID, tt.localPort, tt.portRange)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("localPortCandidates() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("localPortCandidates() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStableLocalPort(t *testing.T) {
+	port := stableLocalPort("i-0123456789abcdef0", 20000, 29999)
+	if port < 20000 || port > 29999 {
+		t.Errorf("stableLocalPort() = %d, out of the range", port)
+	}
+	if again := stableLocalPort("i-0123456789abcdef0", 20000, 29999); again != port {
+		t.Errorf("stableLocalPort() = %d, then %d", port, again)
+	}
+	if other := stableLocalPort("i-0123456789abcdef1", 20000, 29999); other == port {
+		t.Errorf("stableLocalPort() of other instance = %d, same port", other)
+	}
+}
+
+func TestReserveLocalPort(t *testing.T) {
+	listener, port, err := reserveLocalPort(ConnectHost, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if validatePortNumber(port) != nil {
+		t.Errorf("reserveLocalPort() = %q, want a port number", port)
+	}
+
+	_, _, err = reserveLocalPort(ConnectHost, port)
+	var unavailable *LocalPortUnavailableError
+	if !errors.As(err, &unavailable) || unavailable.Port != port {
+		t.Errorf("reserveLocalPort() error = %v, want LocalPortUnavailableError", err)
+	}
+	if ExitCode(err) != ExitCodeLocalPortUnavailable {
+		t.Errorf("ExitCode() = %d, want %d", ExitCode(err), ExitCodeLocalPortUnavailable)
+	}
+}
+
+func TestStartForwardSessionOnPorts(t *testing.T) {
+	setupFakeCommands(t)
+	clients, _ := newFakeAwsClients(t)
+
+	taken, err := net.Listen("tcp", ConnectHost+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	_, takenPort, _ := net.SplitHostPort(taken.Addr().String())
+	freePort, err := fetchEmptyPort(ConnectHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := startForwardSessionOnPorts(context.Background(), clients, testInstanceID, PortForward{RemotePort: "22"}, []string{takenPort, freePort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Stop()
+	if session.LocalPort != freePort {
+		t.Errorf("local port = %s, want %s", session.LocalPort, freePort)
+	}
+
+	_, err = startForwardSessionOnPorts(context.Background(), clients, testInstanceID, PortForward{RemotePort: "22"}, []string{takenPort})
+	var unavailable *LocalPortUnavailableError
+	if !errors.As(err, &unavailable) {
+		t.Errorf("startForwardSessionOnPorts() error = %v, want LocalPortUnavailableError", err)
+	}
+}
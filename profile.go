@@ -0,0 +1,212 @@
+package awssh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	ini "gopkg.in/ini.v1"
+)
+
+const (
+	AwsConfigFilePath      string = "~/.aws/config"
+	AwsCredentialsFilePath string = "~/.aws/credentials"
+	maxSourceProfileDepth  int    = 10
+)
+
+type (
+	// ProfileConfig is the resolved settings of a shared config profile which affect the credentials.
+	ProfileConfig struct {
+		Name             string
+		SourceProfile    string
+		CredentialSource string
+		RoleArn          string
+		RoleSessionName  string
+		ExternalID       string
+		MfaSerial        string
+		Region           string
+		DurationSeconds  int
+		SourceRoleArns   []string
+
+		// IAM Identity Center settings of the profile which holds the credentials.
+		SSOSession            string
+		SSOStartURL           string
+		SSORegion             string
+		SSOAccountID          string
+		SSORoleName           string
+		SSORegistrationScopes []string
+	}
+	cacheKeyMaterial struct {
+		SourceProfile    string   `json:"source_profile"`
+		CredentialSource string   `json:"credential_source"`
+		RoleArn          string   `json:"role_arn"`
+		ExternalID       string   `json:"external_id"`
+		MfaSerial        string   `json:"mfa_serial"`
+		Region           string   `json:"region"`
+		SourceRoleArns   []string `json:"source_role_arns"`
+		SSOStartURL      string   `json:"sso_start_url"`
+		SSOAccountID     string   `json:"sso_account_id"`
+		SSORoleName      string   `json:"sso_role_name"`
+	}
+)
+
+func awsConfigFiles() (configFile, credentialsFile string, err error) {
+	configFile = os.Getenv("AWS_CONFIG_FILE")
+	if configFile == "" {
+		configFile = AwsConfigFilePath
+	}
+	credentialsFile = os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if credentialsFile == "" {
+		credentialsFile = AwsCredentialsFilePath
+	}
+
+	if configFile, err = homedir.Expand(configFile); err != nil {
+		return "", "", err
+	}
+	if credentialsFile, err = homedir.Expand(credentialsFile); err != nil {
+		return "", "", err
+	}
+	return configFile, credentialsFile, nil
+}
+
+// Look up a key of the profile. The credentials file takes precedence over the config file like the AWS CLI.
+func profileValue(configIni, credentialsIni *ini.File, profile, key string) (value string) {
+	if section, err := credentialsIni.GetSection(profile); err == nil && section.HasKey(key) {
+		return section.Key(key).String()
+	}
+
+	sectionName := "profile " + profile
+	if profile == "default" {
+		if _, err := configIni.GetSection(sectionName); err != nil {
+			sectionName = "default"
+		}
+	}
+	if section, err := configIni.GetSection(sectionName); err == nil && section.HasKey(key) {
+		return section.Key(key).String()
+	}
+
+	return ""
+}
+
+func ssoSessionValue(configIni *ini.File, name, key string) (value string) {
+	if section, err := configIni.GetSection("sso-session " + name); err == nil && section.HasKey(key) {
+		return section.Key(key).String()
+	}
+	return ""
+}
+
+func ResolveProfileConfig(profile string) (pc *ProfileConfig, err error) {
+	configFile, credentialsFile, err := awsConfigFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	configIni, err := ini.LoadSources(ini.LoadOptions{Loose: true}, configFile)
+	if err != nil {
+		return nil, err
+	}
+	credentialsIni, err := ini.LoadSources(ini.LoadOptions{Loose: true}, credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pc = &ProfileConfig{
+		Name:             profile,
+		RoleArn:          profileValue(configIni, credentialsIni, profile, "role_arn"),
+		RoleSessionName:  profileValue(configIni, credentialsIni, profile, "role_session_name"),
+		ExternalID:       profileValue(configIni, credentialsIni, profile, "external_id"),
+		MfaSerial:        profileValue(configIni, credentialsIni, profile, "mfa_serial"),
+		CredentialSource: profileValue(configIni, credentialsIni, profile, "credential_source"),
+		Region:           profileValue(configIni, credentialsIni, profile, "region"),
+	}
+	if durationSeconds := profileValue(configIni, credentialsIni, profile, "duration_seconds"); durationSeconds != "" {
+		if pc.DurationSeconds, err = strconv.Atoi(durationSeconds); err != nil {
+			return nil, err
+		}
+	}
+
+	// Follow source_profile to the profile which holds the credentials.
+	sourceProfile := profileValue(configIni, credentialsIni, profile, "source_profile")
+	for depth := 0; sourceProfile != ""; depth++ {
+		if depth >= maxSourceProfileDepth {
+			err = errors.New("source_profile chain is too deep: " + profile)
+			return nil, err
+		}
+
+		pc.SourceProfile = sourceProfile
+		next := profileValue(configIni, credentialsIni, sourceProfile, "source_profile")
+		if next == sourceProfile {
+			break
+		}
+		if roleArn := profileValue(configIni, credentialsIni, sourceProfile, "role_arn"); roleArn != "" && next != "" {
+			pc.SourceRoleArns = append(pc.SourceRoleArns, roleArn)
+		}
+		if credentialSource := profileValue(configIni, credentialsIni, sourceProfile, "credential_source"); credentialSource != "" {
+			pc.CredentialSource = credentialSource
+		}
+		sourceProfile = next
+	}
+
+	credentialsProfile := profile
+	if pc.SourceProfile != "" {
+		credentialsProfile = pc.SourceProfile
+	}
+	pc.SSOSession = profileValue(configIni, credentialsIni, credentialsProfile, "sso_session")
+	pc.SSOAccountID = profileValue(configIni, credentialsIni, credentialsProfile, "sso_account_id")
+	pc.SSORoleName = profileValue(configIni, credentialsIni, credentialsProfile, "sso_role_name")
+	if pc.SSOSession != "" {
+		pc.SSOStartURL = ssoSessionValue(configIni, pc.SSOSession, "sso_start_url")
+		pc.SSORegion = ssoSessionValue(configIni, pc.SSOSession, "sso_region")
+		if scopes := ssoSessionValue(configIni, pc.SSOSession, "sso_registration_scopes"); scopes != "" {
+			for _, scope := range strings.Split(scopes, ",") {
+				pc.SSORegistrationScopes = append(pc.SSORegistrationScopes, strings.TrimSpace(scope))
+			}
+		}
+	} else {
+		pc.SSOStartURL = profileValue(configIni, credentialsIni, credentialsProfile, "sso_start_url")
+		pc.SSORegion = profileValue(configIni, credentialsIni, credentialsProfile, "sso_region")
+	}
+
+	if region := os.Getenv("AWS_DEFAULT_REGION"); region != "" {
+		pc.Region = region
+	}
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		pc.Region = region
+	}
+
+	return pc, nil
+}
+
+// Hash of the settings which identify the credentials. It changes when the profile config is edited.
+func (pc *ProfileConfig) CacheKey() (key string) {
+	material := cacheKeyMaterial{
+		SourceProfile:    pc.SourceProfile,
+		CredentialSource: pc.CredentialSource,
+		RoleArn:          pc.RoleArn,
+		ExternalID:       pc.ExternalID,
+		MfaSerial:        pc.MfaSerial,
+		Region:           pc.Region,
+		SourceRoleArns:   pc.SourceRoleArns,
+		SSOStartURL:      pc.SSOStartURL,
+		SSOAccountID:     pc.SSOAccountID,
+		SSORoleName:      pc.SSORoleName,
+	}
+	if material.SourceProfile == "" && material.CredentialSource == "" {
+		material.SourceProfile = pc.Name
+	}
+
+	data, _ := json.Marshal(material)
+	sum := sha256.Sum256(data)
+	key = hex.EncodeToString(sum[:])
+	return key
+}
+
+func (pc *ProfileConfig) IsSSO() (sso bool) {
+	sso = pc.SSOStartURL != "" && pc.SSOAccountID != "" && pc.SSORoleName != ""
+	return sso
+}
@@ -0,0 +1,214 @@
+package awssh
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testAwsConfig = `
+[default]
+region = us-east-1
+
+[profile base]
+region = ap-northeast-1
+
+[profile admin]
+role_arn = arn:aws:iam::123456789012:role/admin
+source_profile = base
+mfa_serial = arn:aws:iam::123456789012:mfa/alice
+duration_seconds = 3600
+
+[profile chained]
+role_arn = arn:aws:iam::210987654321:role/readonly
+source_profile = admin
+
+[profile ec2]
+role_arn = arn:aws:iam::123456789012:role/ec2
+credential_source = Ec2InstanceMetadata
+
+[profile sso]
+sso_session = company
+sso_account_id = 123456789012
+sso_role_name = Admin
+region = us-west-2
+
+[profile sso-legacy]
+sso_start_url = https://legacy.awsapps.com/start
+sso_region = eu-west-1
+sso_account_id = 123456789012
+sso_role_name = ReadOnly
+
+[sso-session company]
+sso_start_url = https://company.awsapps.com/start
+sso_region = us-east-1
+sso_registration_scopes = sso:account:access, codewhisperer:completions
+
+[profile loop]
+source_profile = loop-a
+
+[profile loop-a]
+source_profile = loop-b
+
+[profile loop-b]
+source_profile = loop-a
+`
+
+const testAwsCredentials = `
+[base]
+aws_access_key_id = AKIAEXAMPLE
+aws_secret_access_key = secret
+`
+
+func setupAwsConfig(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+
+	configFile := filepath.Join(dir, "config")
+	credentialsFile := filepath.Join(dir, "credentials")
+	if err := os.WriteFile(configFile, []byte(testAwsConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(credentialsFile, []byte(testAwsCredentials), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("AWS_CONFIG_FILE", configFile)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsFile)
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+}
+
+func TestResolveProfileConfig(t *testing.T) {
+	setupAwsConfig(t)
+
+	tests := []struct {
+		profile string
+		want    *ProfileConfig
+	}{
+		{
+			profile: "default",
+			want:    &ProfileConfig{Name: "default", Region: "us-east-1"},
+		},
+		{
+			profile: "admin",
+			want: &ProfileConfig{
+				Name:            "admin",
+				SourceProfile:   "base",
+				RoleArn:         "arn:aws:iam::123456789012:role/admin",
+				MfaSerial:       "arn:aws:iam::123456789012:mfa/alice",
+				DurationSeconds: 3600,
+			},
+		},
+		{
+			profile: "chained",
+			want: &ProfileConfig{
+				Name:           "chained",
+				SourceProfile:  "base",
+				RoleArn:        "arn:aws:iam::210987654321:role/readonly",
+				SourceRoleArns: []string{"arn:aws:iam::123456789012:role/admin"},
+			},
+		},
+		{
+			profile: "ec2",
+			want: &ProfileConfig{
+				Name:             "ec2",
+				RoleArn:          "arn:aws:iam::123456789012:role/ec2",
+				CredentialSource: "Ec2InstanceMetadata",
+			},
+		},
+		{
+			profile: "sso",
+			want: &ProfileConfig{
+				Name:                  "sso",
+				Region:                "us-west-2",
+				SSOSession:            "company",
+				SSOStartURL:           "https://company.awsapps.com/start",
+				SSORegion:             "us-east-1",
+				SSOAccountID:          "123456789012",
+				SSORoleName:           "Admin",
+				SSORegistrationScopes: []string{"sso:account:access", "codewhisperer:completions"},
+			},
+		},
+		{
+			profile: "sso-legacy",
+			want: &ProfileConfig{
+				Name:         "sso-legacy",
+				SSOStartURL:  "https://legacy.awsapps.com/start",
+				SSORegion:    "eu-west-1",
+				SSOAccountID: "123456789012",
+				SSORoleName:  "ReadOnly",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.profile, func(t *testing.T) {
+			got, err := ResolveProfileConfig(tt.profile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ResolveProfileConfig() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveProfileConfigLoop(t *testing.T) {
+	setupAwsConfig(t)
+
+	if _, err := ResolveProfileConfig("loop"); err == nil {
+		t.Error("ResolveProfileConfig() error = nil, want error")
+	}
+}
+
+func TestResolveProfileConfigRegionEnv(t *testing.T) {
+	setupAwsConfig(t)
+	t.Setenv("AWS_DEFAULT_REGION", "eu-central-1")
+
+	pc, err := ResolveProfileConfig("sso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pc.Region != "eu-central-1" {
+		t.Errorf("Region = %q, want eu-central-1", pc.Region)
+	}
+
+	t.Setenv("AWS_REGION", "sa-east-1")
+	if pc, _ = ResolveProfileConfig("sso"); pc.Region != "sa-east-1" {
+		t.Errorf("Region = %q, want sa-east-1", pc.Region)
+	}
+}
+
+func TestProfileConfigCacheKey(t *testing.T) {
+	base := ProfileConfig{Name: "admin", SourceProfile: "base", RoleArn: "arn:aws:iam::123456789012:role/admin"}
+
+	renamed := base
+	renamed.Name = "renamed"
+	if base.CacheKey() != renamed.CacheKey() {
+		t.Error("CacheKey() changed by the profile name of an assume role profile")
+	}
+
+	edited := base
+	edited.RoleArn = "arn:aws:iam::123456789012:role/other"
+	if base.CacheKey() == edited.CacheKey() {
+		t.Error("CacheKey() did not change when role_arn changed")
+	}
+
+	static1 := ProfileConfig{Name: "one"}
+	static2 := ProfileConfig{Name: "two"}
+	if static1.CacheKey() == static2.CacheKey() {
+		t.Error("CacheKey() is the same for different profiles without source_profile")
+	}
+}
+
+func TestProfileConfigIsSSO(t *testing.T) {
+	if (&ProfileConfig{SSOStartURL: "https://example.awsapps.com/start", SSOAccountID: "1", SSORoleName: "r"}).IsSSO() != true {
+		t.Error("IsSSO() = false, want true")
+	}
+	if (&ProfileConfig{SSOStartURL: "https://example.awsapps.com/start"}).IsSSO() != false {
+		t.Error("IsSSO() = true, want false")
+	}
+}
@@ -0,0 +1,183 @@
+package awssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+// Serializes the changes of the umask of the process.
+var umaskMutex sync.Mutex
+
+type (
+	// LocalProxy accepts connections on the local address of a forward and proxies them to
+	// session-manager-plugin listening on the loopback address, or to the connections dial opens.
+	// Transferred bytes are counted.
+	LocalProxy struct {
+		listener net.Listener
+		dial     func() (net.Conn, error)
+
+		bytesIn  int64
+		bytesOut int64
+	}
+
+	countingWriter struct {
+		w io.Writer
+		n *int64
+	}
+)
+
+func (w *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = w.w.Write(p)
+	atomic.AddInt64(w.n, int64(n))
+	return n, err
+}
+
+// Listen on the local address of the forward. The local port is set to the forward if it is empty.
+// Unix domain sockets are only accessible by the user. A socket left by a dead process is removed.
+func listenLocal(forward *PortForward) (listener net.Listener, err error) {
+	if forward.LocalSocket == "" {
+		listener, err = net.Listen("tcp", net.JoinHostPort(forward.Bind(), forward.LocalPort))
+		if err != nil {
+			return nil, &LocalPortUnavailableError{Port: forward.LocalPort, Err: err}
+		}
+		_, forward.LocalPort, err = net.SplitHostPort(listener.Addr().String())
+		return listener, err
+	}
+
+	path, err := homedir.Expand(forward.LocalSocket)
+	if err != nil {
+		return nil, err
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, &LocalPortUnavailableError{Port: path, Err: errors.New("socket is in use")}
+	}
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	listener, err = listenUnix(path)
+	if err != nil {
+		return nil, &LocalPortUnavailableError{Port: path, Err: err}
+	}
+	forward.LocalSocket = path
+	return listener, nil
+}
+
+// Listen on the Unix domain socket only the user can connect to. The umask is restricted while the socket
+// is created, so others cannot connect to it before its permissions are set. The umask is per process,
+// so it only removes the permissions of others, which files created meanwhile by other goroutines do not need.
+func listenUnix(path string) (listener net.Listener, err error) {
+	umaskMutex.Lock()
+	umask := syscall.Umask(0077)
+	listener, err = net.Listen("unix", path)
+	syscall.Umask(umask)
+	umaskMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Warn that the forwarded port is reachable from other hosts if it is not bound to a loopback address.
+func warnBindAddress(bind string) {
+	if bind == "" || bind == "localhost" {
+		return
+	}
+	if ip := net.ParseIP(bind); ip != nil && ip.IsLoopback() {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Warning: --bind %s exposes the forwarded ports to other hosts. Anyone who can reach them can connect to the instance.\n", bind)
+}
+
+// NewLocalProxy proxies connections to the address target returns. It returns an empty string while there is
+// no session, and connections are closed then.
+func NewLocalProxy(listener net.Listener, target func() string) (p *LocalProxy) {
+	dial := func() (net.Conn, error) {
+		address := target()
+		if address == "" {
+			return nil, errors.New("no session")
+		}
+		return net.Dial("tcp", address)
+	}
+	p = NewLocalProxyWithDialer(listener, dial)
+	return p
+}
+
+// NewLocalProxyWithDialer proxies each connection to a new connection opened by dial. Connections are closed
+// if dial fails.
+func NewLocalProxyWithDialer(listener net.Listener, dial func() (net.Conn, error)) (p *LocalProxy) {
+	p = &LocalProxy{
+		listener: listener,
+		dial:     dial,
+	}
+	return p
+}
+
+// Serve proxies connections until the listener is closed.
+func (p *LocalProxy) Serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.proxy(conn)
+	}
+}
+
+func (p *LocalProxy) Close() error {
+	return p.listener.Close()
+}
+
+func (p *LocalProxy) BytesIn() int64 {
+	return atomic.LoadInt64(&p.bytesIn)
+}
+
+func (p *LocalProxy) BytesOut() int64 {
+	return atomic.LoadInt64(&p.bytesOut)
+}
+
+func (p *LocalProxy) proxy(conn net.Conn) {
+	defer conn.Close()
+
+	upstream, err := p.dial()
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(&countingWriter{w: upstream, n: &p.bytesOut}, conn)
+		closeWrite(upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(&countingWriter{w: conn, n: &p.bytesIn}, upstream)
+		closeWrite(conn)
+	}()
+	wg.Wait()
+}
+
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+		return
+	}
+	conn.Close()
+}
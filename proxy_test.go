@@ -0,0 +1,140 @@
+package awssh
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestListenLocalUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.sock")
+
+	// A socket file left by a dead process.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	forward := PortForward{LocalSocket: path, RemotePort: "5432"}
+	listener, err := listenLocal(&forward)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("socket permission = %o, want 600", perm)
+	}
+
+	_, err = listenLocal(&PortForward{LocalSocket: path})
+	var unavailable *LocalPortUnavailableError
+	if !errors.As(err, &unavailable) {
+		t.Errorf("listenLocal() of the socket in use error = %v, want LocalPortUnavailableError", err)
+	}
+}
+
+func TestListenUnixUmask(t *testing.T) {
+	umask := syscall.Umask(0)
+	defer syscall.Umask(umask)
+
+	path := filepath.Join(t.TempDir(), "db.sock")
+	listener, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("socket permission = %o, want 600", perm)
+	}
+	if restored := syscall.Umask(0); restored != 0 {
+		t.Errorf("umask = %o after listen, want restored 0", restored)
+	}
+}
+
+func TestListenLocalBind(t *testing.T) {
+	forward := PortForward{BindAddress: "::1", RemotePort: "5432"}
+	listener, err := listenLocal(&forward)
+	if err != nil {
+		t.Skipf("IPv6 loopback is not available: %v", err)
+	}
+	defer listener.Close()
+
+	if forward.LocalPort == "" || listener.Addr().String() != forward.Local() {
+		t.Errorf("listen on %s, forward %s", listener.Addr(), forward.Local())
+	}
+}
+
+func TestLocalProxy(t *testing.T) {
+	upstream, err := net.Listen("tcp", ConnectHost+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	listener, err := net.Listen("tcp", ConnectHost+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var target atomic.Value
+	target.Store("")
+	proxy := NewLocalProxy(listener, func() string { return target.Load().(string) })
+	go proxy.Serve()
+	defer proxy.Close()
+
+	// Connections are closed while there is no target.
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read without target error = %v, want EOF", err)
+	}
+	conn.Close()
+
+	target.Store(upstream.Addr().String())
+	conn, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("hello"))
+	conn.(*net.TCPConn).CloseWrite()
+	data, err := io.ReadAll(conn)
+	if err != nil || string(data) != "hello" {
+		t.Errorf("read %q, %v", data, err)
+	}
+	conn.Close()
+
+	if proxy.BytesIn() != 5 || proxy.BytesOut() != 5 {
+		t.Errorf("bytes in %d out %d, want 5", proxy.BytesIn(), proxy.BytesOut())
+	}
+}
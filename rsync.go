@@ -0,0 +1,181 @@
+package awssh
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	CmdRsync string = "rsync"
+
+	// Short options of rsync which take a value, which is the rest of the arg or the next arg.
+	rsyncShortOptionsWithValue string = "efBTM@"
+)
+
+// Long options of rsync which take a value, which is the next arg unless it is given as "--option=value".
+var rsyncLongOptionsWithValue = map[string]bool{
+	"--address": true, "--backup-dir": true, "--block-size": true, "--bwlimit": true, "--cc": true,
+	"--checksum-choice": true, "--checksum-seed": true, "--chmod": true, "--chown": true, "--compare-dest": true,
+	"--compress-choice": true, "--compress-level": true, "--contimeout": true, "--copy-as": true, "--copy-dest": true,
+	"--debug": true, "--exclude": true, "--exclude-from": true, "--files-from": true, "--filter": true,
+	"--groupmap": true, "--iconv": true, "--include": true, "--include-from": true, "--info": true,
+	"--link-dest": true, "--log-file": true, "--log-file-format": true, "--max-alloc": true, "--max-delete": true,
+	"--max-size": true, "--min-size": true, "--modify-window": true, "--only-write-batch": true, "--out-format": true,
+	"--outbuf": true, "--partial-dir": true, "--password-file": true, "--port": true, "--protocol": true,
+	"--read-batch": true, "--remote-option": true, "--rsh": true, "--rsync-path": true, "--skip-compress": true,
+	"--sockopts": true, "--stderr": true, "--stop-after": true, "--stop-at": true, "--suffix": true,
+	"--temp-dir": true, "--time-limit": true, "--timeout": true, "--usermap": true, "--write-batch": true,
+	"--zc": true, "--zl": true,
+}
+
+// Split the args of the rsync command into the flags of awssh before "--" and the args of rsync.
+// All the args are passed to rsync if there is no "--".
+func splitRsyncArgs(args []string) (awsshArgs, rsyncArgs []string) {
+	for i, arg := range args {
+		if arg == "--" {
+			return args[:i], args[i+1:]
+		}
+	}
+	return nil, args
+}
+
+// Return the indexes of the paths in the args of rsync, skipping the options and their values.
+// The args after "--" are all paths. The remote shell cannot be set since awssh sets it.
+func rsyncPathIndexes(args []string) (indexes []int, err error) {
+	rshErr := errors.New("awssh sets the remote shell of rsync, -e and --rsh cannot be used")
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			for j := i + 1; j < len(args); j++ {
+				indexes = append(indexes, j)
+			}
+			return indexes, nil
+		case strings.HasPrefix(arg, "--"):
+			name := strings.SplitN(arg, "=", 2)[0]
+			if name == "--rsh" {
+				return nil, rshErr
+			}
+			if rsyncLongOptionsWithValue[name] && !strings.Contains(arg, "=") {
+				i++
+			}
+		case strings.HasPrefix(arg, "-") && arg != "-":
+			for j, c := range arg[1:] {
+				if c == 'e' {
+					return nil, rshErr
+				}
+				if strings.ContainsRune(rsyncShortOptionsWithValue, c) {
+					// The value is the rest of the arg, or the next arg.
+					if j == len(arg)-2 {
+						i++
+					}
+					break
+				}
+			}
+		default:
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes, nil
+}
+
+// Find the instance of "INSTANCE:PATH" in the args of rsync. All the remote paths must be on the same instance.
+func rsyncRemoteInstance(args []string) (instance string, err error) {
+	indexes, err := rsyncPathIndexes(args)
+	if err != nil {
+		return "", err
+	}
+
+	for _, i := range indexes {
+		remote := parseRemotePath(args[i])
+		if remote == nil {
+			continue
+		}
+		if instance != "" && remote.Instance != instance {
+			err = errors.New("syncing between instances is not supported: " + instance + ", " + remote.Instance)
+			return "", err
+		}
+		instance = remote.Instance
+	}
+
+	if instance == "" {
+		err = errors.New("either the source or the destination of rsync must be INSTANCE:PATH")
+		return "", err
+	}
+	return instance, nil
+}
+
+// The remote shell of rsync to connect to the local port. The host name of rsync is the instance-id, which
+// ssh resolves to the local port, so known_hosts and rsync see the same host whichever local port is used.
+func rsyncRemoteShell(instanceID, port string, options []string) (rsh string) {
+	sshCommand := viper.GetString("ssh-command")
+	if sshCommand == "" {
+		sshCommand = CmdSsh
+	}
+
+	args := append([]string{sshCommand}, options...)
+	args = append(args, "-o", "HostName="+ConnectHost, "-o", "HostKeyAlias="+instanceID, "-p", port, "-i", viper.GetString("identity-file"))
+	quoted := []string{}
+	for _, arg := range args {
+		quoted = append(quoted, quoteRsyncArg(arg))
+	}
+	rsh = strings.Join(quoted, " ")
+	return rsh
+}
+
+// rsync splits the remote shell by spaces, honoring single and double quotes.
+func quoteRsyncArg(arg string) (quoted string) {
+	if arg != "" && !strings.ContainsAny(arg, " \t'\"") {
+		return arg
+	}
+	quoted = "'" + strings.Replace(arg, "'", `'"'"'`, -1) + "'"
+	return quoted
+}
+
+// RsyncWithClients runs rsync with the args through the port forwarding to the instance of "INSTANCE:PATH".
+func RsyncWithClients(ctx context.Context, clients *Clients, args []string) (err error) {
+	name, err := rsyncRemoteInstance(args)
+	if err != nil {
+		return err
+	}
+
+	instance, err := findInstance(ctx, clients, name)
+	if err != nil {
+		return err
+	}
+
+	options, err := sshOptions()
+	if err != nil {
+		return err
+	}
+
+	session, err := startSshSession(ctx, clients, instance)
+	if err != nil {
+		return err
+	}
+	defer session.Stop()
+
+	indexes, err := rsyncPathIndexes(args)
+	if err != nil {
+		return err
+	}
+	args = append([]string{}, args...)
+	for _, i := range indexes {
+		if remote := parseRemotePath(args[i]); remote != nil {
+			args[i] = viper.GetString("username") + "@" + instance.ID + ":" + remote.Path
+		}
+	}
+	rsyncArgs := append([]string{"-e", rsyncRemoteShell(instance.ID, session.Forward().LocalPort, options)}, args...)
+
+	cmdRsync, err := execExternalCommand(ctx, CmdRsync, rsyncArgs)
+	if err != nil {
+		return err
+	}
+
+	err = commandExitError(cmdRsync.Wait())
+	return err
+}
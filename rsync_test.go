@@ -0,0 +1,109 @@
+package awssh
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestSplitRsyncArgs(t *testing.T) {
+	awsshArgs, rsyncArgs := splitRsyncArgs([]string{"--profile", "prod", "--", "-avz", "web:/var/log", "./logs"})
+	if !reflect.DeepEqual(awsshArgs, []string{"--profile", "prod"}) || !reflect.DeepEqual(rsyncArgs, []string{"-avz", "web:/var/log", "./logs"}) {
+		t.Errorf("splitRsyncArgs() = %v, %v", awsshArgs, rsyncArgs)
+	}
+
+	awsshArgs, rsyncArgs = splitRsyncArgs([]string{"-avz", "--delete", "./dist/", "web:/srv/app"})
+	if awsshArgs != nil || !reflect.DeepEqual(rsyncArgs, []string{"-avz", "--delete", "./dist/", "web:/srv/app"}) {
+		t.Errorf("splitRsyncArgs() without -- = %v, %v", awsshArgs, rsyncArgs)
+	}
+}
+
+func TestRsyncRemoteInstance(t *testing.T) {
+	tests := []struct {
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{args: []string{"-avz", "web:/var/log", "./logs"}, want: "web"},
+		{args: []string{"--exclude=*.tmp", "./dist/", "i-0123456789abcdef0:/srv/app"}, want: "i-0123456789abcdef0"},
+		{args: []string{"web:/a", "web:/b", "./c"}, want: "web"},
+		{args: []string{"web:/a", "db:/b", "./c"}, wantErr: true},
+		{args: []string{"-av", "./a", "./b"}, wantErr: true},
+		{args: []string{"-e", "ssh -p 2222", "web:/a", "./b"}, wantErr: true},
+		{args: []string{"--rsh=ssh", "web:/a", "./b"}, wantErr: true},
+		{args: []string{"-avze", "ssh", "web:/a", "./b"}, wantErr: true},
+		{args: []string{"--exclude", "db:cache", "web:/a", "./b"}, want: "web"},
+		{args: []string{"--exclude", "db:cache", "./a", "./b"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := rsyncRemoteInstance(tt.args)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("rsyncRemoteInstance(%v) = %q, %v", tt.args, got, err)
+		}
+	}
+}
+
+func TestRsyncPathIndexes(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    []int
+		wantErr bool
+	}{
+		{name: "paths", args: []string{"-avz", "web:/a", "./b"}, want: []int{1, 2}},
+		{name: "long option value", args: []string{"--exclude", "a:b", "--filter", "- c:d", "web:/a", "./b"}, want: []int{4, 5}},
+		{name: "long option with =", args: []string{"--exclude=a:b", "web:/a", "./b"}, want: []int{1, 2}},
+		{name: "long option without value", args: []string{"--delete", "web:/a", "./b"}, want: []int{1, 2}},
+		{name: "short option value", args: []string{"-f", "- a:b", "-avT", "/tmp/x", "web:/a", "./b"}, want: []int{4, 5}},
+		{name: "short option value in the arg", args: []string{"-avf- a:b", "web:/a", "./b"}, want: []int{1, 2}},
+		{name: "after --", args: []string{"-av", "--", "-web:/a", "./b"}, want: []int{2, 3}},
+		{name: "stdin", args: []string{"--files-from", "-", "-", "web:/a"}, want: []int{2, 3}},
+		{name: "-e", args: []string{"-e", "ssh", "web:/a", "./b"}, wantErr: true},
+		{name: "-e in a cluster", args: []string{"-ave", "ssh", "web:/a", "./b"}, wantErr: true},
+		{name: "--rsh", args: []string{"--rsh", "ssh", "web:/a", "./b"}, wantErr: true},
+		{name: "-e as a value", args: []string{"--exclude", "-e", "web:/a", "./b"}, want: []int{2, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rsyncPathIndexes(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("rsyncPathIndexes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rsyncPathIndexes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRsyncRemoteShell(t *testing.T) {
+	t.Cleanup(viper.Reset)
+	viper.Set("identity-file", "/home/alice/My Keys/id_ed25519")
+
+	got := rsyncRemoteShell("i-0123456789abcdef0", "20022", []string{"-o", "ServerAliveInterval=30"})
+	want := `ssh -o ServerAliveInterval=30 -o HostName=127.0.0.1 -o HostKeyAlias=i-0123456789abcdef0 -p 20022 -i '/home/alice/My Keys/id_ed25519'`
+	if got != want {
+		t.Errorf("rsyncRemoteShell() = %s, want %s", got, want)
+	}
+}
+
+func TestQuoteRsyncArg(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want string
+	}{
+		{"-p", "-p"},
+		{"a b", "'a b'"},
+		{"it's", `'it'"'"'s'`},
+		{"", "''"},
+	}
+
+	for _, tt := range tests {
+		if got := quoteRsyncArg(tt.arg); got != tt.want {
+			t.Errorf("quoteRsyncArg(%q) = %s, want %s", tt.arg, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package awssh
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+var (
+	// Signals which stop awssh. The child processes get the same signal, and the sessions are terminated before exiting.
+	StopSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}
+
+	// Signals the terminal sends to the foreground process group, such as Ctrl-C. They are ignored by awssh
+	// while an interactive child owns the terminal, since the child handles them itself.
+	TerminalSignals = []os.Signal{os.Interrupt, syscall.SIGQUIT, syscall.SIGTSTP}
+
+	// The number of interactive children running in the foreground.
+	foregroundChildren int32
+)
+
+type (
+	// StopSignalError is the cause of the context cancelled by a received signal.
+	StopSignalError struct {
+		Signal os.Signal
+	}
+)
+
+func (e *StopSignalError) Error() string {
+	return "received " + e.Signal.String()
+}
+
+// Return a copy of parent which is cancelled with StopSignalError when one of StopSignals is received.
+// The commands started with the context are stopped by the same signal. TerminalSignals are skipped while
+// an interactive child runs in the foreground, so only SIGTERM and SIGHUP stop it.
+func notifyStop(parent context.Context) (ctx context.Context, stop context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, StopSignals...)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if isTerminalSignal(sig) && atomic.LoadInt32(&foregroundChildren) > 0 {
+					continue
+				}
+				cancel(&StopSignalError{Signal: sig})
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	stop = func() {
+		signal.Stop(signals)
+		cancel(nil)
+	}
+	return ctx, stop
+}
+
+// The signal to stop the child processes when ctx is done. It is SIGTERM unless ctx is cancelled by a signal.
+func stopSignalOf(ctx context.Context) (sig os.Signal) {
+	var stopErr *StopSignalError
+	if errors.As(context.Cause(ctx), &stopErr) {
+		return stopErr.Signal
+	}
+	return syscall.SIGTERM
+}
+
+// Ignore TerminalSignals while an interactive child such as ssh or the shell session of session-manager-plugin
+// owns the terminal. The child gets them from the terminal and handles them itself, for example Ctrl-C is sent
+// to the remote shell. The signals are caught instead of ignored, so that the child does not inherit SIG_IGN.
+// Call release after the child exited.
+func holdTerminalSignals() (release func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, TerminalSignals...)
+	atomic.AddInt32(&foregroundChildren, 1)
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-signals:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	release = func() {
+		atomic.AddInt32(&foregroundChildren, -1)
+		signal.Stop(signals)
+		close(done)
+	}
+	return release
+}
+
+func isTerminalSignal(sig os.Signal) bool {
+	for _, s := range TerminalSignals {
+		if sig == s {
+			return true
+		}
+	}
+	return false
+}
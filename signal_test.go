@@ -0,0 +1,88 @@
+package awssh
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNotifyStop(t *testing.T) {
+	ctx, stop := notifyStop(context.Background())
+	defer stop()
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context was not cancelled by SIGHUP")
+	}
+	if sig := stopSignalOf(ctx); sig != syscall.SIGHUP {
+		t.Errorf("stopSignalOf() = %v, want SIGHUP", sig)
+	}
+
+	// Child contexts stop their commands by the same signal.
+	child, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if sig := stopSignalOf(child); sig != syscall.SIGHUP {
+		t.Errorf("stopSignalOf() of the child = %v, want SIGHUP", sig)
+	}
+}
+
+func TestStopSignalOf(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if sig := stopSignalOf(ctx); sig != syscall.SIGTERM {
+		t.Errorf("stopSignalOf() = %v, want SIGTERM", sig)
+	}
+}
+
+func TestSetStopSignal(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	command := exec.CommandContext(ctx, "sleep", "10")
+	setStopSignal(ctx, command)
+	if err := command.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel(&StopSignalError{Signal: syscall.SIGINT})
+	err := command.Wait()
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	if status := exitErr.Sys().(syscall.WaitStatus); !status.Signaled() || status.Signal() != syscall.SIGINT {
+		t.Errorf("command exited with %v, want SIGINT", status)
+	}
+}
+
+func TestHoldTerminalSignals(t *testing.T) {
+	ctx, stop := notifyStop(context.Background())
+	defer stop()
+
+	release := holdTerminalSignals()
+	for _, sig := range []syscall.Signal{syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTSTP} {
+		if err := syscall.Kill(os.Getpid(), sig); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if ctx.Err() != nil {
+		t.Fatalf("context was cancelled by %v while an interactive child is running", context.Cause(ctx))
+	}
+
+	// SIGTERM still stops the child.
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context was not cancelled by SIGTERM")
+	}
+	release()
+}
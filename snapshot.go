@@ -0,0 +1,208 @@
+package awssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	SnapshotTagKeyInstanceID    string = "instance-id"
+	SnapshotTagKeyCreated       string = "Created"
+	SnapshotTagKeyCreatedBy     string = "CreatedBy"
+	SnapshotTagKeyPolicy        string = "awssh:snapshot"
+	SnapshotTagValueCreated     string = "awssh"
+	DefaultSnapshotNameTemplate string = "{{ .InstanceID }}_{{ .Timestamp }}"
+)
+
+var (
+	DefaultSnapshotCopyTags = []string{"Name"}
+
+	invalidImageNameCharRe = regexp.MustCompile(`[^a-zA-Z0-9()\[\] ./\-'@_]`)
+)
+
+type (
+	Image struct {
+		ID           string
+		Name         string
+		InstanceID   string
+		State        string
+		CreationDate time.Time
+		SnapshotIDs  []string
+	}
+	Images []Image
+
+	SnapshotOptions struct {
+		NameTemplate string
+		CopyTags     []string
+		Tags         map[string]string
+		IfOlderThan  time.Duration
+	}
+	snapshotNameData struct {
+		InstanceID string
+		Name       string
+		Timestamp  string
+		Date       string
+	}
+)
+
+// Sort images by instance-id, newest first within the same instance.
+func (images Images) sortByInstanceAndNewest() {
+	sort.SliceStable(images, func(i, j int) bool {
+		if images[i].InstanceID != images[j].InstanceID {
+			return images[i].InstanceID < images[j].InstanceID
+		}
+		return images[i].CreationDate.After(images[j].CreationDate)
+	})
+}
+
+// Select images to prune. The newest `keep` images of each instance are always kept,
+// and if olderThan is positive only images created before now-olderThan are selected.
+func selectPruneImages(images Images, keep int, olderThan time.Duration, now time.Time) (pruneImages Images) {
+	sorted := make(Images, len(images))
+	copy(sorted, images)
+	sorted.sortByInstanceAndNewest()
+
+	count := map[string]int{}
+	for _, image := range sorted {
+		count[image.InstanceID]++
+		if count[image.InstanceID] <= keep {
+			continue
+		}
+		if olderThan > 0 && image.CreationDate.After(now.Add(-olderThan)) {
+			continue
+		}
+		pruneImages = append(pruneImages, image)
+	}
+
+	return pruneImages
+}
+
+// Render the AMI name from the template. Characters not allowed in AMI names are replaced with '-'.
+func renderImageName(nameTemplate, instanceID string, instanceTags map[string]string, now time.Time) (name string, err error) {
+	if nameTemplate == "" {
+		nameTemplate = DefaultSnapshotNameTemplate
+	}
+
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(nameTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	data := snapshotNameData{
+		InstanceID: instanceID,
+		Name:       instanceTags["Name"],
+		Timestamp:  now.Format("20060102150405"),
+		Date:       now.Format("2006-01-02"),
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	name = invalidImageNameCharRe.ReplaceAllString(buf.String(), "-")
+	if len(name) > 128 {
+		name = name[:128]
+	}
+	return name, nil
+}
+
+// Build tags for the AMI and its snapshots. Instance tags matching copyTags patterns are copied first,
+// then user-defined tags, then the tags awssh uses to manage the images.
+func buildImageTags(instanceID, principal string, instanceTags map[string]string, opts SnapshotOptions) (tags map[string]string) {
+	tags = map[string]string{}
+
+	for key, value := range instanceTags {
+		// Tags with the "aws:" prefix are reserved and cannot be set by users.
+		if strings.HasPrefix(key, "aws:") {
+			continue
+		}
+		for _, pattern := range opts.CopyTags {
+			if matched, _ := path.Match(pattern, key); matched {
+				tags[key] = value
+				break
+			}
+		}
+	}
+	for key, value := range opts.Tags {
+		tags[key] = value
+	}
+
+	if principal != "" {
+		tags[SnapshotTagKeyCreatedBy] = principal
+	}
+	tags[SnapshotTagKeyInstanceID] = instanceID
+	tags[SnapshotTagKeyCreated] = SnapshotTagValueCreated
+
+	return tags
+}
+
+// Parse "Key=Value" formatted tags.
+func parseTags(tagStrings []string) (tags map[string]string, err error) {
+	tags = map[string]string{}
+	for _, tagString := range tagStrings {
+		kv := strings.SplitN(tagString, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			err = errors.New("invalid tag format: " + tagString + " (expected Key=Value)")
+			return nil, err
+		}
+		tags[kv[0]] = kv[1]
+	}
+	return tags, nil
+}
+
+// Decide whether snapshots are enabled for the instance. The awssh:snapshot instance tag takes precedence
+// over the enabled flag. reason is empty if snapshot is simply not enabled.
+func snapshotEnabled(enabled bool, instanceTags map[string]string) (bool, string) {
+	if value, ok := instanceTags[SnapshotTagKeyPolicy]; ok {
+		switch strings.ToLower(value) {
+		case "true", "enabled", "on", "yes":
+			return true, "enabled by tag " + SnapshotTagKeyPolicy + "=" + value
+		case "false", "disabled", "off", "no":
+			return false, "disabled by tag " + SnapshotTagKeyPolicy + "=" + value
+		}
+	}
+
+	if !enabled {
+		return false, ""
+	}
+	return true, "enabled by option"
+}
+
+// Decide whether to create a snapshot. Snapshots are enabled as snapshotEnabled decides, and when ifOlderThan
+// is positive a snapshot is skipped if the latest awssh AMI is newer than the threshold.
+// reason is empty if snapshot is simply not enabled.
+func decideSnapshot(enabled bool, instanceTags map[string]string, latest *Image, ifOlderThan time.Duration, now time.Time) (create bool, reason string) {
+	if enabled, reason = snapshotEnabled(enabled, instanceTags); !enabled {
+		return false, reason
+	}
+
+	if ifOlderThan > 0 && latest != nil {
+		age := now.Sub(latest.CreationDate)
+		if age < ifOlderThan {
+			reason = fmt.Sprintf("latest AMI %s was created %s ago (threshold %s)", latest.ID, age.Round(time.Minute), ifOlderThan)
+			return false, reason
+		}
+	}
+
+	return true, reason
+}
+
+// Return the newest image that has not failed, or nil.
+func latestImage(images Images) (latest *Image) {
+	for i := range images {
+		if images[i].State != "pending" && images[i].State != "available" {
+			continue
+		}
+		if latest == nil || images[i].CreationDate.After(latest.CreationDate) {
+			latest = &images[i]
+		}
+	}
+	return latest
+}
@@ -0,0 +1,187 @@
+package awssh
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2020, 1, 31, 12, 0, 0, 0, time.UTC)
+
+func testImages() (images Images) {
+	images = Images{
+		{ID: "ami-a1", InstanceID: "i-a", State: "available", CreationDate: testNow.Add(-1 * 24 * time.Hour)},
+		{ID: "ami-a3", InstanceID: "i-a", State: "available", CreationDate: testNow.Add(-3 * 24 * time.Hour)},
+		{ID: "ami-a2", InstanceID: "i-a", State: "failed", CreationDate: testNow.Add(-2 * 24 * time.Hour)},
+		{ID: "ami-b1", InstanceID: "i-b", State: "pending", CreationDate: testNow.Add(-1 * time.Hour)},
+		{ID: "ami-b2", InstanceID: "i-b", State: "available", CreationDate: testNow.Add(-10 * 24 * time.Hour)},
+	}
+	return images
+}
+
+func imageIDs(images Images) (ids []string) {
+	for _, image := range images {
+		ids = append(ids, image.ID)
+	}
+	return ids
+}
+
+func TestSelectPruneImages(t *testing.T) {
+	tests := []struct {
+		name      string
+		keep      int
+		olderThan time.Duration
+		want      []string
+	}{
+		{name: "keep 1", keep: 1, want: []string{"ami-a2", "ami-a3", "ami-b2"}},
+		{name: "keep 2", keep: 2, want: []string{"ami-a3"}},
+		{name: "older than 2 days", olderThan: 48 * time.Hour, want: []string{"ami-a2", "ami-a3", "ami-b2"}},
+		{name: "keep 1 and older than 5 days", keep: 1, olderThan: 5 * 24 * time.Hour, want: []string{"ami-b2"}},
+		{name: "keep all", keep: 10, want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := imageIDs(selectPruneImages(testImages(), tt.keep, tt.olderThan, testNow))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selectPruneImages() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLatestImage(t *testing.T) {
+	images := testImages()[:3]
+	if got := latestImage(images); got == nil || got.ID != "ami-a1" {
+		t.Errorf("latestImage() = %v, want ami-a1", got)
+	}
+
+	failed := Images{{ID: "ami-x", State: "failed", CreationDate: testNow}}
+	if got := latestImage(failed); got != nil {
+		t.Errorf("latestImage() = %v, want nil", got)
+	}
+}
+
+func TestRenderImageName(t *testing.T) {
+	tags := map[string]string{"Name": "web:01"}
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+		wantErr  bool
+	}{
+		{name: "default", template: "", want: "i-123_20200131120000"},
+		{name: "name and date", template: "{{ .Name }}-{{ .Date }}", want: "web-01-2020-01-31"},
+		{name: "invalid template", template: "{{ .Name ", wantErr: true},
+		{name: "unknown field", template: "{{ .Unknown }}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderImageName(tt.template, "i-123", tags, testNow)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("renderImageName() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("renderImageName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	long, err := renderImageName(strings.Repeat("a", 200), "i-123", tags, testNow)
+	if err != nil || len(long) != 128 {
+		t.Errorf("renderImageName() length = %d, want 128", len(long))
+	}
+}
+
+func TestBuildImageTags(t *testing.T) {
+	instanceTags := map[string]string{
+		"Name":                     "web",
+		"Env":                      "prod",
+		"team:owner":               "infra",
+		"aws:cloudformation:stack": "stack",
+		"Unrelated":                "x",
+	}
+	opts := SnapshotOptions{
+		CopyTags: []string{"Name", "Env", "team:*", "aws:*"},
+		Tags:     map[string]string{"Env": "backup", "Purpose": "snapshot"},
+	}
+
+	got := buildImageTags("i-123", "arn:aws:iam::123456789012:user/alice", instanceTags, opts)
+	want := map[string]string{
+		"Name":                   "web",
+		"Env":                    "backup",
+		"team:owner":             "infra",
+		"Purpose":                "snapshot",
+		SnapshotTagKeyCreatedBy:  "arn:aws:iam::123456789012:user/alice",
+		SnapshotTagKeyInstanceID: "i-123",
+		SnapshotTagKeyCreated:    SnapshotTagValueCreated,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("buildImageTags() = %v, want %v", got, want)
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "empty", input: nil, want: map[string]string{}},
+		{name: "valid", input: []string{"Env=prod", "Note=a=b", "Empty="}, want: map[string]string{"Env": "prod", "Note": "a=b", "Empty": ""}},
+		{name: "no separator", input: []string{"Env"}, wantErr: true},
+		{name: "empty key", input: []string{"=prod"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTags(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecideSnapshot(t *testing.T) {
+	recent := &Image{ID: "ami-recent", CreationDate: testNow.Add(-time.Hour)}
+	old := &Image{ID: "ami-old", CreationDate: testNow.Add(-48 * time.Hour)}
+
+	tests := []struct {
+		name        string
+		enabled     bool
+		tags        map[string]string
+		latest      *Image
+		ifOlderThan time.Duration
+		want        bool
+		wantReason  bool
+	}{
+		{name: "disabled", enabled: false, want: false, wantReason: false},
+		{name: "enabled", enabled: true, want: true, wantReason: true},
+		{name: "enabled by tag", enabled: false, tags: map[string]string{SnapshotTagKeyPolicy: "true"}, want: true, wantReason: true},
+		{name: "disabled by tag", enabled: true, tags: map[string]string{SnapshotTagKeyPolicy: "Off"}, want: false, wantReason: true},
+		{name: "unknown tag value", enabled: false, tags: map[string]string{SnapshotTagKeyPolicy: "maybe"}, want: false, wantReason: false},
+		{name: "latest is recent", enabled: true, latest: recent, ifOlderThan: 24 * time.Hour, want: false, wantReason: true},
+		{name: "latest is old", enabled: true, latest: old, ifOlderThan: 24 * time.Hour, want: true, wantReason: true},
+		{name: "no image yet", enabled: true, ifOlderThan: 24 * time.Hour, want: true, wantReason: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := decideSnapshot(tt.enabled, tt.tags, tt.latest, tt.ifOlderThan, testNow)
+			if got != tt.want {
+				t.Errorf("decideSnapshot() = %v (%q), want %v", got, reason, tt.want)
+			}
+			if (reason != "") != tt.wantReason {
+				t.Errorf("decideSnapshot() reason = %q, wantReason %v", reason, tt.wantReason)
+			}
+		})
+	}
+}
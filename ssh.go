@@ -105,6 +105,7 @@ func ExecSshLogin(username, host, port, identityFilePath string) (err error) {
 	if err != nil {
 		return err
 	}
+	defer sshClient.Close()
 
 	sshSession, err := newSshSession(sshClient)
 	if err != nil {
@@ -130,6 +131,6 @@ func ExecSshLogin(username, host, port, identityFilePath string) (err error) {
 	}
 
 	setInputOutput(sshSession, os.Stdout, os.Stdin, os.Stderr)
-	err = execShell(sshSession)
+	err = commandExitError(execShell(sshSession))
 	return err
 }
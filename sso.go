@@ -0,0 +1,239 @@
+package awssh
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/ssocreds"
+	"github.com/aws/aws-sdk-go-v2/service/ssooidc"
+	"github.com/aws/aws-sdk-go-v2/service/ssooidc/types"
+)
+
+const (
+	SSOClientName        string        = "awssh"
+	SSOClientType        string        = "public"
+	SSOGrantTypeDevice   string        = "urn:ietf:params:oauth:grant-type:device_code"
+	SSOGrantTypeRefresh  string        = "refresh_token"
+	SSOTokenExpiryWindow time.Duration = 1 * time.Minute
+)
+
+type (
+	// SSOToken is the token cache format shared with the AWS CLI and SDKs (~/.aws/sso/cache).
+	SSOToken struct {
+		AccessToken           string     `json:"accessToken"`
+		ExpiresAt             time.Time  `json:"expiresAt"`
+		RefreshToken          string     `json:"refreshToken,omitempty"`
+		ClientID              string     `json:"clientId,omitempty"`
+		ClientSecret          string     `json:"clientSecret,omitempty"`
+		RegistrationExpiresAt *time.Time `json:"registrationExpiresAt,omitempty"`
+		Region                string     `json:"region,omitempty"`
+		StartURL              string     `json:"startUrl,omitempty"`
+	}
+)
+
+// The token cache is keyed by the sso-session name, or the start URL for legacy profiles.
+func ssoTokenCacheFilePath(pc *ProfileConfig) (path string, err error) {
+	key := pc.SSOSession
+	if key == "" {
+		key = pc.SSOStartURL
+	}
+
+	path, err = ssocreds.StandardCachedTokenFilepath(key)
+	return path, err
+}
+
+func loadSSOToken(path string) (token *SSOToken, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	token = &SSOToken{}
+	if err = json.Unmarshal(data, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func saveSSOToken(path string, token *SSOToken) (err error) {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(path, data)
+	return err
+}
+
+// Tokens are written in RFC3339 without fractional seconds like the AWS CLI.
+func ssoExpiresAt(expiresIn int64) (expiresAt time.Time) {
+	expiresAt = time.Now().Add(time.Duration(expiresIn) * time.Second).UTC().Truncate(time.Second)
+	return expiresAt
+}
+
+func (t *SSOToken) valid(now time.Time) (valid bool) {
+	valid = t.AccessToken != "" && now.Add(SSOTokenExpiryWindow).Before(t.ExpiresAt)
+	return valid
+}
+
+func (t *SSOToken) refreshable(now time.Time) (refreshable bool) {
+	refreshable = t.RefreshToken != "" && t.ClientID != "" && t.ClientSecret != "" &&
+		t.RegistrationExpiresAt != nil && now.Before(*t.RegistrationExpiresAt)
+	return refreshable
+}
+
+// Make sure a valid IAM Identity Center token is cached for the profile, so that the SDK can resolve credentials.
+// The token is refreshed if possible, otherwise the device authorization flow is started.
+func ensureSSOToken(ctx context.Context, pc *ProfileConfig) (err error) {
+	if !pc.IsSSO() {
+		return nil
+	}
+	if pc.SSORegion == "" {
+		err = errors.New("sso_region is not configured for profile: " + pc.Name)
+		return err
+	}
+
+	path, err := ssoTokenCacheFilePath(pc)
+	if err != nil {
+		return err
+	}
+
+	err = ensureSSOTokenWithClient(ctx, newSSOOIDCClient(pc.SSORegion), pc, path, time.Now())
+	return err
+}
+
+// Make sure the token cached at path is valid at now, by the client if it has to be refreshed or issued.
+func ensureSSOTokenWithClient(ctx context.Context, client SSOTokenIssuer, pc *ProfileConfig, path string, now time.Time) (err error) {
+	token, err := loadSSOToken(path)
+	if err == nil && token.valid(now) {
+		return nil
+	}
+
+	// Only sso-session tokens can be refreshed. Legacy tokens require a new login.
+	if err == nil && pc.SSOSession != "" && token.refreshable(now) {
+		if refreshed, err := refreshSSOToken(ctx, client, token); err == nil {
+			err = saveSSOToken(path, refreshed)
+			return err
+		}
+	}
+
+	token, err = ssoDeviceAuthorization(ctx, client, pc)
+	if err != nil {
+		return err
+	}
+
+	err = saveSSOToken(path, token)
+	return err
+}
+
+func newSSOOIDCClient(region string) (client *ssooidc.Client) {
+	// The OIDC API is unauthenticated. Anonymous credentials avoid resolving the profile recursively.
+	client = ssooidc.NewFromConfig(aws.Config{
+		Credentials: aws.AnonymousCredentials{},
+		Region:      region,
+	})
+	return client
+}
+
+func refreshSSOToken(ctx context.Context, client SSOTokenIssuer, token *SSOToken) (refreshed *SSOToken, err error) {
+	result, err := client.CreateToken(ctx, &ssooidc.CreateTokenInput{
+		ClientId:     aws.String(token.ClientID),
+		ClientSecret: aws.String(token.ClientSecret),
+		GrantType:    aws.String(SSOGrantTypeRefresh),
+		RefreshToken: aws.String(token.RefreshToken),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	refreshed = &SSOToken{}
+	*refreshed = *token
+	refreshed.AccessToken = aws.ToString(result.AccessToken)
+	refreshed.ExpiresAt = ssoExpiresAt(int64(result.ExpiresIn))
+	if result.RefreshToken != nil {
+		refreshed.RefreshToken = *result.RefreshToken
+	}
+	return refreshed, nil
+}
+
+func ssoDeviceAuthorization(ctx context.Context, client SSOTokenIssuer, pc *ProfileConfig) (token *SSOToken, err error) {
+	registerInput := &ssooidc.RegisterClientInput{
+		ClientName: aws.String(SSOClientName),
+		ClientType: aws.String(SSOClientType),
+	}
+	if pc.SSOSession != "" && len(pc.SSORegistrationScopes) > 0 {
+		registerInput.Scopes = pc.SSORegistrationScopes
+	}
+	registration, err := client.RegisterClient(ctx, registerInput)
+	if err != nil {
+		return nil, err
+	}
+
+	authorization, err := client.StartDeviceAuthorization(ctx, &ssooidc.StartDeviceAuthorizationInput{
+		ClientId:     registration.ClientId,
+		ClientSecret: registration.ClientSecret,
+		StartUrl:     aws.String(pc.SSOStartURL),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(os.Stderr, "Attempting to sign in to IAM Identity Center: %s\n", pc.SSOStartURL)
+	fmt.Fprintf(os.Stderr, "Open the following URL in your browser and confirm the code.\n\n")
+	fmt.Fprintf(os.Stderr, "URL:  %s\n", aws.ToString(authorization.VerificationUriComplete))
+	fmt.Fprintf(os.Stderr, "Code: %s\n\n", aws.ToString(authorization.UserCode))
+
+	interval := time.Duration(authorization.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(authorization.ExpiresIn) * time.Second)
+
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+
+		result, err := client.CreateToken(ctx, &ssooidc.CreateTokenInput{
+			ClientId:     registration.ClientId,
+			ClientSecret: registration.ClientSecret,
+			DeviceCode:   authorization.DeviceCode,
+			GrantType:    aws.String(SSOGrantTypeDevice),
+		})
+		var pending *types.AuthorizationPendingException
+		var slowDown *types.SlowDownException
+		if errors.As(err, &pending) {
+			continue
+		} else if errors.As(err, &slowDown) {
+			interval += 5 * time.Second
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		registrationExpiresAt := time.Unix(registration.ClientSecretExpiresAt, 0).UTC()
+		token = &SSOToken{
+			AccessToken:           aws.ToString(result.AccessToken),
+			ExpiresAt:             ssoExpiresAt(int64(result.ExpiresIn)),
+			RefreshToken:          aws.ToString(result.RefreshToken),
+			ClientID:              aws.ToString(registration.ClientId),
+			ClientSecret:          aws.ToString(registration.ClientSecret),
+			RegistrationExpiresAt: &registrationExpiresAt,
+			Region:                pc.SSORegion,
+			StartURL:              pc.SSOStartURL,
+		}
+		fmt.Fprintln(os.Stderr, "Successfully signed in to IAM Identity Center.")
+		return token, nil
+	}
+
+	err = errors.New("device authorization expired. please retry to sign in to IAM Identity Center")
+	return nil, err
+}
@@ -0,0 +1,219 @@
+package awssh
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssooidc"
+	"github.com/aws/aws-sdk-go-v2/service/ssooidc/types"
+)
+
+type fakeSSOOIDC struct {
+	refreshErr  error
+	deviceErr   error
+	pending     int
+	refreshed   *ssooidc.CreateTokenInput
+	registered  *ssooidc.RegisterClientInput
+	deviceToken *ssooidc.CreateTokenInput
+}
+
+func (f *fakeSSOOIDC) RegisterClient(ctx context.Context, params *ssooidc.RegisterClientInput, optFns ...func(*ssooidc.Options)) (*ssooidc.RegisterClientOutput, error) {
+	f.registered = params
+	return &ssooidc.RegisterClientOutput{
+		ClientId:              aws.String("new-client-id"),
+		ClientSecret:          aws.String("new-client-secret"),
+		ClientSecretExpiresAt: testNow.Add(90 * 24 * time.Hour).Unix(),
+	}, nil
+}
+
+func (f *fakeSSOOIDC) StartDeviceAuthorization(ctx context.Context, params *ssooidc.StartDeviceAuthorizationInput, optFns ...func(*ssooidc.Options)) (*ssooidc.StartDeviceAuthorizationOutput, error) {
+	if f.deviceErr != nil {
+		return nil, f.deviceErr
+	}
+	return &ssooidc.StartDeviceAuthorizationOutput{
+		DeviceCode:              aws.String("device-code"),
+		UserCode:                aws.String("ABCD-EFGH"),
+		VerificationUriComplete: aws.String("https://device.sso.us-east-1.amazonaws.com/?user_code=ABCD-EFGH"),
+		ExpiresIn:               60,
+		Interval:                1,
+	}, nil
+}
+
+func (f *fakeSSOOIDC) CreateToken(ctx context.Context, params *ssooidc.CreateTokenInput, optFns ...func(*ssooidc.Options)) (*ssooidc.CreateTokenOutput, error) {
+	if aws.ToString(params.GrantType) == SSOGrantTypeRefresh {
+		f.refreshed = params
+		if f.refreshErr != nil {
+			return nil, f.refreshErr
+		}
+		return &ssooidc.CreateTokenOutput{AccessToken: aws.String("refreshed-access-token"), ExpiresIn: 3600}, nil
+	}
+
+	f.deviceToken = params
+	if f.pending > 0 {
+		f.pending--
+		return nil, &types.AuthorizationPendingException{}
+	}
+	return &ssooidc.CreateTokenOutput{
+		AccessToken:  aws.String("device-access-token"),
+		RefreshToken: aws.String("device-refresh-token"),
+		ExpiresIn:    3600,
+	}, nil
+}
+
+func TestSSOTokenValid(t *testing.T) {
+	tests := []struct {
+		name  string
+		token SSOToken
+		want  bool
+	}{
+		{name: "valid", token: SSOToken{AccessToken: "token", ExpiresAt: testNow.Add(time.Hour)}, want: true},
+		{name: "expired", token: SSOToken{AccessToken: "token", ExpiresAt: testNow.Add(-time.Hour)}},
+		{name: "expires within the window", token: SSOToken{AccessToken: "token", ExpiresAt: testNow.Add(SSOTokenExpiryWindow / 2)}},
+		{name: "no access token", token: SSOToken{ExpiresAt: testNow.Add(time.Hour)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.token.valid(testNow); got != tt.want {
+				t.Errorf("valid() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSSOTokenRefreshable(t *testing.T) {
+	registered := testNow.Add(24 * time.Hour)
+	registrationExpired := testNow.Add(-time.Hour)
+	refreshable := SSOToken{RefreshToken: "refresh", ClientID: "id", ClientSecret: "secret", RegistrationExpiresAt: &registered}
+
+	tests := []struct {
+		name   string
+		modify func(token *SSOToken)
+		want   bool
+	}{
+		{name: "refreshable", modify: func(token *SSOToken) {}, want: true},
+		{name: "no refresh token", modify: func(token *SSOToken) { token.RefreshToken = "" }},
+		{name: "no client", modify: func(token *SSOToken) { token.ClientID = "" }},
+		{name: "no client secret", modify: func(token *SSOToken) { token.ClientSecret = "" }},
+		{name: "no registration expiry", modify: func(token *SSOToken) { token.RegistrationExpiresAt = nil }},
+		{name: "registration expired", modify: func(token *SSOToken) { token.RegistrationExpiresAt = &registrationExpired }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := refreshable
+			tt.modify(&token)
+			if got := token.refreshable(testNow); got != tt.want {
+				t.Errorf("refreshable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnsureSSOTokenWithClient(t *testing.T) {
+	registered := testNow.Add(24 * time.Hour)
+	session := &ProfileConfig{Name: "sso", SSOSession: "company", SSOStartURL: "https://company.awsapps.com/start", SSORegion: "us-east-1"}
+	legacy := &ProfileConfig{Name: "sso-legacy", SSOStartURL: "https://legacy.awsapps.com/start", SSORegion: "eu-west-1"}
+	valid := &SSOToken{AccessToken: "cached-access-token", ExpiresAt: testNow.Add(time.Hour)}
+	expired := &SSOToken{
+		AccessToken:           "cached-access-token",
+		ExpiresAt:             testNow.Add(-time.Hour),
+		RefreshToken:          "cached-refresh-token",
+		ClientID:              "client-id",
+		ClientSecret:          "client-secret",
+		RegistrationExpiresAt: &registered,
+	}
+	deviceErr := errors.New("device authorization failed")
+
+	tests := []struct {
+		name        string
+		pc          *ProfileConfig
+		cached      *SSOToken
+		refreshErr  error
+		wantRefresh bool
+		wantDevice  bool
+		wantToken   string
+	}{
+		{name: "valid", pc: session, cached: valid, wantToken: "cached-access-token"},
+		{name: "refreshed", pc: session, cached: expired, wantRefresh: true, wantToken: "refreshed-access-token"},
+		{name: "refresh failed", pc: session, cached: expired, refreshErr: errors.New("invalid grant"), wantRefresh: true, wantDevice: true, wantToken: "cached-access-token"},
+		{name: "legacy is not refreshed", pc: legacy, cached: expired, wantDevice: true, wantToken: "cached-access-token"},
+		{name: "not cached", pc: session, wantDevice: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "token.json")
+			if tt.cached != nil {
+				if err := saveSSOToken(path, tt.cached); err != nil {
+					t.Fatal(err)
+				}
+			}
+			client := &fakeSSOOIDC{refreshErr: tt.refreshErr, deviceErr: deviceErr}
+
+			err := ensureSSOTokenWithClient(context.Background(), client, tt.pc, path, testNow)
+			if tt.wantDevice != errors.Is(err, deviceErr) {
+				t.Errorf("ensureSSOTokenWithClient() error = %v, want device authorization %v", err, tt.wantDevice)
+			}
+			if (client.refreshed != nil) != tt.wantRefresh {
+				t.Errorf("refreshed = %v, want %v", client.refreshed != nil, tt.wantRefresh)
+			}
+			if tt.wantRefresh && aws.ToString(client.refreshed.RefreshToken) != "cached-refresh-token" {
+				t.Errorf("refresh token = %q", aws.ToString(client.refreshed.RefreshToken))
+			}
+			if (client.registered != nil) != tt.wantDevice {
+				t.Errorf("device authorization started = %v, want %v", client.registered != nil, tt.wantDevice)
+			}
+
+			if tt.wantToken == "" {
+				return
+			}
+			token, err := loadSSOToken(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.AccessToken != tt.wantToken {
+				t.Errorf("cached access token = %q, want %q", token.AccessToken, tt.wantToken)
+			}
+			if tt.wantRefresh && !tt.wantDevice && token.RefreshToken != "cached-refresh-token" {
+				t.Errorf("cached refresh token = %q, want kept", token.RefreshToken)
+			}
+		})
+	}
+}
+
+func TestSSODeviceAuthorization(t *testing.T) {
+	pc := &ProfileConfig{
+		Name:                  "sso",
+		SSOSession:            "company",
+		SSOStartURL:           "https://company.awsapps.com/start",
+		SSORegion:             "us-east-1",
+		SSORegistrationScopes: []string{"sso:account:access"},
+	}
+	client := &fakeSSOOIDC{pending: 1}
+
+	token, err := ssoDeviceAuthorization(context.Background(), client, pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(client.registered.Scopes) != 1 || client.registered.Scopes[0] != "sso:account:access" {
+		t.Errorf("RegisterClient scopes = %v", client.registered.Scopes)
+	}
+	if aws.ToString(client.deviceToken.DeviceCode) != "device-code" || aws.ToString(client.deviceToken.GrantType) != SSOGrantTypeDevice {
+		t.Errorf("CreateToken input = %+v", client.deviceToken)
+	}
+	if token.AccessToken != "device-access-token" || token.RefreshToken != "device-refresh-token" || token.ClientID != "new-client-id" {
+		t.Errorf("token = %+v", token)
+	}
+	if token.RegistrationExpiresAt == nil || !token.RegistrationExpiresAt.Equal(testNow.Add(90*24*time.Hour)) {
+		t.Errorf("registration expires at %v", token.RegistrationExpiresAt)
+	}
+	if !token.valid(time.Now()) || token.Region != "us-east-1" || token.StartURL != pc.SSOStartURL {
+		t.Errorf("token = %+v", token)
+	}
+}
@@ -0,0 +1,644 @@
+package awssh
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+const (
+	TunnelSocketPath string = ConfigPath + "/tunnel.sock"
+	TunnelLogPath    string = ConfigPath + "/tunnel.log"
+
+	TunnelCommandUp   string = "up"
+	TunnelCommandDown string = "down"
+	TunnelCommandList string = "ls"
+
+	TunnelStatusConnected    string = "connected"
+	TunnelStatusReconnecting string = "reconnecting"
+	TunnelStatusExpired      string = "expired"
+
+	// The delay before reconnecting doubles up to the max while the session keeps failing.
+	TunnelReconnectMinDelay time.Duration = 1 * time.Second
+	TunnelReconnectMaxDelay time.Duration = 30 * time.Second
+	// How long to wait for the daemon to listen on the control socket after starting it.
+	TunnelDaemonStartTimeout time.Duration = 5 * time.Second
+)
+
+var (
+	ErrTunnelDaemonNotRunning   = errors.New("tunnel daemon is not running")
+	ErrTunnelCredentialsExpired = errors.New("credentials of the tunnel expired, run `awssh tunnel up` of the instance again to refresh them")
+)
+
+type (
+	// TunnelRequest is a request to the tunnel daemon on the control socket.
+	// Up requests carry the credentials, since the daemon cannot prompt for MFA. They also refresh the
+	// credentials of the tunnels of the instance which are already up.
+	TunnelRequest struct {
+		Command      string          `json:"Command"`
+		InstanceID   string          `json:"InstanceID,omitempty"`
+		InstanceName string          `json:"InstanceName,omitempty"`
+		Forwards     PortForwards    `json:"Forwards,omitempty"`
+		Region       string          `json:"Region,omitempty"`
+		Credentials  aws.Credentials `json:"Credentials"`
+		// Targets of down requests. Tunnel IDs or instance IDs, all tunnels if empty.
+		Targets []string `json:"Targets,omitempty"`
+	}
+
+	// TunnelResponse is the response of the tunnel daemon.
+	TunnelResponse struct {
+		Tunnels TunnelStatuses `json:"Tunnels"`
+		Error   string         `json:"Error,omitempty"`
+	}
+
+	// TunnelStatus is the status of a tunnel. ID is the local port or the socket path of the tunnel.
+	TunnelStatus struct {
+		ID           string      `json:"ID"`
+		InstanceID   string      `json:"InstanceID"`
+		InstanceName string      `json:"InstanceName"`
+		Forward      PortForward `json:"Forward"`
+		Status       string      `json:"Status"`
+		Started      time.Time   `json:"Started"`
+		Reconnects   int         `json:"Reconnects"`
+		BytesIn      int64       `json:"BytesIn"`
+		BytesOut     int64       `json:"BytesOut"`
+		Error        string      `json:"Error,omitempty"`
+		// When the credentials of the tunnel expire. Zero if they do not expire.
+		CredentialsExpire time.Time `json:"CredentialsExpire"`
+	}
+	TunnelStatuses []TunnelStatus
+
+	// TunnelDaemon owns the tunnels of the user and serves requests on the control socket.
+	TunnelDaemon struct {
+		// NewClients returns the clients used to start the sessions of a tunnel.
+		NewClients func(region string, credentials aws.CredentialsProvider) *Clients
+
+		mu          sync.Mutex
+		tunnels     map[string]*Tunnel
+		credentials map[string]*TunnelCredentials
+		listener    net.Listener
+	}
+
+	// TunnelCredentials are the credentials sent by `tunnel up`, which the sessions of the tunnels are started
+	// with, including reconnects. `tunnel up` of the instance again replaces them before they expire.
+	TunnelCredentials struct {
+		mu    sync.Mutex
+		value aws.Credentials
+	}
+
+	// Tunnel listens on the local port and proxies connections to session-manager-plugin,
+	// which is restarted with a new session when it exits.
+	Tunnel struct {
+		id           string
+		instanceID   string
+		instanceName string
+		forward      PortForward
+		clients      *Clients
+		onReconnect  func(ctx context.Context) error
+		started      time.Time
+		proxy        *LocalProxy
+		cancel       context.CancelFunc
+		done         chan struct{}
+
+		mu         sync.Mutex
+		target     string
+		status     string
+		reconnects int
+		err        error
+	}
+)
+
+// NewTunnelDaemon returns the daemon which starts sessions with the credentials sent by clients.
+func NewTunnelDaemon() (d *TunnelDaemon) {
+	d = &TunnelDaemon{
+		NewClients: func(region string, credentials aws.CredentialsProvider) *Clients {
+			return NewClients(aws.Config{
+				Region:      region,
+				Credentials: credentials,
+			})
+		},
+	}
+	return d
+}
+
+func NewTunnelCredentials(value aws.Credentials) (c *TunnelCredentials) {
+	c = &TunnelCredentials{value: value}
+	return c
+}
+
+// Retrieve returns the credentials, or ErrTunnelCredentialsExpired if they expired.
+func (c *TunnelCredentials) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.value.Expired() {
+		return aws.Credentials{}, ErrTunnelCredentialsExpired
+	}
+	return c.value, nil
+}
+
+func (c *TunnelCredentials) Set(value aws.Credentials) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.value = value
+}
+
+// Expires returns when the credentials expire, and whether they expired. It is zero if they do not expire.
+func (c *TunnelCredentials) Expires() (expires time.Time, expired bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.value.CanExpire {
+		return time.Time{}, false
+	}
+	return c.value.Expires, c.value.Expired()
+}
+
+// Serve listens on the control socket and serves requests until ctx is done or the last tunnel is down.
+func (d *TunnelDaemon) Serve(ctx context.Context, socketPath string) (err error) {
+	listener, err := listenTunnelSocket(socketPath)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.tunnels = map[string]*Tunnel{}
+	d.credentials = map[string]*TunnelCredentials{}
+	d.listener = listener
+	d.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	defer d.downTunnels(nil)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go d.handle(ctx, conn)
+	}
+}
+
+func (d *TunnelDaemon) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	var request TunnelRequest
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&request); err != nil {
+		json.NewEncoder(conn).Encode(TunnelResponse{Error: err.Error()})
+		return
+	}
+
+	var response TunnelResponse
+	switch request.Command {
+	case TunnelCommandUp:
+		tunnels, err := d.upTunnels(ctx, request)
+		response.Tunnels = tunnels
+		if err != nil {
+			response.Error = err.Error()
+		}
+	case TunnelCommandDown:
+		response.Tunnels = d.downTunnels(request.Targets)
+	case TunnelCommandList:
+		response.Tunnels = d.statuses()
+	default:
+		response.Error = "unknown command: " + request.Command
+	}
+	json.NewEncoder(conn).Encode(response)
+
+	// The daemon exits when no tunnel is left by the request.
+	d.mu.Lock()
+	if request.Command != TunnelCommandList && len(d.tunnels) == 0 {
+		d.listener.Close()
+	}
+	d.mu.Unlock()
+}
+
+// Start the tunnels of the request. Tunnels started before a failure are kept. The tunnels of the instance
+// which are already up get the credentials of the request, and the forwards of them are not started again.
+func (d *TunnelDaemon) upTunnels(ctx context.Context, request TunnelRequest) (statuses TunnelStatuses, err error) {
+	d.mu.Lock()
+	refreshed := map[string]bool{}
+	for id, tunnel := range d.tunnels {
+		if tunnel.instanceID == request.InstanceID {
+			d.credentials[id].Set(request.Credentials)
+			refreshed[id] = true
+		}
+	}
+	d.mu.Unlock()
+	if len(request.Forwards) == 0 {
+		if len(refreshed) == 0 {
+			err = errors.New("no tunnel of the instance to refresh: " + request.InstanceID)
+			return nil, err
+		}
+		for id := range refreshed {
+			statuses = append(statuses, d.status(id))
+		}
+		sortTunnelStatuses(statuses)
+		return statuses, nil
+	}
+
+	credentials := NewTunnelCredentials(request.Credentials)
+	var clients *Clients
+	for _, forward := range request.Forwards {
+		id := forward.tunnelID()
+		if expanded, err := homedir.Expand(id); err == nil {
+			id = expanded
+		}
+		if refreshed[id] {
+			statuses = append(statuses, d.status(id))
+			continue
+		}
+
+		if clients == nil {
+			clients = d.NewClients(request.Region, credentials)
+		}
+		tunnel, err := startTunnel(ctx, clients, request.InstanceID, request.InstanceName, forward, nil)
+		if err != nil {
+			return statuses, err
+		}
+
+		d.mu.Lock()
+		d.tunnels[tunnel.id] = tunnel
+		d.credentials[tunnel.id] = credentials
+		d.mu.Unlock()
+		statuses = append(statuses, d.status(tunnel.id))
+	}
+	return statuses, nil
+}
+
+// The status of the tunnel with the expiry of its credentials. A tunnel which cannot reconnect because
+// the credentials expired is expired.
+func (d *TunnelDaemon) status(id string) (status TunnelStatus) {
+	d.mu.Lock()
+	tunnel, credentials := d.tunnels[id], d.credentials[id]
+	d.mu.Unlock()
+	return tunnelStatusWithCredentials(tunnel, credentials)
+}
+
+func tunnelStatusWithCredentials(tunnel *Tunnel, credentials *TunnelCredentials) (status TunnelStatus) {
+	status = tunnel.Status()
+	if credentials == nil {
+		return status
+	}
+	expires, expired := credentials.Expires()
+	status.CredentialsExpire = expires
+	if expired && status.Status != TunnelStatusConnected {
+		status.Status = TunnelStatusExpired
+	}
+	return status
+}
+
+// Stop the tunnels matching the targets, or all tunnels if targets is empty.
+func (d *TunnelDaemon) downTunnels(targets []string) (statuses TunnelStatuses) {
+	d.mu.Lock()
+	var tunnels []*Tunnel
+	var credentials []*TunnelCredentials
+	for id, tunnel := range d.tunnels {
+		if len(targets) > 0 && !containsString(targets, id) && !containsString(targets, tunnel.instanceID) {
+			continue
+		}
+		tunnels = append(tunnels, tunnel)
+		credentials = append(credentials, d.credentials[id])
+		delete(d.tunnels, id)
+		delete(d.credentials, id)
+	}
+	d.mu.Unlock()
+
+	for i, tunnel := range tunnels {
+		tunnel.Stop()
+		statuses = append(statuses, tunnelStatusWithCredentials(tunnel, credentials[i]))
+	}
+	sortTunnelStatuses(statuses)
+	return statuses
+}
+
+func (d *TunnelDaemon) statuses() (statuses TunnelStatuses) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	statuses = TunnelStatuses{}
+	for id, tunnel := range d.tunnels {
+		statuses = append(statuses, tunnelStatusWithCredentials(tunnel, d.credentials[id]))
+	}
+	sortTunnelStatuses(statuses)
+	return statuses
+}
+
+// Listen on the control socket, which only the user can connect to. A socket left by a dead daemon is removed.
+func listenTunnelSocket(socketPath string) (listener net.Listener, err error) {
+	fullPath, err := homedir.Expand(socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(fullPath), 0700); err != nil {
+		return nil, err
+	}
+
+	if conn, err := net.Dial("unix", fullPath); err == nil {
+		conn.Close()
+		err = errors.New("tunnel daemon is already running: " + fullPath)
+		return nil, err
+	}
+	if err = os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	listener, err = listenUnix(fullPath)
+	return listener, err
+}
+
+// Listen on the local address of the forward and start a session to the instance. The session is kept
+// in the background, and onReconnect is called after it is reconnected if it is not nil.
+func startTunnel(ctx context.Context, clients *Clients, instanceID, instanceName string, forward PortForward, onReconnect func(ctx context.Context) error) (tunnel *Tunnel, err error) {
+	listener, err := listenLocal(&forward)
+	if err != nil {
+		return nil, err
+	}
+
+	id := forward.tunnelID()
+
+	ctx, cancel := context.WithCancel(ctx)
+	tunnel = &Tunnel{
+		id:           id,
+		instanceID:   instanceID,
+		instanceName: instanceName,
+		forward:      forward,
+		clients:      clients,
+		onReconnect:  onReconnect,
+		started:      time.Now(),
+		cancel:       cancel,
+		done:         make(chan struct{}),
+	}
+	tunnel.proxy = NewLocalProxy(listener, tunnel.currentTarget)
+
+	session, err := tunnel.connect(ctx)
+	if err != nil {
+		cancel()
+		listener.Close()
+		return nil, err
+	}
+
+	go tunnel.keepSession(ctx, session)
+	go tunnel.proxy.Serve()
+	return tunnel, nil
+}
+
+// Stop the tunnel and wait for its session to exit.
+func (t *Tunnel) Stop() {
+	t.cancel()
+	t.proxy.Close()
+	<-t.done
+}
+
+func (t *Tunnel) Forward() PortForward {
+	return t.forward
+}
+
+func (t *Tunnel) Status() (status TunnelStatus) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status = TunnelStatus{
+		ID:           t.id,
+		InstanceID:   t.instanceID,
+		InstanceName: t.instanceName,
+		Forward:      t.forward,
+		Status:       t.status,
+		Started:      t.started,
+		Reconnects:   t.reconnects,
+		BytesIn:      t.proxy.BytesIn(),
+		BytesOut:     t.proxy.BytesOut(),
+	}
+	if t.err != nil {
+		status.Error = t.err.Error()
+	}
+	return status
+}
+
+func (t *Tunnel) setTarget(target, status string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.target = target
+	t.status = status
+	t.err = err
+	if status == TunnelStatusReconnecting {
+		t.reconnects++
+	}
+}
+
+func (t *Tunnel) currentTarget() (target string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.target
+}
+
+// Start session-manager-plugin on a free port of the loopback address, and proxy the tunnel to it.
+func (t *Tunnel) connect(ctx context.Context) (session *ForwardSession, err error) {
+	forward := PortForward{RemoteHost: t.forward.RemoteHost, RemotePort: t.forward.RemotePort}
+	session, err = startPluginSession(ctx, t.clients, t.instanceID, forward)
+	if err != nil {
+		return nil, err
+	}
+	t.setTarget(net.JoinHostPort(ConnectHost, session.LocalPort), TunnelStatusConnected, nil)
+	return session, nil
+}
+
+// Monitor the session, and reconnect with a new session when session-manager-plugin exits.
+func (t *Tunnel) keepSession(ctx context.Context, session *ForwardSession) {
+	defer close(t.done)
+
+	delay := TunnelReconnectMinDelay
+	for {
+		var err error
+		select {
+		case <-session.done:
+			err = fmt.Errorf("session-manager-plugin exited: %v", session.err)
+			session.Stop()
+		case <-ctx.Done():
+			session.Stop()
+			return
+		}
+
+		for {
+			log.Printf("tunnel %s (%s %s): %v, reconnect in %s", t.id, t.instanceID, t.forward.Remote(), err, delay)
+			t.setTarget("", TunnelStatusReconnecting, err)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			if delay *= 2; delay > TunnelReconnectMaxDelay {
+				delay = TunnelReconnectMaxDelay
+			}
+
+			if session, err = t.connect(ctx); err == nil {
+				break
+			}
+		}
+		delay = TunnelReconnectMinDelay
+
+		if t.onReconnect != nil {
+			if err := t.onReconnect(ctx); err != nil {
+				log.Printf("tunnel %s (%s %s): %v", t.id, t.instanceID, t.forward.Remote(), err)
+			}
+		}
+	}
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Sort the statuses by the local port. Socket paths are sorted by name after the ports.
+func sortTunnelStatuses(statuses TunnelStatuses) {
+	sort.Slice(statuses, func(i, j int) bool {
+		a, errA := strconv.Atoi(statuses[i].ID)
+		b, errB := strconv.Atoi(statuses[j].ID)
+		switch {
+		case errA == nil && errB == nil:
+			return a < b
+		case errA == nil || errB == nil:
+			return errA == nil
+		default:
+			return statuses[i].ID < statuses[j].ID
+		}
+	})
+}
+
+// Send the request to the tunnel daemon. ErrTunnelDaemonNotRunning is returned if no daemon listens on the socket.
+func sendTunnelRequest(socketPath string, request TunnelRequest) (response TunnelResponse, err error) {
+	fullPath, err := homedir.Expand(socketPath)
+	if err != nil {
+		return TunnelResponse{}, err
+	}
+
+	conn, err := net.Dial("unix", fullPath)
+	if err != nil {
+		return TunnelResponse{}, ErrTunnelDaemonNotRunning
+	}
+	defer conn.Close()
+
+	if err = json.NewEncoder(conn).Encode(request); err != nil {
+		return TunnelResponse{}, err
+	}
+	if err = json.NewDecoder(conn).Decode(&response); err != nil {
+		return TunnelResponse{}, err
+	}
+	if response.Error != "" {
+		return response, errors.New(response.Error)
+	}
+	return response, nil
+}
+
+// Start `awssh tunnel daemon` detached from the terminal, and wait until it listens on the socket.
+func startTunnelDaemon(socketPath, logPath string) (err error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	fullLogPath, err := homedir.Expand(logPath)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(fullLogPath), 0700); err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(fullLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	command := exec.Command(executable, "tunnel", "daemon")
+	command.Stdout = logFile
+	command.Stderr = logFile
+	command.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err = command.Start(); err != nil {
+		return err
+	}
+	command.Process.Release()
+
+	deadline := time.Now().Add(TunnelDaemonStartTimeout)
+	for time.Now().Before(deadline) {
+		if _, err = sendTunnelRequest(socketPath, TunnelRequest{Command: TunnelCommandList}); err == nil {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	err = errors.New("tunnel daemon did not start. See " + fullLogPath)
+	return err
+}
+
+func printTunnelStatuses(w io.Writer, statuses TunnelStatuses, now time.Time) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tLOCAL\tREMOTE\tINSTANCE ID\tNAME\tSTATUS\tUPTIME\tIN\tOUT\tRECONNECTS\tCREDENTIALS")
+	for _, status := range statuses {
+		state := status.Status
+		if status.Error != "" {
+			state += " (" + status.Error + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			status.ID,
+			status.Forward.Local(),
+			status.Forward.Remote(),
+			status.InstanceID,
+			status.InstanceName,
+			state,
+			now.Sub(status.Started).Round(time.Second),
+			formatBytes(status.BytesIn),
+			formatBytes(status.BytesOut),
+			status.Reconnects,
+			formatCredentialsExpire(status.CredentialsExpire, now),
+		)
+	}
+	tw.Flush()
+}
+
+// How long the credentials of the tunnel are valid, "expired", or "-" if they do not expire.
+func formatCredentialsExpire(expires, now time.Time) string {
+	if expires.IsZero() {
+		return "-"
+	}
+	if !now.Before(expires) {
+		return TunnelStatusExpired
+	}
+	return "expires in " + expires.Sub(now).Round(time.Second).String()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10) + "B"
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
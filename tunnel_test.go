@@ -0,0 +1,275 @@
+package awssh
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Wait until the only tunnel of the daemon satisfies cond.
+func waitTunnelStatus(t *testing.T, socketPath string, cond func(TunnelStatus) bool) (status TunnelStatus) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		response, err := sendTunnelRequest(socketPath, TunnelRequest{Command: TunnelCommandList})
+		if err == nil && len(response.Tunnels) == 1 && cond(response.Tunnels[0]) {
+			return response.Tunnels[0]
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for the tunnel status")
+	return TunnelStatus{}
+}
+
+func TestTunnelDaemon(t *testing.T) {
+	commandDir := setupFakeCommands(t)
+	clients, server := newFakeAwsClients(t)
+	socketPath := filepath.Join(t.TempDir(), "tunnel.sock")
+
+	daemon := NewTunnelDaemon()
+	daemon.NewClients = func(region string, credentials aws.CredentialsProvider) *Clients {
+		creds, err := credentials.Retrieve(context.Background())
+		if region != "ap-northeast-1" || err != nil || creds.AccessKeyID != "AKIAEXAMPLE" {
+			t.Errorf("NewClients(%s, %s, %v)", region, creds.AccessKeyID, err)
+		}
+		return clients
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- daemon.Serve(ctx, socketPath)
+	}()
+
+	var response TunnelResponse
+	var err error
+	for i := 0; i < 100; i++ {
+		if response, err = sendTunnelRequest(socketPath, TunnelRequest{
+			Command:      TunnelCommandUp,
+			InstanceID:   testInstanceID,
+			InstanceName: "web",
+			Forwards:     PortForwards{{RemotePort: "5432"}},
+			Region:       "ap-northeast-1",
+			Credentials:  aws.Credentials{AccessKeyID: "AKIAEXAMPLE", SecretAccessKey: "secret"},
+		}); err != ErrTunnelDaemonNotRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Tunnels) != 1 || response.Tunnels[0].ID != response.Tunnels[0].Forward.LocalPort {
+		t.Fatalf("up response = %+v", response)
+	}
+	localPort := response.Tunnels[0].ID
+
+	waitTunnelStatus(t, socketPath, func(s TunnelStatus) bool { return s.Status == TunnelStatusConnected })
+	if startSession, ok := server.request("AmazonSSM.StartSession"); !ok || startSession["Target"] != testInstanceID {
+		t.Errorf("StartSession = %v", startSession)
+	}
+
+	// The fake plugin echoes the data back.
+	conn, err := net.Dial("tcp", net.JoinHostPort(ConnectHost, localPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("read %q, %v", buf, err)
+	}
+	conn.Close()
+	waitTunnelStatus(t, socketPath, func(s TunnelStatus) bool { return s.BytesIn == 5 && s.BytesOut == 5 })
+
+	// Kill the plugin, the tunnel reconnects with a new session on the same local port.
+	pid, err := ioutil.ReadFile(filepath.Join(commandDir, "plugin.pid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := strconv.Atoi(string(pid))
+	if err := syscall.Kill(n, syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	status := waitTunnelStatus(t, socketPath, func(s TunnelStatus) bool {
+		return s.Reconnects == 1 && s.Status == TunnelStatusConnected
+	})
+	if status.ID != localPort {
+		t.Errorf("tunnel ID = %s after reconnect, want %s", status.ID, localPort)
+	}
+	if pluginArgs := strings.Split(readArgs(t, filepath.Join(commandDir, "plugin.args")), "\n"); len(pluginArgs) != 2 {
+		t.Errorf("session-manager-plugin was executed %d times, want 2", len(pluginArgs))
+	}
+
+	// Up of the instance again refreshes the credentials of the tunnel instead of starting it again.
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	refreshed := aws.Credentials{AccessKeyID: "AKIAREFRESHED", SecretAccessKey: "secret", CanExpire: true, Expires: expires}
+	for _, forwards := range []PortForwards{nil, {{LocalPort: localPort, RemotePort: "5432"}}} {
+		response, err = sendTunnelRequest(socketPath, TunnelRequest{
+			Command:     TunnelCommandUp,
+			InstanceID:  testInstanceID,
+			Forwards:    forwards,
+			Region:      "ap-northeast-1",
+			Credentials: refreshed,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Tunnels) != 1 || response.Tunnels[0].ID != localPort || !response.Tunnels[0].CredentialsExpire.Equal(expires) {
+			t.Errorf("refresh response = %+v", response)
+		}
+	}
+	daemon.mu.Lock()
+	creds, err := daemon.credentials[localPort].Retrieve(context.Background())
+	daemon.mu.Unlock()
+	if err != nil || creds.AccessKeyID != "AKIAREFRESHED" {
+		t.Errorf("credentials after refresh = %s, %v", creds.AccessKeyID, err)
+	}
+	if pluginArgs := strings.Split(readArgs(t, filepath.Join(commandDir, "plugin.args")), "\n"); len(pluginArgs) != 2 {
+		t.Errorf("session-manager-plugin was executed %d times after refresh, want 2", len(pluginArgs))
+	}
+
+	response, err = sendTunnelRequest(socketPath, TunnelRequest{Command: TunnelCommandDown, Targets: []string{testInstanceID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Tunnels) != 1 || response.Tunnels[0].ID != localPort {
+		t.Errorf("down response = %+v", response)
+	}
+
+	// The daemon exits when the last tunnel is down.
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel daemon did not exit")
+	}
+	if _, err := sendTunnelRequest(socketPath, TunnelRequest{Command: TunnelCommandList}); err != ErrTunnelDaemonNotRunning {
+		t.Errorf("sendTunnelRequest() error = %v, want ErrTunnelDaemonNotRunning", err)
+	}
+	if conn, err := net.Dial("tcp", net.JoinHostPort(ConnectHost, localPort)); err == nil {
+		conn.Close()
+		t.Error("tunnel still listens after down")
+	}
+}
+
+func TestPrintTunnelStatuses(t *testing.T) {
+	now := time.Date(2019, 10, 20, 12, 0, 0, 0, time.UTC)
+	statuses := TunnelStatuses{
+		{
+			ID:           "15432",
+			InstanceID:   "i-00000001",
+			InstanceName: "bastion",
+			Forward:      PortForward{LocalPort: "15432", RemoteHost: "db.example.com", RemotePort: "5432"},
+			Status:       TunnelStatusReconnecting,
+			Started:      now.Add(-90 * time.Minute),
+			Reconnects:   2,
+			BytesIn:      3 * 1024 * 1024,
+			BytesOut:     512,
+			Error:        "session-manager-plugin exited",
+		},
+		{
+			ID:                "/tmp/db.sock",
+			InstanceID:        "i-00000002",
+			Forward:           PortForward{LocalSocket: "/tmp/db.sock", RemotePort: "5432"},
+			Status:            TunnelStatusExpired,
+			Started:           now.Add(-2 * time.Hour),
+			CredentialsExpire: now.Add(-time.Hour),
+		},
+	}
+
+	var buf bytes.Buffer
+	printTunnelStatuses(&buf, statuses, now)
+	for _, want := range []string{"15432", "127.0.0.1:15432", "db.example.com:5432", "bastion", "reconnecting (session-manager-plugin exited)", "1h30m0s", "3.0MiB", "512B", "/tmp/db.sock", "expired"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("output does not contain %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestTunnelCredentials(t *testing.T) {
+	credentials := NewTunnelCredentials(aws.Credentials{AccessKeyID: "AKIAEXAMPLE"})
+	if expires, expired := credentials.Expires(); !expires.IsZero() || expired {
+		t.Errorf("Expires() of credentials which do not expire = %v, %v", expires, expired)
+	}
+
+	expires := time.Now().Add(-time.Minute)
+	credentials.Set(aws.Credentials{AccessKeyID: "AKIAEXPIRED", CanExpire: true, Expires: expires})
+	if _, err := credentials.Retrieve(context.Background()); err != ErrTunnelCredentialsExpired {
+		t.Errorf("Retrieve() of expired credentials error = %v, want ErrTunnelCredentialsExpired", err)
+	}
+
+	// A reconnecting tunnel cannot reconnect with the expired credentials, a connected one keeps its session.
+	tunnel := &Tunnel{proxy: &LocalProxy{}, status: TunnelStatusReconnecting}
+	if status := tunnelStatusWithCredentials(tunnel, credentials); status.Status != TunnelStatusExpired || !status.CredentialsExpire.Equal(expires) {
+		t.Errorf("status of the reconnecting tunnel = %s, expires %v", status.Status, status.CredentialsExpire)
+	}
+	tunnel.status = TunnelStatusConnected
+	if status := tunnelStatusWithCredentials(tunnel, credentials); status.Status != TunnelStatusConnected {
+		t.Errorf("status of the connected tunnel = %s", status.Status)
+	}
+}
+
+func TestSortTunnelStatuses(t *testing.T) {
+	statuses := TunnelStatuses{{ID: "/tmp/b.sock"}, {ID: "8080"}, {ID: "/tmp/a.sock"}, {ID: "15432"}}
+	sortTunnelStatuses(statuses)
+
+	var ids []string
+	for _, status := range statuses {
+		ids = append(ids, status.ID)
+	}
+	if got := strings.Join(ids, " "); got != "8080 15432 /tmp/a.sock /tmp/b.sock" {
+		t.Errorf("sorted IDs = %s", got)
+	}
+}
+
+func TestFormatCredentialsExpire(t *testing.T) {
+	now := time.Date(2019, 10, 20, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		expires time.Time
+		want    string
+	}{
+		{time.Time{}, "-"},
+		{now.Add(45 * time.Minute), "expires in 45m0s"},
+		{now, TunnelStatusExpired},
+	}
+
+	for _, tt := range tests {
+		if got := formatCredentialsExpire(tt.expires, now); got != tt.want {
+			t.Errorf("formatCredentialsExpire(%v) = %s, want %s", tt.expires, got, tt.want)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1.0KiB"},
+		{1536, "1.5KiB"},
+		{5 * 1024 * 1024 * 1024, "5.0GiB"},
+	}
+
+	for _, tt := range tests {
+		if got := formatBytes(tt.n); got != tt.want {
+			t.Errorf("formatBytes(%d) = %s, want %s", tt.n, got, tt.want)
+		}
+	}
+}